@@ -0,0 +1,546 @@
+package main
+
+import (
+	"criblPatching/functions"
+	"criblPatching/vars"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// commands are run as `criblPatching <command> [flags]`. Without a command the tool replicates an object.
+var commands = map[string]func(args []string){
+	"secrets-encrypt": secretsEncryptCommand,
+	"secrets-decrypt": secretsDecryptCommand,
+	"apply":           applyCommand,
+	"state":           stateCommand,
+	"audit-verify":    auditVerifyCommand,
+	"force-unlock":    forceUnlockCommand,
+	"compare":         compareCommand,
+}
+
+// The state file, audit log and lock files are kept in one place per user, e.g. ~/.config/criblPatching, so every run
+// shares them wherever it is started from
+var (
+	defaultStateFile    = filepath.Join(defaultDataDir(), "state.json")
+	defaultAuditLogFile = filepath.Join(defaultDataDir(), "audit.jsonl")
+	defaultLockDir      = filepath.Join(defaultDataDir(), "locks")
+)
+
+// defaultDataDir is the per-user directory for the tool's local records, a .criblPatching directory in the working
+// directory if the user has no config directory
+func defaultDataDir() string {
+	configDir, configErr := os.UserConfigDir()
+	if configErr != nil {
+		return ".criblPatching"
+	}
+	return filepath.Join(configDir, "criblPatching")
+}
+
+func secretsPassphrase() string {
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Error loading .env file, relying on environment variables alone")
+	}
+	passphrase := os.Getenv("CRIBL_SECRETS_PASSPHRASE")
+	if passphrase == "" {
+		log.Fatal("CRIBL_SECRETS_PASSPHRASE must be set to encrypt or decrypt the secrets file")
+	}
+	return passphrase
+}
+
+func secretsEncryptCommand(args []string) {
+	fs := flag.NewFlagSet("secrets-encrypt", flag.ExitOnError)
+	in := fs.String("in", "", "Plaintext secrets JSON file")
+	out := fs.String("out", "", "Encrypted secrets file to write")
+	fs.Parse(args)
+	if *in == "" || *out == "" {
+		log.Fatal("-in and -out are required")
+	}
+
+	if encryptErr := functions.EncryptSecretsFile(*in, *out, secretsPassphrase()); encryptErr != nil {
+		log.Fatal("Fatal error encountered: ", encryptErr)
+	}
+	log.Printf("Encrypted %s to %s. Remove the plaintext file once you've checked the encrypted one works", *in, *out)
+}
+
+func secretsDecryptCommand(args []string) {
+	fs := flag.NewFlagSet("secrets-decrypt", flag.ExitOnError)
+	in := fs.String("in", "", "Encrypted secrets file")
+	out := fs.String("out", "", "Plaintext secrets JSON file to write")
+	fs.Parse(args)
+	if *in == "" || *out == "" {
+		log.Fatal("-in and -out are required")
+	}
+
+	plaintext, decryptErr := functions.DecryptSecretsFile(*in, secretsPassphrase())
+	if decryptErr != nil {
+		log.Fatal("Fatal error encountered: ", decryptErr)
+	}
+	if writeErr := os.WriteFile(*out, plaintext, 0600); writeErr != nil {
+		log.Fatal("Fatal error encountered: ", writeErr)
+	}
+	log.Printf("Decrypted %s to %s", *in, *out)
+}
+
+// applyCommand executes a plan written with -planOut. Worker groups whose object changed since the plan was made are
+// skipped, the plan has to be made again for them.
+func applyCommand(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	planFile := fs.String("plan", "", "Signed plan file written with -planOut")
+	requestTimeout := fs.Duration("requestTimeout", 60*time.Second, "(Optional) Timeout for each attempt of an API call")
+	runTimeout := fs.Duration("runTimeout", 0, "(Optional) Timeout for the whole run, e.g. 15m. In-flight requests are cancelled when it expires")
+	stateFile := fs.String("stateFile", defaultStateFile, "(Optional) Local file recording what was deployed to each worker group. Empty to not record")
+	auditLogFile := fs.String("auditLog", defaultAuditLogFile, "(Optional) Append-only, hash chained log of every attempted change on a leader, HMACed with CRIBL_AUDIT_KEY when set. Empty to not log")
+	lockDir := fs.String("lockDir", defaultLockDir, "(Optional) Directory of lock files that stop two runs changing the same worker group at once. Empty to not lock")
+	lockTtl := fs.Duration("lockTtl", time.Hour, "(Optional) How long the locks last unless renewed. They are renewed while the run is going, so this is how long a run that died keeps them")
+	leaderLock := fs.Bool("leaderLock", false, "(Optional) Also lock each worker group on the leader with a marker global variable. A run that died leaves it behind, remove it with force-unlock -leader")
+	verify := fs.Bool("verify", true, "(Optional) Read each object back after it is pushed and fail the worker group if fields were dropped or changed")
+	verifyIgnore := fs.String("verifyIgnore", "", "(Optional) Comma separated paths that are expected to differ after -verify, e.g. conf.output,description")
+	fs.Parse(args)
+	if *planFile == "" {
+		log.Fatal("-plan is required")
+	}
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Error loading .env file, relying on environment variables alone")
+	}
+	if *auditLogFile != "" {
+		setAuditLog(*auditLogFile)
+	}
+	plan, planErr := functions.LoadPlan(*planFile, os.Getenv("CRIBL_PLAN_SIGNING_KEY"))
+	if planErr != nil {
+		log.Fatal("Fatal error encountered: ", planErr)
+	}
+
+	functions.SetTimeouts(*requestTimeout, 30*time.Minute)
+	stop := handleInterrupts(*runTimeout)
+
+	targetUrl, targetUser, targetPass, transportErr := leaderFromEnv(targetEnvPrefix(plan.Env))
+	if transportErr != nil {
+		log.Fatal("Fatal error encountered: ", transportErr)
+	}
+	if targetUrl != plan.TargetUrl {
+		log.Fatalf("Plan %s was made for leader %s but env %s is configured for %s", *planFile, plan.TargetUrl, plan.Env, targetUrl)
+	}
+	targetToken, targetTokenErr := functions.TokenApiCall(targetUrl, targetUser, targetPass)
+	if targetTokenErr != nil {
+		log.Fatal("Fatal error encountered: ", targetTokenErr)
+	}
+
+	log.Printf("Applying plan %s made by %s at %s: %s %s '%s' on %d worker group(s)", *planFile, plan.Operator, plan.CreatedAt.Format(time.RFC3339), plan.Action, plan.ObjType, plan.ObjId, len(plan.Groups))
+
+	var workerGroups []string
+	for _, group := range plan.Groups {
+		workerGroups = append(workerGroups, group.WorkerGroup)
+	}
+	var locker *functions.RunLocker
+	if *lockDir != "" {
+		locker = functions.NewRunLocker(*lockDir, *lockTtl)
+		if *leaderLock {
+			locker.WithLeaderLock(targetUrl, targetToken)
+		}
+		if lockErr := locker.Acquire(plan.Env, workerGroups); lockErr != nil {
+			log.Fatal("Aborting before any worker group was changed: ", lockErr)
+		}
+		defer releaseLocks(locker)
+	}
+
+	var state *functions.StateStore
+	if *stateFile != "" {
+		state = functions.OpenStateStore(*stateFile)
+	}
+	verifyIgnoreFields := splitFieldPaths(*verifyIgnore)
+	summary := newRunSummary(workerGroups)
+	for _, group := range plan.Groups {
+		if stop.Err() != nil {
+			log.Printf("Stop requested, not applying the plan to remaining worker groups")
+			break
+		}
+		if applyErr := applyPlanGroup(targetUrl, targetToken, plan, group, *verify, verifyIgnoreFields); applyErr != nil {
+			log.Printf("Skipped %s %s '%s' on worker group '%s' due to the following error: %v", plan.Action, plan.ObjType, plan.ObjId, group.WorkerGroup, applyErr)
+			summary.fail(group.WorkerGroup, applyErr)
+		} else {
+			log.Printf("Successfully applied %s %s '%s' on worker group '%s'", plan.Action, plan.ObjType, plan.ObjId, group.WorkerGroup)
+			summary.done(group.WorkerGroup)
+			payloadHash, _ := functions.ConfigHash(group.Payload)
+			recordState(state, plan.Env, targetUrl, group.WorkerGroup, plan.ObjType, plan.ObjId, payloadHash, plan.Action+"d")
+		}
+	}
+	summary.print(plan.ObjType, plan.ObjId)
+
+	if summary.failed() || stop.Err() != nil && len(summary.groups(groupUntouched)) > 0 {
+		// os.Exit skips deferred calls. Releasing works even when the run was cancelled.
+		if locker != nil {
+			releaseLocks(locker)
+		}
+		os.Exit(1)
+	}
+}
+
+// applyPlanGroup pushes a planned payload, as long as the worker group is still in the state the plan expects, and
+// reads it back to verify it unless verify is off
+func applyPlanGroup(targetBaseApiUrl string, targetToken string, plan *functions.Plan, group functions.PlanGroup, verify bool, verifyIgnore []string) error {
+	currentHash, _, stateErr := targetState(targetBaseApiUrl, group.WorkerGroup, targetToken, plan.ObjType, plan.ObjId)
+	if stateErr != nil {
+		return fmt.Errorf("unable to check its current state: %w", stateErr)
+	}
+	if currentHash != group.ExpectedHash {
+		return fmt.Errorf("it changed since the plan was made (expected %s, found %s), make a new plan", describeHash(group.ExpectedHash), describeHash(currentHash))
+	}
+
+	var pushErr error
+	if plan.Action == "create" {
+		pushErr = functions.CreateDataObj(targetBaseApiUrl, group.WorkerGroup, targetToken, plan.ObjId, group.Payload, plan.ObjType)
+	} else {
+		pushErr = functions.UpdateDataObj(targetBaseApiUrl, group.WorkerGroup, targetToken, plan.ObjId, group.Payload, plan.ObjType)
+	}
+	if pushErr != nil || !verify {
+		return pushErr
+	}
+	return verifyReadBack(targetBaseApiUrl, group.WorkerGroup, targetToken, plan.ObjType, plan.ObjId, group.Payload, verifyIgnore)
+}
+
+func describeHash(hash string) string {
+	if hash == "" {
+		return "no object"
+	}
+	return "hash " + hash[:12]
+}
+
+// stateCommand answers "what is deployed where" from the state file, e.g. `state -objType pipeline -id main -wg wg1`
+func stateCommand(args []string) {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	stateFile := fs.String("stateFile", defaultStateFile, "State file written by previous runs")
+	var filter functions.StateFilter
+	fs.StringVar(&filter.Env, "env", "", "(Optional) Only this env (Uat or Prod)")
+	fs.StringVar(&filter.WorkerGroup, "wg", "", "(Optional) Only this worker group")
+	fs.StringVar(&filter.ObjType, "objType", "", "(Optional) Only this object type")
+	fs.StringVar(&filter.ObjId, "id", "", "(Optional) Only this object id")
+	history := fs.Bool("history", false, "(Optional) List every recorded deployment instead of only the latest per worker group and object")
+	asJson := fs.Bool("json", false, "(Optional) Print JSON instead of a table")
+	fs.Parse(args)
+
+	state := functions.OpenStateStore(*stateFile)
+	var (
+		entries  []functions.StateEntry
+		queryErr error
+	)
+	if *history {
+		entries, queryErr = state.History(filter)
+	} else {
+		entries, queryErr = state.Current(filter)
+	}
+	if queryErr != nil {
+		log.Fatal("Fatal error encountered: ", queryErr)
+	}
+
+	if *asJson {
+		entriesJson, _ := json.MarshalIndent(entries, "", "  ")
+		fmt.Println(string(entriesJson))
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No deployments recorded in %s match\n", *stateFile)
+		return
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "ENV\tWORKER GROUP\tTYPE\tID\tHASH\tRESULT\tWHEN\tOPERATOR")
+	for _, entry := range entries {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%.12s\t%s\t%s\t%s\n", entry.Env, entry.WorkerGroup, entry.ObjType, entry.ObjId, entry.ContentHash, entry.Result, entry.Timestamp.Local().Format(time.RFC3339), entry.Operator)
+	}
+	table.Flush()
+}
+
+func auditVerifyCommand(args []string) {
+	fs := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	auditLogFile := fs.String("auditLog", defaultAuditLogFile, "Audit log to verify")
+	head := fs.String("head", "", "(Optional) seq:hash of an entry recorded outside the log, e.g. printed by an earlier audit-verify, that the log must still reach")
+	fs.Parse(args)
+
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Error loading .env file, relying on environment variables alone")
+	}
+	report, verifyErr := auditVerifyReport(*auditLogFile, os.Getenv("CRIBL_AUDIT_KEY"), *head)
+	if verifyErr != nil {
+		log.Fatalf("Audit log verification FAILED: %v", verifyErr)
+	}
+	log.Print(report)
+}
+
+// auditVerifyReport verifies the audit log and describes its head, which is worth recording somewhere else: the log
+// alone can't show it was cut short
+func auditVerifyReport(auditLogFile string, auditKey string, head string) (string, error) {
+	last, verifyErr := functions.VerifyAuditLog(auditLogFile, auditKey, head)
+	if verifyErr != nil {
+		return "", fmt.Errorf("%w (%d good entries before the failure)", verifyErr, last.Seq)
+	}
+	keyed := "keyed"
+	if auditKey == "" {
+		keyed = "unkeyed"
+	}
+	return fmt.Sprintf("Audit log %s is intact, %d %s entries verified, head %d:%s", auditLogFile, last.Seq, keyed, last.Seq, last.Hash), nil
+}
+
+// forceUnlockCommand removes locks left behind by a run that died, or that is known to be stuck
+func forceUnlockCommand(args []string) {
+	fs := flag.NewFlagSet("force-unlock", flag.ExitOnError)
+	var (
+		env          vars.Env
+		workerGroups vars.WorkerGroupList
+	)
+	fs.Var(&env, "env", "The env the locks were taken for (Uat or Prod)")
+	fs.Var(&workerGroups, "wgList", "Worker groups to unlock")
+	lockDir := fs.String("lockDir", defaultLockDir, "(Optional) Directory of lock files")
+	leader := fs.Bool("leader", false, "(Optional) Also remove the marker global variable lock on the leader")
+	fs.Parse(args)
+	if env == "" || len(workerGroups) == 0 {
+		log.Fatal("-env and -wgList are required")
+	}
+	envName := strings.ToLower(string(env))
+
+	for _, workerGroup := range workerGroups {
+		holder, wasLocked, unlockErr := functions.ForceUnlockLocal(*lockDir, envName, workerGroup)
+		switch {
+		case unlockErr != nil:
+			log.Printf("Unable to remove the local lock of worker group '%s': %v", workerGroup, unlockErr)
+		case wasLocked:
+			log.Printf("Removed the local lock of worker group '%s' held by %s", workerGroup, holder)
+		default:
+			log.Printf("Worker group '%s' has no local lock", workerGroup)
+		}
+	}
+	if !*leader {
+		return
+	}
+
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Error loading .env file, relying on environment variables alone")
+	}
+	targetUrl, targetUser, targetPass, transportErr := leaderFromEnv(targetEnvPrefix(envName))
+	if transportErr != nil {
+		log.Fatal("Fatal error encountered: ", transportErr)
+	}
+	targetToken, targetTokenErr := functions.TokenApiCall(targetUrl, targetUser, targetPass)
+	if targetTokenErr != nil {
+		log.Fatal("Fatal error encountered: ", targetTokenErr)
+	}
+	for _, workerGroup := range workerGroups {
+		holder, wasLocked, unlockErr := functions.ForceUnlockLeader(targetUrl, workerGroup, targetToken)
+		switch {
+		case unlockErr != nil:
+			log.Printf("Unable to remove the leader lock of worker group '%s': %v", workerGroup, unlockErr)
+		case wasLocked:
+			log.Printf("Removed the leader lock of worker group '%s' held by %s", workerGroup, holder)
+		default:
+			log.Printf("Worker group '%s' has no leader lock", workerGroup)
+		}
+	}
+}
+
+// groupRef is a worker group on the leader of an env, written env:group, e.g. uat:default. The template leader's env
+// is "template".
+type groupRef struct {
+	env         string
+	workerGroup string
+}
+
+func parseGroupRef(ref string) (groupRef, error) {
+	env, workerGroup, hasEnv := strings.Cut(ref, ":")
+	env = strings.ToLower(strings.TrimSpace(env))
+	workerGroup = strings.TrimSpace(workerGroup)
+	if !hasEnv || workerGroup == "" {
+		return groupRef{}, fmt.Errorf("worker group '%s' must be in the form env:group, e.g. uat:default", ref)
+	}
+	if env != "template" && env != "uat" && env != "prod" {
+		return groupRef{}, fmt.Errorf("invalid env in '%s'. Valid options are: template, uat, or prod", ref)
+	}
+	return groupRef{env: env, workerGroup: workerGroup}, nil
+}
+
+func (g groupRef) String() string {
+	return g.env + ":" + g.workerGroup
+}
+
+// login returns the url of the group's leader and a token for it
+func (g groupRef) login() (string, string, error) {
+	prefix := "TEMPLATE"
+	if g.env != "template" {
+		prefix = targetEnvPrefix(g.env)
+	}
+	baseUrl, user, pass, transportErr := leaderFromEnv(prefix)
+	if transportErr != nil {
+		return "", "", transportErr
+	}
+	token, tokenErr := functions.TokenApiCall(baseUrl, user, pass)
+	if tokenErr != nil {
+		return "", "", tokenErr
+	}
+	return baseUrl, token, nil
+}
+
+// compareCommand shows how two worker groups differ without changing either, e.g. `compare -a uat:default -b prod:default`
+func compareCommand(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	leftRef := fs.String("a", "", "First worker group as env:group (env is template, uat, or prod)")
+	rightRef := fs.String("b", "", "Second worker group as env:group")
+	objTypesList := fs.String("objTypes", "", "(Optional) Comma separated object types to compare, all types including Lookup by default")
+	ignoreList := fs.String("ignore", "", "(Optional) Comma separated paths to ignore when diffing, e.g. description,conf.output")
+	showSame := fs.Bool("all", false, "(Optional) Also list objects that are the same in both worker groups")
+	diffFormat := fs.String("diff", "", "(Optional) Also print each different object's changes, with credentials redacted: color, plain, or markdown")
+	asJson := fs.Bool("json", false, "(Optional) Print JSON instead of a table")
+	requestTimeout := fs.Duration("requestTimeout", 60*time.Second, "(Optional) Timeout for each attempt of an API call")
+	fs.Parse(args)
+
+	left, leftErr := parseGroupRef(*leftRef)
+	if leftErr != nil {
+		log.Fatal("-a: ", leftErr)
+	}
+	right, rightErr := parseGroupRef(*rightRef)
+	if rightErr != nil {
+		log.Fatal("-b: ", rightErr)
+	}
+	if *diffFormat != "" && !functions.IsDiffFormat(*diffFormat) {
+		log.Fatalf("Invalid -diff format %s. Valid options are: color, plain, or markdown", *diffFormat)
+	}
+	objTypes := append(functions.DataObjTypes(), "lookup")
+	if *objTypesList != "" {
+		objTypes = nil
+		for _, objType := range strings.Split(*objTypesList, ",") {
+			objType = strings.ToLower(strings.TrimSpace(objType))
+			if objType != "lookup" && !functions.IsDataObjType(objType) {
+				log.Fatalf("Invalid object type %s. Valid options are: %s, or lookup", objType, strings.Join(functions.DataObjTypes(), ", "))
+			}
+			objTypes = append(objTypes, objType)
+		}
+	}
+	ignoreFields := splitFieldPaths(*ignoreList)
+
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Error loading .env file, relying on environment variables alone")
+	}
+	functions.SetTimeouts(*requestTimeout, 30*time.Minute)
+	leftUrl, leftToken, loginErr := left.login()
+	if loginErr != nil {
+		log.Fatalf("Fatal error encountered logging in for %s: %v", left, loginErr)
+	}
+	rightUrl, rightToken, loginErr := right.login()
+	if loginErr != nil {
+		log.Fatalf("Fatal error encountered logging in for %s: %v", right, loginErr)
+	}
+
+	comparisons, compareErr := compareGroups(leftUrl, left.workerGroup, leftToken, rightUrl, right.workerGroup, rightToken, objTypes, ignoreFields)
+	if compareErr != nil {
+		log.Fatal("Fatal error encountered: ", compareErr)
+	}
+	counts := map[string]int{}
+	var listed []functions.ObjectComparison
+	for _, comparison := range comparisons {
+		counts[comparison.Status]++
+		if comparison.Status != functions.CompareSame || *showSame {
+			listed = append(listed, comparison)
+		}
+	}
+
+	if *asJson {
+		report, _ := json.MarshalIndent(struct {
+			A       string                       `json:"a"`
+			B       string                       `json:"b"`
+			Objects []functions.ObjectComparison `json:"objects"`
+		}{A: left.String(), B: right.String(), Objects: listed}, "", "  ")
+		fmt.Println(string(report))
+		return
+	}
+
+	statusText := map[string]string{
+		functions.CompareOnlyLeft:      "only in " + left.String(),
+		functions.CompareOnlyRight:     "only in " + right.String(),
+		functions.CompareDifferent:     "different",
+		functions.CompareSame:          "same",
+		functions.CompareSecretUnknown: "secret differs (unknown)",
+	}
+	if len(listed) > 0 {
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "TYPE\tID\tSTATUS\tCHANGES")
+		for _, comparison := range listed {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", comparison.ObjType, comparison.ObjId, statusText[comparison.Status], functions.DescribeChanges(comparison.Changes))
+		}
+		table.Flush()
+	}
+	fmt.Printf("%s vs %s: %d only in %s, %d only in %s, %d different, %d with secrets that can't be compared, %d the same\n", left, right, counts[functions.CompareOnlyLeft], left, counts[functions.CompareOnlyRight], right, counts[functions.CompareDifferent], counts[functions.CompareSecretUnknown], counts[functions.CompareSame])
+
+	if *diffFormat == "" {
+		return
+	}
+	for _, comparison := range listed {
+		if len(comparison.Changes) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s '%s':\n", comparison.ObjType, comparison.ObjId)
+		fmt.Print(functions.RenderDiff(comparison.Changes, left.String(), right.String(), *diffFormat))
+	}
+}
+
+// compareGroups compares every object of each type in two worker groups, which may be on different leaders. Lookups
+// are compared by a hash of their content.
+func compareGroups(leftUrl string, leftGroup string, leftToken string, rightUrl string, rightGroup string, rightToken string, objTypes []string, ignoreFields []string) ([]functions.ObjectComparison, error) {
+	var comparisons []functions.ObjectComparison
+	for _, objType := range objTypes {
+		if objType == "lookup" {
+			leftHashes, leftErr := lookupHashes(leftUrl, leftGroup, leftToken)
+			if leftErr != nil {
+				return nil, leftErr
+			}
+			rightHashes, rightErr := lookupHashes(rightUrl, rightGroup, rightToken)
+			if rightErr != nil {
+				return nil, rightErr
+			}
+			comparisons = append(comparisons, functions.CompareHashes(objType, leftHashes, rightHashes)...)
+			continue
+		}
+
+		leftObjs, leftErr := functions.ListDataObjs(leftUrl, leftGroup, leftToken, objType)
+		if leftErr != nil {
+			return nil, leftErr
+		}
+		rightObjs, rightErr := functions.ListDataObjs(rightUrl, rightGroup, rightToken, objType)
+		if rightErr != nil {
+			return nil, rightErr
+		}
+		// A run's lock marker isn't config, it only shows which group a run happens to be changing
+		if objType == "globalvariable" {
+			delete(leftObjs, functions.LeaderLockVarId)
+			delete(rightObjs, functions.LeaderLockVarId)
+		}
+		comparisons = append(comparisons, functions.CompareConfigs(objType, leftObjs, rightObjs, ignoreFields)...)
+	}
+	return comparisons, nil
+}
+
+// lookupHashes downloads each lookup in a worker group in turn to hash its content
+func lookupHashes(baseApiUrl string, workerGroup string, token string) (map[string]string, error) {
+	lookupIds, listErr := functions.ListLookups(baseApiUrl, workerGroup, token)
+	if listErr != nil {
+		return nil, listErr
+	}
+	hashes := map[string]string{}
+	for _, lookupId := range lookupIds {
+		lookupFile, downloadErr := functions.DownloadLookupToFile(baseApiUrl, workerGroup, token, lookupId)
+		if downloadErr != nil {
+			return nil, downloadErr
+		}
+		hash, hashErr := functions.LookupContentHash(lookupId, lookupFile)
+		os.Remove(lookupFile)
+		if hashErr != nil {
+			return nil, hashErr
+		}
+		hashes[lookupId] = hash
+	}
+	return hashes, nil
+}
@@ -0,0 +1,634 @@
+// Package fakeleader is an in-process stand-in for a Cribl leader's REST API, used to exercise the functions
+// package and the replicate commands without a real deployment. All state is held in memory.
+package fakeleader
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Collections are the config object endpoints (relative to /api/v1/m/{group}/) the fake leader serves CRUD for
+var Collections = []string{
+	"system/inputs",
+	"system/outputs",
+	"pipelines",
+	"lib/vars",
+	"lib/breakers",
+	"lib/parsers",
+	"lib/regex",
+	"lib/grok",
+	"lib/schemas",
+	"lib/parquet-schemas",
+	"lib/jobs",
+	"notification-targets",
+	"notifications",
+	"system/secrets",
+	"system/certificates",
+}
+
+// Failure makes matching requests fail with the given status instead of being handled.
+// Times is how many matching requests fail before the failure is used up, 0 means every matching request fails.
+type Failure struct {
+	Method       string
+	PathContains string
+	Status       int
+	Message      string
+	Times        int
+}
+
+// RecordedRequest is a request the fake leader received, kept so tests can assert on what was sent
+type RecordedRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Body   []byte
+}
+
+type groupState struct {
+	objects map[string]map[string]map[string]interface{}
+	uploads map[string][]byte
+	lookups map[string][]byte
+	// Served by /master/workers and the group's metrics endpoint for rollout health gates
+	connectedWorkers    int
+	disconnectedWorkers int
+	metrics             map[string]float64
+	// Commits made with /version/commit, and the one last deployed to the group's workers
+	commits  []string
+	deployed string
+}
+
+type Leader struct {
+	URL string
+
+	server    *httptest.Server
+	mu        sync.Mutex
+	username  string
+	password  string
+	token     string
+	groups    map[string]*groupState
+	failures  []*Failure
+	requests  []RecordedRequest
+	onSave    func(collection string, obj map[string]interface{})
+	onRequest func(req RecordedRequest)
+}
+
+// New starts a fake leader that accepts the given credentials and serves the given worker groups
+func New(username string, password string, groups ...string) *Leader {
+	l := &Leader{
+		username: username,
+		password: password,
+		token:    randomHex(16),
+		groups:   map[string]*groupState{},
+	}
+	for _, group := range groups {
+		l.AddGroup(group)
+	}
+
+	l.server = httptest.NewServer(http.HandlerFunc(l.serveHTTP))
+	l.URL = l.server.URL
+	return l
+}
+
+func (l *Leader) Close() {
+	l.server.Close()
+}
+
+func (l *Leader) AddGroup(group string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, exists := l.groups[group]; exists {
+		return
+	}
+	gs := &groupState{
+		objects: map[string]map[string]map[string]interface{}{},
+		uploads: map[string][]byte{},
+		lookups: map[string][]byte{},
+		// One connected worker, matching the workerCount reported for every group
+		connectedWorkers: 1,
+		metrics:          map[string]float64{},
+	}
+	for _, collection := range Collections {
+		gs.objects[collection] = map[string]map[string]interface{}{}
+	}
+	l.groups[group] = gs
+}
+
+// SetObject stores an object as if it had been created in the leader UI
+func (l *Leader) SetObject(group string, collection string, id string, obj map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stored := copyObject(obj)
+	stored["id"] = id
+	l.groups[group].objects[collection][id] = stored
+}
+
+// Object returns a copy of the stored object, or false if it doesn't exist
+func (l *Leader) Object(group string, collection string, id string) (map[string]interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	gs, ok := l.groups[group]
+	if !ok {
+		return nil, false
+	}
+	obj, ok := gs.objects[collection][id]
+	if !ok {
+		return nil, false
+	}
+	return copyObject(obj), true
+}
+
+func (l *Leader) SetLookup(group string, id string, content []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.groups[group].lookups[id] = append([]byte(nil), content...)
+}
+
+func (l *Leader) Lookup(group string, id string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	gs, ok := l.groups[group]
+	if !ok {
+		return nil, false
+	}
+	content, ok := gs.lookups[id]
+	return append([]byte(nil), content...), ok
+}
+
+// SetWorkers sets how many of the group's workers are connected and disconnected
+func (l *Leader) SetWorkers(group string, connected int, disconnected int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.groups[group].connectedWorkers = connected
+	l.groups[group].disconnectedWorkers = disconnected
+}
+
+// AddMetric increases one of the group's cumulative metrics, e.g. total.in_events
+func (l *Leader) AddMetric(group string, name string, value float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.groups[group].metrics[name] += value
+}
+
+// Deployed returns the commit last deployed to the group's workers, "" if nothing was deployed
+func (l *Leader) Deployed(group string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.groups[group].deployed
+}
+
+func (l *Leader) InjectFailure(f Failure) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failure := f
+	l.failures = append(l.failures, &failure)
+}
+
+// OnSave changes objects as they are created or updated, like a real leader filling in defaults, normalizing values
+// or encrypting secrets when it stores them
+func (l *Leader) OnSave(hook func(collection string, obj map[string]interface{})) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onSave = hook
+}
+
+// OnRequest is called with every request before it is handled, outside the leader's lock so it can change the
+// leader's objects, e.g. to simulate someone editing a worker group in the UI part way through a run
+func (l *Leader) OnRequest(hook func(req RecordedRequest)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onRequest = hook
+}
+
+// Requests returns every request received so far, in order
+func (l *Leader) Requests() []RecordedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]RecordedRequest(nil), l.requests...)
+}
+
+func (l *Leader) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	l.mu.Lock()
+	onRequest := l.onRequest
+	l.mu.Unlock()
+	if onRequest != nil {
+		onRequest(RecordedRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: body})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.requests = append(l.requests, RecordedRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Body: body})
+
+	if failure := l.matchFailure(r); failure != nil {
+		message := failure.Message
+		if message == "" {
+			message = fmt.Sprintf("injected failure (%d)", failure.Status)
+		}
+		writeError(w, failure.Status, message)
+		return
+	}
+
+	if r.URL.Path == "/api/v1/auth/login" {
+		l.handleLogin(w, r, body)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+l.token {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if r.URL.Path == "/api/v1/master/groups" && r.Method == http.MethodGet {
+		l.handleGroups(w)
+		return
+	}
+	if r.URL.Path == "/api/v1/master/workers" && r.Method == http.MethodGet {
+		l.handleWorkers(w)
+		return
+	}
+	if r.URL.Path == "/api/v1/version/commit" && r.Method == http.MethodPost {
+		l.handleCommit(w, body)
+		return
+	}
+	if group, isDeploy := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/master/groups/"), "/deploy"); isDeploy && r.Method == http.MethodPatch {
+		l.handleDeploy(w, group, body)
+		return
+	}
+
+	group, rest, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/m/"), "/")
+	if !found || !strings.HasPrefix(r.URL.Path, "/api/v1/m/") {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	gs, ok := l.groups[group]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Worker group %s not found", group))
+		return
+	}
+
+	rest = strings.TrimSuffix(rest, "/")
+	if rest == "system/metrics" && r.Method == http.MethodGet {
+		items := []map[string]interface{}{}
+		for _, name := range sortedKeys(gs.metrics) {
+			items = append(items, map[string]interface{}{"name": name, "value": gs.metrics[name]})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "count": len(items)})
+		return
+	}
+	if rest == "preview" && r.Method == http.MethodPost {
+		l.handlePreview(w, gs, body)
+		return
+	}
+	if rest == "system/lookups" || strings.HasPrefix(rest, "system/lookups/") {
+		l.handleLookups(w, r, gs, strings.TrimPrefix(strings.TrimPrefix(rest, "system/lookups"), "/"), body)
+		return
+	}
+
+	for _, collection := range Collections {
+		if rest == collection {
+			l.handleCollection(w, r, collection, gs.objects[collection], body)
+			return
+		}
+		if id, isItem := strings.CutPrefix(rest, collection+"/"); isItem && !strings.Contains(id, "/") {
+			l.handleItem(w, r, collection, gs.objects[collection], id, body)
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "Not Found")
+}
+
+func (l *Leader) matchFailure(r *http.Request) *Failure {
+	for i, failure := range l.failures {
+		if failure.Method != "" && !strings.EqualFold(failure.Method, r.Method) {
+			continue
+		}
+		if !strings.Contains(r.URL.Path, failure.PathContains) {
+			continue
+		}
+		if failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				l.failures = append(l.failures[:i], l.failures[i+1:]...)
+			}
+		}
+		return failure
+	}
+	return nil
+}
+
+func (l *Leader) handleLogin(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(body, &creds); err != nil || creds.Username != l.username || creds.Password != l.password {
+		writeError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": l.token, "forcePasswordChange": false})
+}
+
+func (l *Leader) handleGroups(w http.ResponseWriter) {
+	items := []map[string]interface{}{}
+	for _, name := range sortedKeys(l.groups) {
+		gs := l.groups[name]
+		items = append(items, map[string]interface{}{"id": name, "onPrem": true, "workerCount": gs.connectedWorkers + gs.disconnectedWorkers})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "count": len(items)})
+}
+
+func (l *Leader) handleWorkers(w http.ResponseWriter) {
+	items := []map[string]interface{}{}
+	for _, name := range sortedKeys(l.groups) {
+		gs := l.groups[name]
+		for i := 0; i < gs.connectedWorkers+gs.disconnectedWorkers; i++ {
+			items = append(items, map[string]interface{}{
+				"id":           fmt.Sprintf("%s-worker-%d", name, i+1),
+				"group":        name,
+				"disconnected": i >= gs.connectedWorkers,
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "count": len(items)})
+}
+
+func (l *Leader) handleCommit(w http.ResponseWriter, body []byte) {
+	var commit struct {
+		Group   string `json:"group"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(body, &commit)
+	gs, ok := l.groups[commit.Group]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Worker group %s not found", commit.Group))
+		return
+	}
+	version := randomHex(20)
+	gs.commits = append(gs.commits, version)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": []map[string]interface{}{{"commit": version, "message": commit.Message}}, "count": 1})
+}
+
+func (l *Leader) handleDeploy(w http.ResponseWriter, group string, body []byte) {
+	gs, ok := l.groups[group]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Worker group %s not found", group))
+		return
+	}
+	var deploy struct {
+		Version string `json:"version"`
+	}
+	json.Unmarshal(body, &deploy)
+	if !slices.Contains(gs.commits, deploy.Version) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Version %s not found", deploy.Version))
+		return
+	}
+	gs.deployed = deploy.Version
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": []map[string]interface{}{{"id": group, "configVersion": deploy.Version}}, "count": 1})
+}
+
+func (l *Leader) handleCollection(w http.ResponseWriter, r *http.Request, collection string, objects map[string]map[string]interface{}, body []byte) {
+	switch r.Method {
+	case http.MethodGet:
+		items := []map[string]interface{}{}
+		for _, id := range sortedKeys(objects) {
+			items = append(items, withLeaderFields(objects[id]))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "count": len(items)})
+	case http.MethodPost:
+		var obj map[string]interface{}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		id, _ := obj["id"].(string)
+		if id == "" {
+			writeError(w, http.StatusBadRequest, "Missing id")
+			return
+		}
+		if _, exists := objects[id]; exists {
+			writeError(w, http.StatusConflict, fmt.Sprintf("Item with id %s already exists", id))
+			return
+		}
+		l.save(collection, objects, id, obj)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": []interface{}{obj}, "count": 1})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+func (l *Leader) handleItem(w http.ResponseWriter, r *http.Request, collection string, objects map[string]map[string]interface{}, id string, body []byte) {
+	existing, exists := objects[id]
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Item with id %s not found", id))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": []interface{}{withLeaderFields(existing)}, "count": 1})
+	case http.MethodPatch:
+		var obj map[string]interface{}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		obj["id"] = id
+		l.save(collection, objects, id, obj)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": []interface{}{obj}, "count": 1})
+	case http.MethodDelete:
+		delete(objects, id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": []interface{}{existing}, "count": 1})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+// handlePreview runs events through a stored pipeline. Only eval functions that add fields with quoted string
+// literal values are applied, other functions pass events through unchanged. Each output event gets an internal
+// __inputId field like the real preview adds.
+func (l *Leader) handlePreview(w http.ResponseWriter, gs *groupState, body []byte) {
+	var preview struct {
+		PipelineId string                   `json:"pipelineId"`
+		Events     []map[string]interface{} `json:"events"`
+	}
+	if err := json.Unmarshal(body, &preview); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	pipeline, exists := gs.objects["pipelines"][preview.PipelineId]
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Pipeline %s not found", preview.PipelineId))
+		return
+	}
+
+	type evalField struct{ name, value string }
+	var adds []evalField
+	conf, _ := pipeline["conf"].(map[string]interface{})
+	functions, _ := conf["functions"].([]interface{})
+	for _, function := range functions {
+		functionObj, _ := function.(map[string]interface{})
+		if functionObj["id"] != "eval" || functionObj["disabled"] == true {
+			continue
+		}
+		functionConf, _ := functionObj["conf"].(map[string]interface{})
+		fields, _ := functionConf["add"].([]interface{})
+		for _, field := range fields {
+			fieldObj, _ := field.(map[string]interface{})
+			name, _ := fieldObj["name"].(string)
+			value, _ := fieldObj["value"].(string)
+			if name != "" && len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+				adds = append(adds, evalField{name: name, value: value[1 : len(value)-1]})
+			}
+		}
+	}
+
+	items := []map[string]interface{}{}
+	for _, event := range preview.Events {
+		out := map[string]interface{}{"__inputId": "preview:" + preview.PipelineId}
+		for key, value := range event {
+			out[key] = value
+		}
+		for _, add := range adds {
+			out[add.name] = add.value
+		}
+		items = append(items, out)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "count": len(items)})
+}
+
+// handleLookups implements the two step lookup flow: PUT the file to get a staged filename, then POST (create)
+// or PATCH (update) the lookup to point at the staged file
+func (l *Leader) handleLookups(w http.ResponseWriter, r *http.Request, gs *groupState, subPath string, body []byte) {
+	switch {
+	case subPath == "" && r.Method == http.MethodGet:
+		items := []map[string]interface{}{}
+		for _, id := range sortedKeys(gs.lookups) {
+			items = append(items, map[string]interface{}{"id": id, "size": len(gs.lookups[id])})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": items, "count": len(items)})
+	case subPath == "" && r.Method == http.MethodPut:
+		filename := r.URL.Query().Get("filename")
+		if filename == "" {
+			writeError(w, http.StatusBadRequest, "Missing filename")
+			return
+		}
+		staged := filename + "." + randomHex(4) + ".tmp"
+		gs.uploads[staged] = body
+		writeJSON(w, http.StatusOK, map[string]interface{}{"filename": staged, "size": len(body)})
+	case subPath == "" && r.Method == http.MethodPost:
+		id, content, errMsg := l.stagedLookup(gs, body)
+		if errMsg != "" {
+			writeError(w, http.StatusBadRequest, errMsg)
+			return
+		}
+		if _, exists := gs.lookups[id]; exists {
+			writeError(w, http.StatusConflict, fmt.Sprintf("Lookup %s already exists", id))
+			return
+		}
+		gs.lookups[id] = content
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": []interface{}{map[string]interface{}{"id": id}}, "count": 1})
+	case strings.HasSuffix(subPath, "/content") && r.Method == http.MethodGet:
+		content, exists := gs.lookups[strings.TrimSuffix(subPath, "/content")]
+		if !exists {
+			writeError(w, http.StatusNotFound, "Lookup not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+	case subPath != "" && r.Method == http.MethodPatch:
+		if _, exists := gs.lookups[subPath]; !exists {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("Lookup %s not found", subPath))
+			return
+		}
+		id, content, errMsg := l.stagedLookup(gs, body)
+		if errMsg != "" {
+			writeError(w, http.StatusBadRequest, errMsg)
+			return
+		}
+		gs.lookups[id] = content
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": []interface{}{map[string]interface{}{"id": id}}, "count": 1})
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (l *Leader) stagedLookup(gs *groupState, body []byte) (string, []byte, string) {
+	var payload struct {
+		Id       string `json:"id"`
+		FileInfo struct {
+			Filename string `json:"filename"`
+		} `json:"fileInfo"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Id == "" {
+		return "", nil, "Invalid lookup payload"
+	}
+	content, staged := gs.uploads[payload.FileInfo.Filename]
+	if !staged {
+		return "", nil, fmt.Sprintf("Staged file %s not found", payload.FileInfo.Filename)
+	}
+	delete(gs.uploads, payload.FileInfo.Filename)
+	return payload.Id, content, ""
+}
+
+func (l *Leader) save(collection string, objects map[string]map[string]interface{}, id string, obj map[string]interface{}) {
+	if l.onSave != nil {
+		l.onSave(collection, obj)
+	}
+	objects[id] = obj
+}
+
+// withLeaderFields adds the runtime fields a real leader returns on GET so callers have to strip them
+func withLeaderFields(obj map[string]interface{}) map[string]interface{} {
+	withFields := copyObject(obj)
+	withFields["status"] = map[string]interface{}{"health": "Green"}
+	return withFields
+}
+
+func copyObject(obj map[string]interface{}) map[string]interface{} {
+	raw, _ := json.Marshal(obj)
+	var copied map[string]interface{}
+	json.Unmarshal(raw, &copied)
+	return copied
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"status": "error", "message": message})
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,386 @@
+package functions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one attempt at a mutating API call. Entries are chained: each one's Hash covers its own fields and
+// the previous entry's hash, so editing, removing or reordering entries breaks the chain from that point on. With an
+// audit key the hash is an HMAC, so the chain can't be rewritten from scratch by someone who can only edit the file.
+type AuditEntry struct {
+	Seq         int       `json:"seq"`
+	Timestamp   time.Time `json:"timestamp"`
+	Operator    string    `json:"operator"`
+	Method      string    `json:"method"`
+	Url         string    `json:"url"`
+	WorkerGroup string    `json:"workerGroup"`
+	// sha256 of the request body, the body itself is not logged since it may hold secrets
+	PayloadHash string `json:"payloadHash"`
+	// 1 for the first try of a call, retries of the same call count up from there
+	Attempt int `json:"attempt,omitempty"`
+	// 0 when no response was received
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Whether Hash is an HMAC under the audit key
+	Keyed    bool   `json:"keyed,omitempty"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+func (e AuditEntry) computeHash(key string) string {
+	e.Hash = ""
+	entryJson, _ := json.Marshal(e)
+	if key == "" {
+		sum := sha256.Sum256(entryJson)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(entryJson)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditLockStale is how long an append may hold the audit log's lock file before it is taken to have died with its run.
+// Appends take milliseconds, so a lock this old isn't held by anyone.
+const auditLockStale = 30 * time.Second
+
+// auditLog appends entries to one audit log file. Several runs may append to the same file at once, e.g. against
+// different worker groups, so each append takes the log's lock file and chains onto whatever entry is last in the file
+// at that point, rather than onto the last one this run wrote.
+type auditLog struct {
+	path  string
+	key   string
+	runId string
+	file  *os.File
+	// The last entry this run saw in the file, the file must never go back before it
+	last AuditEntry
+}
+
+var (
+	auditMu  sync.Mutex
+	auditCur *auditLog
+)
+
+// SetAuditLog appends an entry to the JSONL file at filePath for every attempt at a mutating request from here on.
+// The existing log is verified first so a new entry is never chained onto a tampered one. Entries are HMACed with key
+// when one is given, a log can't mix keyed and unkeyed entries.
+func SetAuditLog(filePath string, key string) error {
+	audit, openErr := openAuditLog(filePath, key)
+	if openErr != nil {
+		return openErr
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditCur != nil {
+		auditCur.file.Close()
+	}
+	auditCur = audit
+	return nil
+}
+
+func openAuditLog(filePath string, key string) (*auditLog, error) {
+	runId := make([]byte, 8)
+	rand.Read(runId)
+	audit := &auditLog{path: filePath, key: key, runId: hex.EncodeToString(runId)}
+
+	if mkdirErr := os.MkdirAll(filepath.Dir(filePath), 0700); mkdirErr != nil {
+		return nil, fmt.Errorf("unable to create the directory for audit log %s: %w", filePath, mkdirErr)
+	}
+	unlock, lockErr := audit.lock()
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock()
+	last, verifyErr := verifyAuditLog(filePath, key, "")
+	if verifyErr != nil && !errors.Is(verifyErr, fs.ErrNotExist) {
+		return nil, verifyErr
+	}
+	file, openErr := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if openErr != nil {
+		return nil, fmt.Errorf("unable to open audit log %s: %w", filePath, openErr)
+	}
+	audit.file, audit.last = file, last
+	return audit, nil
+}
+
+// CloseAuditLog stops logging requests
+func CloseAuditLog() error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditCur == nil {
+		return nil
+	}
+	closeErr := auditCur.file.Close()
+	auditCur = nil
+	return closeErr
+}
+
+// auditEnabled reports whether SetAuditLog has been called, so requests skip hashing their payload when it hasn't
+func auditEnabled() bool {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	return auditCur != nil
+}
+
+// lock takes the audit log's lock file, waiting for other runs' appends, and returns the function that releases it
+func (a *auditLog) lock() (func(), error) {
+	lockPath := a.path + ".lock"
+	deadline := time.Now().Add(2 * auditLockStale)
+	for {
+		now := time.Now().UTC()
+		infoJson, _ := json.Marshal(LockInfo{Owner: Operator(), RunId: a.runId, Acquired: now, Expires: now.Add(auditLockStale)})
+		lockFile, createErr := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if createErr == nil {
+			_, writeErr := lockFile.Write(infoJson)
+			closeErr := lockFile.Close()
+			if writeErr != nil || closeErr != nil {
+				os.Remove(lockPath)
+				return nil, fmt.Errorf("unable to write audit log lock %s: %w", lockPath, errors.Join(writeErr, closeErr))
+			}
+			return func() { removeLockFile(lockPath, a.runId, a.runId) }, nil
+		}
+		if !errors.Is(createErr, fs.ErrExist) {
+			return nil, fmt.Errorf("unable to create audit log lock %s: %w", lockPath, createErr)
+		}
+
+		// A lock that can't be read yet is still being written by its run
+		if existing, readErr := readLockFile(lockPath); readErr == nil && now.After(existing.Expires) {
+			if _, removeErr := removeLockFile(lockPath, existing.RunId, a.runId); removeErr != nil {
+				return nil, removeErr
+			}
+			continue
+		}
+		if now.After(deadline) {
+			return nil, fmt.Errorf("audit log %s is still locked by %s after %s, remove the lock file if no run is writing to the log", a.path, lockPath, 2*auditLockStale)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// append chains entry onto the last entry in the file and writes it, filling in its sequence and hashes
+func (a *auditLog) append(entry AuditEntry) error {
+	unlock, lockErr := a.lock()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	last, tailErr := a.tail()
+	if tailErr != nil {
+		return tailErr
+	}
+	entry.Seq = last.Seq + 1
+	entry.Keyed = a.key != ""
+	entry.PrevHash = last.Hash
+	entry.Hash = entry.computeHash(a.key)
+
+	entryJson, _ := json.Marshal(entry)
+	if _, writeErr := a.file.Write(append(entryJson, '\n')); writeErr != nil {
+		return fmt.Errorf("unable to write audit log %s: %w", a.path, writeErr)
+	}
+	a.last = entry
+	return nil
+}
+
+// tail returns the last entry in the file, which other runs may have appended since this run last wrote. Only that
+// entry is checked, the entries before it were verified by whichever run appended them.
+func (a *auditLog) tail() (AuditEntry, error) {
+	var last AuditEntry
+	line, readErr := lastLine(a.file)
+	if readErr != nil {
+		return last, fmt.Errorf("unable to read audit log %s: %w", a.path, readErr)
+	}
+	if line != nil {
+		if unMarshErr := json.Unmarshal(line, &last); unMarshErr != nil {
+			return last, fmt.Errorf("audit log %s ends with an entry that is not valid: %w", a.path, unMarshErr)
+		}
+		if last.Keyed != (a.key != "") || !hmac.Equal([]byte(last.Hash), []byte(last.computeHash(a.key))) {
+			return last, fmt.Errorf("audit log %s ends with an entry that does not match its hash: the entry was edited", a.path)
+		}
+	}
+	if last.Seq < a.last.Seq || last.Seq == a.last.Seq && last.Hash != a.last.Hash {
+		return last, fmt.Errorf("audit log %s was rewritten since entry %d: its last entry is now %d", a.path, a.last.Seq, last.Seq)
+	}
+	return last, nil
+}
+
+// lastLine returns the last newline terminated line of file, nil if it is empty
+func lastLine(file *os.File) ([]byte, error) {
+	info, statErr := file.Stat()
+	if statErr != nil {
+		return nil, statErr
+	}
+	size := info.Size()
+	for chunk := int64(4096); ; chunk *= 2 {
+		offset := max(size-chunk, 0)
+		content := make([]byte, size-offset)
+		if _, readErr := file.ReadAt(content, offset); readErr != nil && !errors.Is(readErr, io.EOF) {
+			return nil, readErr
+		}
+		content = bytes.TrimSuffix(content, []byte("\n"))
+		if start := bytes.LastIndexByte(content, '\n'); start >= 0 {
+			return content[start+1:], nil
+		}
+		if offset == 0 {
+			if len(content) == 0 {
+				return nil, nil
+			}
+			return content, nil
+		}
+	}
+}
+
+// VerifyAuditLog checks every entry's hash and link to the previous entry, returning the last good entry. The chain
+// alone can't tell a log that was cut short from one that ended there, so head, the "seq:hash" of an entry recorded
+// somewhere else, can be given to check the log still reaches it.
+func VerifyAuditLog(filePath string, key string, head string) (AuditEntry, error) {
+	return verifyAuditLog(filePath, key, head)
+}
+
+func verifyAuditLog(filePath string, key string, head string) (AuditEntry, error) {
+	var (
+		headSeq  int
+		headHash string
+	)
+	if head != "" {
+		seqText, hash, found := strings.Cut(head, ":")
+		seq, seqErr := strconv.Atoi(seqText)
+		if !found || seqErr != nil || seq < 1 || hash == "" {
+			return AuditEntry{}, fmt.Errorf("audit log head '%s' is not of the form seq:hash", head)
+		}
+		headSeq, headHash = seq, hash
+	}
+
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		return AuditEntry{}, fmt.Errorf("unable to open audit log %s: %w", filePath, openErr)
+	}
+	defer file.Close()
+
+	var last AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		var entry AuditEntry
+		if unMarshErr := json.Unmarshal(scanner.Bytes(), &entry); unMarshErr != nil {
+			return last, fmt.Errorf("audit log %s line %d is not a valid entry: %w", filePath, lineNum, unMarshErr)
+		}
+		switch {
+		case entry.Keyed && key == "":
+			return last, fmt.Errorf("audit log %s line %d is keyed, the audit key is needed to verify it", filePath, lineNum)
+		case !entry.Keyed && key != "":
+			return last, fmt.Errorf("audit log %s line %d was written without an audit key, so it can't be trusted under one: start a new audit log to use a key", filePath, lineNum)
+		case entry.Seq != last.Seq+1:
+			return last, fmt.Errorf("audit log %s line %d has sequence %d, expected %d: entries were removed or reordered", filePath, lineNum, entry.Seq, last.Seq+1)
+		case entry.PrevHash != last.Hash:
+			return last, fmt.Errorf("audit log %s line %d does not chain to the previous entry: entries were removed or reordered", filePath, lineNum)
+		case !hmac.Equal([]byte(entry.Hash), []byte(entry.computeHash(key))):
+			return last, fmt.Errorf("audit log %s line %d does not match its hash: the entry was edited, or the key is wrong", filePath, lineNum)
+		case entry.Seq == headSeq && entry.Hash != headHash:
+			return last, fmt.Errorf("audit log %s line %d does not match the head %s: the log was rewritten", filePath, lineNum, head)
+		}
+		last = entry
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		return last, fmt.Errorf("unable to read audit log %s: %w", filePath, scanErr)
+	}
+	if last.Seq < headSeq {
+		return last, fmt.Errorf("audit log %s ends at entry %d, before the head %s: entries were removed from the end", filePath, last.Seq, head)
+	}
+	return last, nil
+}
+
+// isAudited reports whether a request changes config. Logins are POSTs but change nothing, and carry a password.
+func isAudited(req *http.Request) bool {
+	switch req.Method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return !strings.HasSuffix(req.URL.Path, "/auth/login")
+	default:
+		return false
+	}
+}
+
+type payloadHashKey struct{}
+
+// withPayloadHash records the sha256 of a request's body for the audit log, for bodies the caller has already hashed
+// and that are too costly to read again, like a lookup streamed from disk
+func withPayloadHash(req *http.Request, payloadHash string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), payloadHashKey{}, payloadHash))
+}
+
+// requestPayloadHash returns the hash given with withPayloadHash, or hashes the in-memory body without consuming it
+func requestPayloadHash(req *http.Request) string {
+	if payloadHash, found := req.Context().Value(payloadHashKey{}).(string); found {
+		return payloadHash
+	}
+	hasher := sha256.New()
+	if req.GetBody != nil {
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return ""
+		}
+		defer body.Close()
+		if _, copyErr := io.Copy(hasher, body); copyErr != nil {
+			return ""
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// auditRequest appends the outcome of one attempt at a mutating request to the audit log, if one is set
+func auditRequest(req *http.Request, payloadHash string, attempt int, resp *http.Response, httpErr error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditCur == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Timestamp:   time.Now().UTC(),
+		Operator:    Operator(),
+		Method:      req.Method,
+		Url:         req.URL.String(),
+		WorkerGroup: urlWorkerGroup(req.URL.Path),
+		PayloadHash: payloadHash,
+		Attempt:     attempt,
+	}
+	if resp != nil {
+		entry.Status = resp.StatusCode
+	}
+	if httpErr != nil {
+		entry.Error = httpErr.Error()
+	}
+	if appendErr := auditCur.append(entry); appendErr != nil {
+		// The request has already been made, losing the record of it is reported loudly but can't undo it
+		fmt.Fprintf(os.Stderr, "WARNING: unable to write audit log entry for %s %s: %v\n", req.Method, req.URL, appendErr)
+	}
+}
+
+// urlWorkerGroup returns the {workerGroup} of an /api/v1/m/{workerGroup}/... path
+func urlWorkerGroup(path string) string {
+	_, groupPath, found := strings.Cut(path, "/api/v1/m/")
+	if !found {
+		return ""
+	}
+	workerGroup, _, _ := strings.Cut(groupPath, "/")
+	return workerGroup
+}
@@ -0,0 +1,242 @@
+package functions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// startAuditLog points the audit log at a fresh file and stops logging when the test ends
+func startAuditLog(t *testing.T, key string) string {
+	t.Helper()
+	// Its directory is created on first use, like the default per-user one
+	auditPath := filepath.Join(t.TempDir(), "criblPatching", "audit.jsonl")
+	if err := SetAuditLog(auditPath, key); err != nil {
+		t.Fatalf("unable to set audit log: %v", err)
+	}
+	t.Cleanup(func() { CloseAuditLog() })
+	return auditPath
+}
+
+func readAuditEntries(t *testing.T, auditPath string) []AuditEntry {
+	t.Helper()
+	content, _ := os.ReadFile(auditPath)
+	var entries []AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("unable to parse audit entry %s: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func writeAuditEntries(t *testing.T, auditPath string, entries []AuditEntry) {
+	t.Helper()
+	var content bytes.Buffer
+	for _, entry := range entries {
+		entryJson, _ := json.Marshal(entry)
+		content.Write(append(entryJson, '\n'))
+	}
+	os.WriteFile(auditPath, content.Bytes(), 0600)
+}
+
+func TestRetriedRequestAuditsEveryAttempt(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	auditPath := startAuditLog(t, "audit key")
+
+	body := []byte(`{"id": "main"}`)
+	req, _ := http.NewRequest("PATCH", server.URL+"/api/v1/m/wg1/pipelines/main", bytes.NewBuffer(body))
+	resp, err := retryHttp(req, 3)
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	resp.Body.Close()
+
+	entries := readAuditEntries(t, auditPath)
+	bodySum := sha256.Sum256(body)
+	if len(entries) != 2 {
+		t.Fatalf("expected an entry per attempt, got %+v", entries)
+	}
+	for i, wantStatus := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		entry := entries[i]
+		if entry.Attempt != i+1 || entry.Status != wantStatus || entry.WorkerGroup != "wg1" || entry.PayloadHash != hex.EncodeToString(bodySum[:]) {
+			t.Errorf("expected attempt %d with status %d, got %+v", i+1, wantStatus, entry)
+		}
+	}
+}
+
+func TestPayloadHashIsOnlyTakenForAnAuditLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("PUT", server.URL+"/api/v1/m/wg1/system/lookups", strings.NewReader("host,owner\n"))
+		req.GetBody = func() (io.ReadCloser, error) {
+			t.Error("the request body was re-read")
+			return nil, errors.New("re-read")
+		}
+		return req
+	}
+
+	if resp, err := retryHttp(newRequest(), 1); err != nil {
+		t.Fatalf("unable to make the request: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	auditPath := startAuditLog(t, "")
+	if resp, err := retryHttp(withPayloadHash(newRequest(), "callerhash"), 1); err != nil {
+		t.Fatalf("unable to make the request: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if entries := readAuditEntries(t, auditPath); len(entries) != 1 || entries[0].PayloadHash != "callerhash" {
+		t.Errorf("expected the caller's payload hash to be logged, got %+v", entries)
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	auditPath := startAuditLog(t, "audit key")
+	for i := 1; i <= 3; i++ {
+		req := httptest.NewRequest("POST", fmt.Sprintf("https://leader/api/v1/m/wg%d/pipelines", i), nil)
+		auditRequest(req, "payload", 1, &http.Response{StatusCode: http.StatusOK}, nil)
+	}
+	entries := readAuditEntries(t, auditPath)
+	head := fmt.Sprintf("3:%s", entries[2].Hash)
+
+	if last, err := VerifyAuditLog(auditPath, "audit key", head); err != nil || last.Seq != 3 {
+		t.Fatalf("expected the intact log to verify to entry 3, got %d %v", last.Seq, err)
+	}
+	if _, err := VerifyAuditLog(auditPath, "wrong key", ""); err == nil {
+		t.Error("expected the wrong key to fail verification")
+	}
+	if _, err := VerifyAuditLog(auditPath, "", ""); err == nil || !strings.Contains(err.Error(), "audit key is needed") {
+		t.Errorf("expected a keyed log to need the key, got %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		entries func() []AuditEntry
+		head    string
+		wantErr string
+	}{
+		{
+			name: "edited and rehashed without the key",
+			entries: func() []AuditEntry {
+				edited := append([]AuditEntry{}, entries...)
+				edited[1].Status = http.StatusForbidden
+				edited[1].Hash = edited[1].computeHash("")
+				return edited
+			},
+			wantErr: "line 2 does not match its hash",
+		},
+		{
+			name:    "entry removed",
+			entries: func() []AuditEntry { return []AuditEntry{entries[0], entries[2]} },
+			wantErr: "line 2 has sequence 3",
+		},
+		{
+			name:    "entries reordered",
+			entries: func() []AuditEntry { return []AuditEntry{entries[1], entries[0], entries[2]} },
+			wantErr: "line 1 has sequence 2",
+		},
+		{
+			name:    "truncated",
+			entries: func() []AuditEntry { return entries[:2] },
+			head:    head,
+			wantErr: "before the head",
+		},
+	}
+	for _, test := range tests {
+		writeAuditEntries(t, auditPath, test.entries())
+		if _, err := VerifyAuditLog(auditPath, "audit key", test.head); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.wantErr, err)
+		}
+	}
+	writeAuditEntries(t, auditPath, entries[:2])
+	if _, err := VerifyAuditLog(auditPath, "audit key", ""); err != nil {
+		t.Errorf("expected a truncated log to verify without a head to check against, got %v", err)
+	}
+}
+
+func TestSetAuditLogRejectsKeyingAnUnkeyedLog(t *testing.T) {
+	auditPath := startAuditLog(t, "")
+	auditRequest(httptest.NewRequest("DELETE", "https://leader/api/v1/m/wg1/pipelines/main", nil), "", 1, nil, errors.New("connection refused"))
+
+	if err := SetAuditLog(auditPath, "audit key"); err == nil || !strings.Contains(err.Error(), "without an audit key") {
+		t.Errorf("expected an unkeyed log to be refused once a key is set, got %v", err)
+	}
+	if last, err := VerifyAuditLog(auditPath, "", ""); err != nil || last.Seq != 1 || last.Error != "connection refused" {
+		t.Errorf("expected the unkeyed log to verify without a key, got %+v %v", last, err)
+	}
+}
+
+func TestAuditLogConcurrentRunsKeepOneChain(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// Separate audit logs stand in for separate runs, they share nothing but the file
+	var wg sync.WaitGroup
+	for run := 0; run < 4; run++ {
+		audit, err := openAuditLog(auditPath, "audit key")
+		if err != nil {
+			t.Fatalf("unable to open audit log: %v", err)
+		}
+		defer audit.file.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				if err := audit.append(AuditEntry{Method: "PATCH", WorkerGroup: fmt.Sprintf("wg%d", run), Attempt: 1}); err != nil {
+					t.Errorf("unable to append: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if last, err := VerifyAuditLog(auditPath, "audit key", ""); err != nil || last.Seq != 100 {
+		t.Errorf("expected one chain of 100 entries, got %d %v", last.Seq, err)
+	}
+	if _, err := os.Stat(auditPath + ".lock"); !os.IsNotExist(err) {
+		t.Error("expected the audit log lock to be released")
+	}
+}
+
+func TestAuditLogRefusesToAppendToARewrittenLog(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := openAuditLog(auditPath, "")
+	if err != nil {
+		t.Fatalf("unable to open audit log: %v", err)
+	}
+	defer audit.file.Close()
+	for i := 0; i < 2; i++ {
+		if err := audit.append(AuditEntry{Method: "DELETE", Attempt: 1}); err != nil {
+			t.Fatalf("unable to append: %v", err)
+		}
+	}
+
+	entries := readAuditEntries(t, auditPath)
+	writeAuditEntries(t, auditPath, entries[:1])
+	if err := audit.append(AuditEntry{Method: "DELETE", Attempt: 1}); err == nil || !strings.Contains(err.Error(), "was rewritten") {
+		t.Errorf("expected appending after the log was cut short to fail, got %v", err)
+	}
+}
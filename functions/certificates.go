@@ -0,0 +1,61 @@
+package functions
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Fields of a certificate object that hold PEM certificates
+var certificatePemFields = []string{"cert", "ca"}
+
+// CheckCertificate inspects a certificate object before it is replicated. It returns a warning for every certificate
+// that has expired or expires within warnWithin, and an error if the object carries a private key that isn't allowed to be copied.
+func CheckCertificate(objConfig []byte, warnWithin time.Duration, allowPrivateKeys bool) ([]string, error) {
+	var certConfig CribConfig
+	if unMarshErr := json.Unmarshal(objConfig, &certConfig); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to read certificate config: %w", unMarshErr)
+	}
+
+	if privKey, _ := certConfig["privKey"].(string); strings.TrimSpace(privKey) != "" && !allowPrivateKeys {
+		return nil, fmt.Errorf("certificate '%v' includes a private key, refusing to copy it without -allowPrivateKeys", certConfig["id"])
+	}
+
+	var warnings []string
+	now := time.Now()
+	for _, field := range certificatePemFields {
+		pemData, _ := certConfig[field].(string)
+		rest := []byte(pemData)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, parseErr := x509.ParseCertificate(block.Bytes)
+			if parseErr != nil {
+				return nil, fmt.Errorf("certificate '%v' has an unparseable certificate in '%s': %w", certConfig["id"], field, parseErr)
+			}
+
+			subject := cert.Subject.CommonName
+			if subject == "" {
+				subject = cert.Subject.String()
+			}
+			switch {
+			case cert.NotAfter.Before(now):
+				warnings = append(warnings, fmt.Sprintf("%s certificate '%s' EXPIRED on %s", field, subject, cert.NotAfter.Format(time.DateOnly)))
+			case cert.NotAfter.Before(now.Add(warnWithin)):
+				daysLeft := int(cert.NotAfter.Sub(now).Hours() / 24)
+				warnings = append(warnings, fmt.Sprintf("%s certificate '%s' expires on %s (%d day(s) left)", field, subject, cert.NotAfter.Format(time.DateOnly), daysLeft))
+			}
+		}
+	}
+
+	return warnings, nil
+}
@@ -0,0 +1,28 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DisableCollectorSchedule turns off the schedule on a collector job so it can't fire before the target group is ready.
+// The rest of the schedule (cron, run settings, state tracking) is kept so it only needs to be re-enabled. A job with no
+// schedule only runs when started by hand and is returned unchanged, reporting that there was nothing to disable.
+func DisableCollectorSchedule(objConfig []byte) ([]byte, bool, error) {
+	var collectorConfig CribConfig
+	if unMarshErr := json.Unmarshal(objConfig, &collectorConfig); unMarshErr != nil {
+		return nil, false, fmt.Errorf("unable to read collector config: %w", unMarshErr)
+	}
+
+	schedule, hasSchedule := collectorConfig["schedule"].(map[string]interface{})
+	if !hasSchedule {
+		return objConfig, false, nil
+	}
+	schedule["enabled"] = false
+
+	disabledConfig, marshErr := json.Marshal(collectorConfig)
+	if marshErr != nil {
+		return nil, false, fmt.Errorf("unable to format collector config: %w", marshErr)
+	}
+	return disabledConfig, true, nil
+}
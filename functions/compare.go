@@ -0,0 +1,96 @@
+package functions
+
+import (
+	"sort"
+)
+
+const (
+	CompareOnlyLeft  = "only-left"
+	CompareOnlyRight = "only-right"
+	CompareDifferent = "different"
+	CompareSame      = "same"
+	// Only values encrypted by each leader differ. Leaders encrypt with their own keys and the same value encrypts
+	// differently each time, so whether the secrets themselves differ is unknown.
+	CompareSecretUnknown = "secret-unknown"
+)
+
+// ObjectComparison is how one object differs between two worker groups. Changes go from the left group's config to
+// the right's, and are only set for different JSON config objects, or for secret-unknown ones to show which values
+// couldn't be compared. Credentials in them are redacted.
+type ObjectComparison struct {
+	ObjType string       `json:"objType"`
+	ObjId   string       `json:"objId"`
+	Status  string       `json:"status"`
+	Changes []DiffChange `json:"changes,omitempty"`
+}
+
+// CompareConfigs compares every object of one type listed in two worker groups, in id order
+func CompareConfigs(objType string, left map[string]CribConfig, right map[string]CribConfig, ignoreFields []string) []ObjectComparison {
+	var comparisons []ObjectComparison
+	for _, id := range unionIds(left, right) {
+		leftConfig, inLeft := left[id]
+		rightConfig, inRight := right[id]
+		comparison := ObjectComparison{ObjType: objType, ObjId: id}
+		switch {
+		case !inRight:
+			comparison.Status = CompareOnlyLeft
+		case !inLeft:
+			comparison.Status = CompareOnlyRight
+		default:
+			var changes, encryptedChanges []DiffChange
+			for _, change := range DiffConfigs(leftConfig, rightConfig, ignoreFields) {
+				if change.Kind == DiffChanged && isEncryptedValue(change.Before) && isEncryptedValue(change.After) {
+					encryptedChanges = append(encryptedChanges, change)
+				} else {
+					changes = append(changes, change)
+				}
+			}
+			switch {
+			case len(changes) > 0:
+				comparison.Status = CompareDifferent
+				comparison.Changes = RedactChanges(changes)
+			case len(encryptedChanges) > 0:
+				comparison.Status = CompareSecretUnknown
+				comparison.Changes = RedactChanges(encryptedChanges)
+			default:
+				comparison.Status = CompareSame
+			}
+		}
+		comparisons = append(comparisons, comparison)
+	}
+	return comparisons
+}
+
+// CompareHashes compares objects that are only compared as a whole, like lookup files, by a hash of their content
+func CompareHashes(objType string, left map[string]string, right map[string]string) []ObjectComparison {
+	var comparisons []ObjectComparison
+	for _, id := range unionIds(left, right) {
+		leftHash, inLeft := left[id]
+		rightHash, inRight := right[id]
+		comparison := ObjectComparison{ObjType: objType, ObjId: id, Status: CompareSame}
+		switch {
+		case !inRight:
+			comparison.Status = CompareOnlyLeft
+		case !inLeft:
+			comparison.Status = CompareOnlyRight
+		case leftHash != rightHash:
+			comparison.Status = CompareDifferent
+		}
+		comparisons = append(comparisons, comparison)
+	}
+	return comparisons
+}
+
+func unionIds[V any](left map[string]V, right map[string]V) []string {
+	ids := make([]string, 0, len(left)+len(right))
+	for id := range left {
+		ids = append(ids, id)
+	}
+	for id := range right {
+		if _, inLeft := left[id]; !inLeft {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
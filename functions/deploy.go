@@ -0,0 +1,63 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// CommitAndDeploy commits a worker group's pending config changes on the leader and deploys that commit to the group's
+// workers, returning the commit. Workers only run deployed config, so a change must be deployed before its effect on
+// them can be measured. Every pending change in the group is committed, not only the ones made by this run.
+func CommitAndDeploy(baseApiUrl string, workerGroup string, token string, message string) (string, error) {
+	commitBody, _ := json.Marshal(map[string]interface{}{"group": workerGroup, "message": message})
+	var commitResponse struct {
+		Items []struct {
+			Commit string `json:"commit"`
+		} `json:"items"`
+	}
+	if postErr := sendDeployJson("POST", baseApiUrl+"/api/v1/version/commit", token, commitBody, &commitResponse); postErr != nil {
+		return "", fmt.Errorf("unable to commit worker group %s: %w", workerGroup, postErr)
+	}
+	if len(commitResponse.Items) == 0 || commitResponse.Items[0].Commit == "" {
+		return "", fmt.Errorf("unable to commit worker group %s: the leader returned no commit", workerGroup)
+	}
+	commit := commitResponse.Items[0].Commit
+
+	deployBody, _ := json.Marshal(map[string]interface{}{"version": commit})
+	if patchErr := sendDeployJson("PATCH", baseApiUrl+"/api/v1/master/groups/"+workerGroup+"/deploy", token, deployBody, nil); patchErr != nil {
+		return commit, fmt.Errorf("unable to deploy commit %s to worker group %s: %w", commit, workerGroup, patchErr)
+	}
+	return commit, nil
+}
+
+func sendDeployJson(method string, url string, token string, body []byte, response interface{}) error {
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
+
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp == nil || httpErr != nil {
+		return fmt.Errorf("request to url %s failed: %w Attempted (%d) time(s)", url, httpErr, maxRetries)
+	}
+	defer resp.Body.Close()
+	if response == nil {
+		return nil
+	}
+
+	responseData, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		return fmt.Errorf("unable to properly read response body %w", readErr)
+	}
+	if unMarshErr := json.Unmarshal(responseData, response); unMarshErr != nil {
+		return fmt.Errorf("unable to parse response body from url %s: %w", url, unMarshErr)
+	}
+	return nil
+}
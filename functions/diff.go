@@ -0,0 +1,388 @@
+package functions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// DefaultVolatileFields are set by the leader rather than the config author, so they never count as a difference
+var DefaultVolatileFields = []string{"status"}
+
+const (
+	DiffAdded     = "added"
+	DiffRemoved   = "removed"
+	DiffChanged   = "changed"
+	DiffReordered = "reordered"
+)
+
+// DiffChange is one semantic difference between two configs. Path uses the same key.key[N] form as policy rules,
+// except that array elements matched by id are shown as [id=value].
+type DiffChange struct {
+	Path   string      `json:"path"`
+	Kind   string      `json:"kind"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// DiffConfigs compares two configs ignoring key order. Arrays whose elements all have an id (pipeline functions,
+// routes) are matched by id so an inserted function shows up as one addition instead of every later function
+// changing, anything else is matched by position. ignoreFields are top level keys or full paths to skip, on top of
+// DefaultVolatileFields.
+func DiffConfigs(before CribConfig, after CribConfig, ignoreFields []string) []DiffChange {
+	ignore := map[string]bool{}
+	for _, field := range DefaultVolatileFields {
+		ignore[field] = true
+	}
+	for _, field := range ignoreFields {
+		ignore[field] = true
+	}
+
+	var changes []DiffChange
+	diffValues("", map[string]interface{}(before), map[string]interface{}(after), ignore, &changes)
+	return changes
+}
+
+// ConfigHash returns a sha256 of the config with its keys sorted and DefaultVolatileFields dropped, so configs that
+// DiffConfigs finds no differences between hash the same
+func ConfigHash(objConfig []byte) (string, error) {
+	var config CribConfig
+	if unMarshErr := json.Unmarshal(objConfig, &config); unMarshErr != nil {
+		return "", fmt.Errorf("unable to read config to hash: %w", unMarshErr)
+	}
+	for _, field := range DefaultVolatileFields {
+		delete(config, field)
+	}
+	normalized, marshErr := json.Marshal(config)
+	if marshErr != nil {
+		return "", fmt.Errorf("unable to format config to hash: %w", marshErr)
+	}
+	sum := sha256.Sum256(normalized)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// DiffConfigJson is DiffConfigs for configs as returned by GetDataObj
+func DiffConfigJson(before []byte, after []byte, ignoreFields []string) ([]DiffChange, error) {
+	var beforeConfig, afterConfig CribConfig
+	if unMarshErr := json.Unmarshal(before, &beforeConfig); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to read config to diff: %w", unMarshErr)
+	}
+	if unMarshErr := json.Unmarshal(after, &afterConfig); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to read config to diff: %w", unMarshErr)
+	}
+	return DiffConfigs(beforeConfig, afterConfig, ignoreFields), nil
+}
+
+func diffValues(path string, before interface{}, after interface{}, ignore map[string]bool, changes *[]DiffChange) {
+	if ignore[path] {
+		return
+	}
+
+	beforeObj, beforeIsObj := asJsonObject(before)
+	afterObj, afterIsObj := asJsonObject(after)
+	if beforeIsObj && afterIsObj {
+		keys := make([]string, 0, len(beforeObj)+len(afterObj))
+		for key := range beforeObj {
+			keys = append(keys, key)
+		}
+		for key := range afterObj {
+			if _, inBefore := beforeObj[key]; !inBefore {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			if path == "" && ignore[key] {
+				continue
+			}
+			beforeValue, inBefore := beforeObj[key]
+			afterValue, inAfter := afterObj[key]
+			switch {
+			case !inAfter:
+				*changes = append(*changes, DiffChange{Path: childPath, Kind: DiffRemoved, Before: beforeValue})
+			case !inBefore:
+				*changes = append(*changes, DiffChange{Path: childPath, Kind: DiffAdded, After: afterValue})
+			default:
+				diffValues(childPath, beforeValue, afterValue, ignore, changes)
+			}
+		}
+		return
+	}
+
+	beforeArr, beforeIsArr := before.([]interface{})
+	afterArr, afterIsArr := after.([]interface{})
+	if beforeIsArr && afterIsArr {
+		if matches, keyed := matchArrayElements(beforeArr, afterArr); keyed {
+			diffKeyedArrays(path, beforeArr, afterArr, matches, ignore, changes)
+			return
+		}
+		for i := 0; i < max(len(beforeArr), len(afterArr)); i++ {
+			elementPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(afterArr):
+				*changes = append(*changes, DiffChange{Path: elementPath, Kind: DiffRemoved, Before: beforeArr[i]})
+			case i >= len(beforeArr):
+				*changes = append(*changes, DiffChange{Path: elementPath, Kind: DiffAdded, After: afterArr[i]})
+			default:
+				diffValues(elementPath, beforeArr[i], afterArr[i], ignore, changes)
+			}
+		}
+		return
+	}
+
+	// Marshalling sorts map keys, so this is also a key order independent comparison of mixed types
+	if jsonString(before) != jsonString(after) {
+		*changes = append(*changes, DiffChange{Path: path, Kind: DiffChanged, Before: before, After: after})
+	}
+}
+
+func diffKeyedArrays(path string, beforeArr []interface{}, afterArr []interface{}, matches map[int]int, ignore map[string]bool, changes *[]DiffChange) {
+	beforeLabels, afterLabels := arrayElementLabels(beforeArr), arrayElementLabels(afterArr)
+	matchedAfter := make(map[int]int, len(matches))
+	for i, j := range matches {
+		matchedAfter[j] = i
+	}
+
+	var beforeOrder, afterOrder []string
+	for j := range afterArr {
+		elementPath := path + "[" + afterLabels[j] + "]"
+		if i, matched := matchedAfter[j]; matched {
+			// Matched elements are named by their position among the before elements with the same id
+			afterOrder = append(afterOrder, beforeLabels[i])
+			diffValues(elementPath, beforeArr[i], afterArr[j], ignore, changes)
+		} else {
+			*changes = append(*changes, DiffChange{Path: elementPath, Kind: DiffAdded, After: afterArr[j]})
+		}
+	}
+	for i := range beforeArr {
+		if _, matched := matches[i]; matched {
+			beforeOrder = append(beforeOrder, beforeLabels[i])
+		} else {
+			*changes = append(*changes, DiffChange{Path: path + "[" + beforeLabels[i] + "]", Kind: DiffRemoved, Before: beforeArr[i]})
+		}
+	}
+
+	// Order matters for pipeline functions and routes even when every element is unchanged
+	if !slices.Equal(beforeOrder, afterOrder) {
+		*changes = append(*changes, DiffChange{Path: path, Kind: DiffReordered, Before: beforeOrder, After: afterOrder})
+	}
+}
+
+// elementId returns the id of an array element, or false if it isn't an object with a non-empty string id
+func elementId(element interface{}) (string, bool) {
+	obj, isObj := asJsonObject(element)
+	if !isObj {
+		return "", false
+	}
+	id, isString := obj["id"].(string)
+	return id, isString && id != ""
+}
+
+// matchArrayElements pairs before and after elements by id, returning before index -> after index, or false if any
+// element has no id. Elements with a repeated id (e.g. several eval functions) are paired by content first, using
+// the longest common subsequence of identical elements, and any left over are paired in order. That way inserting
+// or removing one eval shows up as one addition or removal instead of every later eval changing.
+func matchArrayElements(beforeArr []interface{}, afterArr []interface{}) (map[int]int, bool) {
+	var ids []string
+	beforeById, afterById := map[string][]int{}, map[string][]int{}
+	for i, element := range beforeArr {
+		id, hasId := elementId(element)
+		if !hasId {
+			return nil, false
+		}
+		if _, seen := beforeById[id]; !seen {
+			ids = append(ids, id)
+		}
+		beforeById[id] = append(beforeById[id], i)
+	}
+	for j, element := range afterArr {
+		id, hasId := elementId(element)
+		if !hasId {
+			return nil, false
+		}
+		if _, seen := beforeById[id]; !seen {
+			if _, seenAfter := afterById[id]; !seenAfter {
+				ids = append(ids, id)
+			}
+		}
+		afterById[id] = append(afterById[id], j)
+	}
+
+	matches := map[int]int{}
+	for _, id := range ids {
+		beforeIdx, afterIdx := beforeById[id], afterById[id]
+		if len(beforeIdx) <= 1 && len(afterIdx) <= 1 {
+			if len(beforeIdx) == 1 && len(afterIdx) == 1 {
+				matches[beforeIdx[0]] = afterIdx[0]
+			}
+			continue
+		}
+
+		beforeJson := make([]string, len(beforeIdx))
+		for k, i := range beforeIdx {
+			beforeJson[k] = jsonString(beforeArr[i])
+		}
+		afterJson := make([]string, len(afterIdx))
+		for k, j := range afterIdx {
+			afterJson[k] = jsonString(afterArr[j])
+		}
+		identical := longestCommonSubsequence(beforeJson, afterJson)
+
+		// Pair the elements between consecutive identical pairs in order, they are the ones that changed
+		prevB, prevA := -1, -1
+		for _, pair := range append(identical, [2]int{len(beforeIdx), len(afterIdx)}) {
+			for b, a := prevB+1, prevA+1; b < pair[0] && a < pair[1]; b, a = b+1, a+1 {
+				matches[beforeIdx[b]] = afterIdx[a]
+			}
+			if pair[0] < len(beforeIdx) {
+				matches[beforeIdx[pair[0]]] = afterIdx[pair[1]]
+			}
+			prevB, prevA = pair[0], pair[1]
+		}
+	}
+	return matches, true
+}
+
+// longestCommonSubsequence returns the index pairs of a longest common subsequence of two lists, in order
+func longestCommonSubsequence(before []string, after []string) [][2]int {
+	lengths := make([][]int, len(before)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+
+	var pairs [][2]int
+	for i, j := 0, 0; i < len(before) && j < len(after); {
+		switch {
+		case before[i] == after[j]:
+			pairs = append(pairs, [2]int{i, j})
+			i, j = i+1, j+1
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return pairs
+}
+
+// arrayElementLabels names each element "id=value" for paths, with "#N" for the Nth element of a repeated id
+func arrayElementLabels(arr []interface{}) []string {
+	counts := map[string]int{}
+	for _, element := range arr {
+		id, _ := elementId(element)
+		counts[id]++
+	}
+	labels := make([]string, 0, len(arr))
+	seen := map[string]int{}
+	for _, element := range arr {
+		id, _ := elementId(element)
+		seen[id]++
+		label := "id=" + id
+		if counts[id] > 1 {
+			label = fmt.Sprintf("%s#%d", label, seen[id])
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+func asJsonObject(value interface{}) (map[string]interface{}, bool) {
+	switch obj := value.(type) {
+	case map[string]interface{}:
+		return obj, true
+	case CribConfig:
+		return map[string]interface{}(obj), true
+	default:
+		return nil, false
+	}
+}
+
+const (
+	DiffFormatColor    = "color"
+	DiffFormatPlain    = "plain"
+	DiffFormatMarkdown = "markdown"
+)
+
+func IsDiffFormat(format string) bool {
+	switch format {
+	case DiffFormatColor, DiffFormatPlain, DiffFormatMarkdown:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	ansiReset = "\033[0m"
+	ansiBold  = "\033[1m"
+	ansiRed   = "\033[31m"
+	ansiGreen = "\033[32m"
+	ansiCyan  = "\033[36m"
+)
+
+// RenderDiff formats changes as a unified style diff with one hunk per changed path. The color format is for
+// terminals, plain for logs and markdown wraps the plain diff in a ```diff block for PR comments.
+func RenderDiff(changes []DiffChange, beforeLabel string, afterLabel string, format string) string {
+	colorize := func(color string, line string) string {
+		if format != DiffFormatColor {
+			return line
+		}
+		return color + line + ansiReset
+	}
+
+	var out strings.Builder
+	if format == DiffFormatMarkdown {
+		out.WriteString("```diff\n")
+	}
+	out.WriteString(colorize(ansiBold, "--- "+beforeLabel) + "\n")
+	out.WriteString(colorize(ansiBold, "+++ "+afterLabel) + "\n")
+	if len(changes) == 0 {
+		out.WriteString("  (no differences)\n")
+	}
+
+	for _, change := range changes {
+		out.WriteString(colorize(ansiCyan, fmt.Sprintf("@@ %s (%s) @@", change.Path, change.Kind)) + "\n")
+		if change.Kind != DiffAdded {
+			for _, line := range diffValueLines(change.Before) {
+				out.WriteString(colorize(ansiRed, "- "+line) + "\n")
+			}
+		}
+		if change.Kind != DiffRemoved {
+			for _, line := range diffValueLines(change.After) {
+				out.WriteString(colorize(ansiGreen, "+ "+line) + "\n")
+			}
+		}
+	}
+
+	if format == DiffFormatMarkdown {
+		out.WriteString("```\n")
+	}
+	return out.String()
+}
+
+// diffValueLines pretty prints a value without escaping <, > and &, which are common in filter expressions
+func diffValueLines(value interface{}) []string {
+	var valueJson strings.Builder
+	encoder := json.NewEncoder(&valueJson)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+	return strings.Split(strings.TrimSuffix(valueJson.String(), "\n"), "\n")
+}
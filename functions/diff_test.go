@@ -0,0 +1,138 @@
+package functions
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func diffJson(t *testing.T, before string, after string, ignore ...string) []DiffChange {
+	t.Helper()
+	changes, err := DiffConfigJson([]byte(before), []byte(after), ignore)
+	if err != nil {
+		t.Fatalf("unable to diff: %v", err)
+	}
+	return changes
+}
+
+func changeSummary(changes []DiffChange) []string {
+	var summary []string
+	for _, change := range changes {
+		summary = append(summary, change.Kind+" "+change.Path)
+	}
+	return summary
+}
+
+func TestDiffConfigs(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		ignore        []string
+		want          []string
+	}{
+		{
+			name:   "key order and status are ignored",
+			before: `{"a": 1, "b": {"x": 1, "y": 2}, "status": {"health": "Green"}}`,
+			after:  `{"b": {"y": 2, "x": 1}, "a": 1}`,
+		},
+		{
+			name:   "nested change, addition and removal",
+			before: `{"conf": {"output": "default", "old": true}}`,
+			after:  `{"conf": {"output": "s3", "new": 1}}`,
+			want:   []string{"added conf.new", "removed conf.old", "changed conf.output"},
+		},
+		{
+			name:   "ignored fields",
+			before: `{"description": "a", "conf": {"output": "default"}}`,
+			after:  `{"description": "b", "conf": {"output": "s3"}}`,
+			ignore: []string{"description", "conf.output"},
+		},
+		{
+			name:   "positional arrays",
+			before: `{"hosts": ["a", "b"]}`,
+			after:  `{"hosts": ["a", "c", "d"]}`,
+			want:   []string{"changed hosts[1]", "added hosts[2]"},
+		},
+		{
+			name:   "unique ids matched by id",
+			before: `{"functions": [{"id": "eval", "filter": "true"}, {"id": "drop"}]}`,
+			after:  `{"functions": [{"id": "mask"}, {"id": "eval", "filter": "false"}, {"id": "drop"}]}`,
+			want:   []string{"added functions[id=mask]", "changed functions[id=eval].filter"},
+		},
+		{
+			name:   "reordered",
+			before: `{"functions": [{"id": "eval"}, {"id": "drop"}]}`,
+			after:  `{"functions": [{"id": "drop"}, {"id": "eval"}]}`,
+			want:   []string{"reordered functions"},
+		},
+		{
+			name:   "eval inserted ahead of repeated evals",
+			before: `{"functions": [{"id": "eval", "n": 1}, {"id": "eval", "n": 2}, {"id": "eval", "n": 3}]}`,
+			after:  `{"functions": [{"id": "eval", "n": 0}, {"id": "eval", "n": 1}, {"id": "eval", "n": 2}, {"id": "eval", "n": 3}]}`,
+			want:   []string{"added functions[id=eval#1]"},
+		},
+		{
+			name:   "one of repeated evals removed",
+			before: `{"functions": [{"id": "eval", "n": 1}, {"id": "eval", "n": 2}, {"id": "eval", "n": 3}]}`,
+			after:  `{"functions": [{"id": "eval", "n": 1}, {"id": "eval", "n": 3}]}`,
+			want:   []string{"removed functions[id=eval#2]"},
+		},
+		{
+			name:   "one of repeated evals changed",
+			before: `{"functions": [{"id": "eval", "n": 1}, {"id": "drop"}, {"id": "eval", "n": 2}]}`,
+			after:  `{"functions": [{"id": "eval", "n": 1}, {"id": "drop"}, {"id": "eval", "n": 5}]}`,
+			want:   []string{"changed functions[id=eval#2].n"},
+		},
+		{
+			name:   "repeated evals moved",
+			before: `{"functions": [{"id": "eval", "n": 1}, {"id": "drop"}, {"id": "eval", "n": 2}]}`,
+			after:  `{"functions": [{"id": "drop"}, {"id": "eval", "n": 1}, {"id": "eval", "n": 2}]}`,
+			want:   []string{"reordered functions"},
+		},
+	}
+	for _, test := range tests {
+		got := changeSummary(diffJson(t, test.before, test.after, test.ignore...))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestConfigHashIgnoresKeyOrderAndStatus(t *testing.T) {
+	first, _ := ConfigHash([]byte(`{"a": 1, "b": [1, 2], "status": "x"}`))
+	second, _ := ConfigHash([]byte(`{"b": [1, 2], "a": 1}`))
+	third, _ := ConfigHash([]byte(`{"b": [2, 1], "a": 1}`))
+	if first != second {
+		t.Error("expected configs that only differ in key order and status to hash the same")
+	}
+	if first == third {
+		t.Error("expected a reordered array to change the hash")
+	}
+}
+
+func TestRenderDiff(t *testing.T) {
+	changes := diffJson(t, `{"filter": "a > 1 && b < 2"}`, `{"filter": "a > 2"}`)
+
+	markdown := RenderDiff(changes, "template", "wg1", DiffFormatMarkdown)
+	wantMarkdown := "```diff\n--- template\n+++ wg1\n@@ filter (changed) @@\n- \"a > 1 && b < 2\"\n+ \"a > 2\"\n```\n"
+	if markdown != wantMarkdown {
+		t.Errorf("expected markdown diff:\n%s\ngot:\n%s", wantMarkdown, markdown)
+	}
+	if plain := RenderDiff(changes, "a", "b", DiffFormatPlain); strings.Contains(plain, "\033[") {
+		t.Error("plain diff contains ANSI escapes")
+	}
+	if color := RenderDiff(changes, "a", "b", DiffFormatColor); !strings.Contains(color, ansiRed+"- ") {
+		t.Error("color diff is missing ANSI escapes")
+	}
+	if none := RenderDiff(nil, "a", "b", DiffFormatPlain); !strings.Contains(none, "(no differences)") {
+		t.Errorf("expected an empty diff to say so, got %s", none)
+	}
+}
+
+func TestDiffChangeJson(t *testing.T) {
+	changeJson, _ := json.Marshal(DiffChange{Path: "conf.output", Kind: DiffChanged, Before: "a", After: false})
+	if string(changeJson) != `{"path":"conf.output","kind":"changed","before":"a","after":false}` {
+		t.Errorf("unexpected JSON for a change: %s", changeJson)
+	}
+}
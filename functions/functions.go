@@ -3,33 +3,122 @@ package functions
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"sort"
 	"strings"
 )
 
 type CribConfig map[string]interface{}
 
-func retryHttp(client *http.Client, req *http.Request, retryCount int) (*http.Response, error) {
+// ErrObjNotFound is wrapped by GetDataObj when the object doesn't exist in the worker group
+var ErrObjNotFound = errors.New("object not found")
+
+// objEndpoints maps each replicable object type to its API path under /api/v1/m/{workerGroup}
+var objEndpoints = map[string]string{
+	"source":         "/system/inputs",
+	"destination":    "/system/outputs",
+	"pipeline":       "/pipelines",
+	"globalvariable": "/lib/vars",
+	// Knowledge library
+	"eventbreaker":  "/lib/breakers",
+	"parser":        "/lib/parsers",
+	"regex":         "/lib/regex",
+	"grok":          "/lib/grok",
+	"schema":        "/lib/schemas",
+	"parquetschema": "/lib/parquet-schemas",
+	// Saved collection jobs, including their schedule and state settings
+	"collector": "/lib/jobs",
+	// Alerting
+	"notificationtarget": "/notification-targets",
+	"notification":       "/notifications",
+	// TLS certificates, CAs and key pairs referenced by name from sources and destinations
+	"certificate": "/system/certificates",
+}
+
+// ObjEndpoint returns the API path for an object type, relative to the worker group
+func ObjEndpoint(objType string) (string, error) {
+	objEndpoint, ok := objEndpoints[strings.ToLower(objType)]
+	if !ok {
+		return "", fmt.Errorf("invalid Object Type provided: %s. Valid options are: %s, or Lookup", objType, strings.Join(DataObjTypes(), ", "))
+	}
+	return objEndpoint, nil
+}
+
+// IsDataObjType reports whether the object type is a JSON config object replicated with GetDataObj/CreateDataObj/UpdateDataObj
+func IsDataObjType(objType string) bool {
+	_, ok := objEndpoints[strings.ToLower(objType)]
+	return ok
+}
+
+// DataObjTypes lists the JSON config object types in a stable order
+func DataObjTypes() []string {
+	objTypes := make([]string, 0, len(objEndpoints))
+	for objType := range objEndpoints {
+		objTypes = append(objTypes, objType)
+	}
+	sort.Strings(objTypes)
+	return objTypes
+}
+
+func retryHttp(req *http.Request, retryCount int) (*http.Response, error) {
 	var (
 		retries int = retryCount
 		resp    *http.Response
 		err     error
+		client  = httpClient(req.URL.String())
 	)
 
+	// Only hash the payload when there's a log to write it to, every attempt gets its own entry
+	audited := auditEnabled() && isAudited(req)
+	var payloadHash string
+	if audited {
+		payloadHash = requestPayloadHash(req)
+	}
+
+	attempt := 0
 	for retries > 0 {
-		resp, err = client.Do(req)
-		if err != nil && resp.StatusCode != http.StatusOK {
+		attempt += 1
+		attemptCtx, cancel := attemptContext(req)
+		resp, err = client.Do(req.WithContext(attemptCtx))
+		if err != nil || resp.StatusCode >= http.StatusInternalServerError {
 			retries -= 1
+			// No point retrying once the run has been cancelled
+			if retries == 0 || requestRunContext(req).Err() != nil {
+				if resp != nil {
+					resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+				} else {
+					cancel()
+				}
+				break
+			}
+			if audited {
+				auditRequest(req, payloadHash, attempt, resp, err)
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			cancel()
+			// Request bodies are consumed by each attempt, rewind them (bytes buffers, temp files) before retrying
+			if req.GetBody != nil {
+				body, bodyErr := req.GetBody()
+				if bodyErr != nil {
+					return nil, fmt.Errorf("unable to rewind request body for retry: %w", bodyErr)
+				}
+				req.Body = body
+			}
 		} else {
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
 			break
 		}
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if err == nil && resp.StatusCode != http.StatusOK {
+		// The body is only the error message, callers that get an error back just check the status code
 		bodyResp, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
 		var errorResponse struct {
 			Error string `json:"message"`
 		}
@@ -38,7 +127,13 @@ func retryHttp(client *http.Client, req *http.Request, retryCount int) (*http.Re
 
 		err = fmt.Errorf("'%s'", errorResponse.Error)
 	}
+	if audited {
+		auditRequest(req, payloadHash, attempt, resp, err)
+	}
 
+	if resp == nil {
+		return nil, err
+	}
 	return resp, err
 }
 
@@ -46,7 +141,6 @@ func TokenApiCall(baseUrl string, username string, password string) (string, err
 	url := baseUrl + "/api/v1/auth/login"
 	authBody := map[string]string{"username": username, "password": password}
 	authBodyJson, _ := json.Marshal(authBody)
-	client := &http.Client{}
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(authBodyJson))
 	req.Header = http.Header{"content-type": {"application/json"}}
 
@@ -56,7 +150,7 @@ func TokenApiCall(baseUrl string, username string, password string) (string, err
 		httpErr    error
 	)
 
-	resp, httpErr = retryHttp(client, req, maxRetries)
+	resp, httpErr = retryHttp(req, maxRetries)
 
 	if resp != nil && httpErr == nil {
 		defer resp.Body.Close()
@@ -87,7 +181,6 @@ func TokenApiCall(baseUrl string, username string, password string) (string, err
 func GetWorkerGroups(baseUrl string, token string) ([]byte, error) {
 	url := baseUrl + "/api/v1/master/groups"
 
-	client := &http.Client{}
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header = http.Header{"Authorization": {token}}
 
@@ -97,7 +190,7 @@ func GetWorkerGroups(baseUrl string, token string) ([]byte, error) {
 		httpErr    error
 	)
 
-	resp, httpErr = retryHttp(client, req, maxRetries)
+	resp, httpErr = retryHttp(req, maxRetries)
 
 	if resp != nil && httpErr == nil {
 		defer resp.Body.Close()
@@ -113,105 +206,60 @@ func GetWorkerGroups(baseUrl string, token string) ([]byte, error) {
 	}
 }
 
-func GetLookupContent(baseApiUrl string, workerGroup string, token string, lookupId string) ([]byte, error) {
-	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/system/lookups/" + lookupId + "/content?raw=0"
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
-
-	var (
-		maxRetries int = 5
-		resp       *http.Response
-		httpErr    error
-	)
-
-	resp, httpErr = retryHttp(client, req, maxRetries)
-
-	if resp != nil && httpErr == nil {
-		defer resp.Body.Close()
-
-		responseData, readErr := io.ReadAll(resp.Body)
-		if readErr != nil {
-			return nil, fmt.Errorf("unable to properly read response body %w", readErr)
-		}
-
-		return responseData, nil
-	} else {
-		return nil, fmt.Errorf("lookup content for %s unable to be retrieved from url %s : %w Attempted (%d) time(s)", lookupId, url, httpErr, maxRetries)
+// lookupPatchPayload builds the PATCH/POST payload that points the lookup id at the file the leader just stored on upload
+func lookupPatchPayload(lookup_id string, uploadResponse io.Reader) ([]byte, error) {
+	responseData, readErr := io.ReadAll(uploadResponse)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to properly read response body %w", readErr)
 	}
 
-}
-
-func UploadLookup(baseApiUrl string, workerGroup string, token string, lookup_id string, lookupContent []byte) ([]byte, error) {
-	client := &http.Client{}
-	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/system/lookups/?filename=" + lookup_id
-	//objectConfigBytes, _ := json.Marshal(responseData)
-	req, _ := http.NewRequest("PUT", url, bytes.NewBuffer(lookupContent))
-	req.Header = http.Header{"Authorization": {token}, "content-type": {"text/csv"}}
-
-	var (
-		maxRetries int = 5
-		resp       *http.Response
-		httpErr    error
-	)
-
-	resp, httpErr = retryHttp(client, req, maxRetries)
-
-	if resp != nil && httpErr == nil {
-		responseData, readErr := io.ReadAll(resp.Body)
-		if readErr != nil {
-			return nil, fmt.Errorf("unable to properly read response body %w", readErr)
-		}
-
-		var lookupPayloadFileinfo struct {
-			FileName string `json:"filename"`
-		}
-
-		type fileInfo struct {
-			Filename string `json:"filename"`
-		}
+	var lookupPayloadFileinfo struct {
+		FileName string `json:"filename"`
+	}
 
-		type LookupPayload struct {
-			Id       string   `json:"id"`
-			FileInfo fileInfo `json:"fileInfo"`
-		}
+	type fileInfo struct {
+		Filename string `json:"filename"`
+	}
 
-		unMarshErr := json.Unmarshal([]byte(responseData), &lookupPayloadFileinfo)
-		if unMarshErr != nil {
-			return nil, fmt.Errorf("unable to extract lookup upload details from respones body: %w", unMarshErr)
-		}
+	type LookupPayload struct {
+		Id       string   `json:"id"`
+		FileInfo fileInfo `json:"fileInfo"`
+	}
 
-		lookupApiPayload := LookupPayload{
-			Id: lookup_id,
-			FileInfo: fileInfo{
-				Filename: lookupPayloadFileinfo.FileName,
-			},
-		}
+	unMarshErr := json.Unmarshal([]byte(responseData), &lookupPayloadFileinfo)
+	if unMarshErr != nil {
+		return nil, fmt.Errorf("unable to extract lookup upload details from respones body: %w", unMarshErr)
+	}
 
-		lookUpPayloadJson, marshErr := json.Marshal(lookupApiPayload)
-		if marshErr != nil {
-			return nil, fmt.Errorf("unable to format upload payload to be used for patching: %w", marshErr)
-		}
+	lookupApiPayload := LookupPayload{
+		Id: lookup_id,
+		FileInfo: fileInfo{
+			Filename: lookupPayloadFileinfo.FileName,
+		},
+	}
 
-		return lookUpPayloadJson, nil
-	} else {
-		return nil, fmt.Errorf("uploading lookup failed when trying url %s : %w Attempted (%d) time(s)", url, httpErr, maxRetries)
+	lookUpPayloadJson, marshErr := json.Marshal(lookupApiPayload)
+	if marshErr != nil {
+		return nil, fmt.Errorf("unable to format upload payload to be used for patching: %w", marshErr)
 	}
 
+	return lookUpPayloadJson, nil
 }
 
 func PatchLookup(baseApiUrl string, workerGroup string, token string, lookup_id string, patchPayload []byte) error {
-	client := &http.Client{}
 	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/system/lookups/" + lookup_id
 	req, _ := http.NewRequest("PATCH", url, bytes.NewBuffer(patchPayload))
 	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
 	var (
 		maxRetries int = 5
-		// resp       *http.Response
-		httpErr error
+		resp       *http.Response
+		httpErr    error
 	)
 
-	_, httpErr = retryHttp(client, req, maxRetries)
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp != nil {
+		resp.Body.Close()
+	}
 	if httpErr != nil {
 		return fmt.Errorf("patching lookup failed when trying url %s: %w Attempted (%d) time(s)", url, httpErr, maxRetries)
 	} else {
@@ -220,17 +268,19 @@ func PatchLookup(baseApiUrl string, workerGroup string, token string, lookup_id
 }
 
 func CreateLookup(baseApiUrl string, workerGroup string, token string, lookup_id string, patchPayload []byte) error {
-	client := &http.Client{}
 	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/system/lookups"
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(patchPayload))
 	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
 	var (
 		maxRetries int = 5
-		// resp       *http.Response
-		httpErr error
+		resp       *http.Response
+		httpErr    error
 	)
 
-	_, httpErr = retryHttp(client, req, maxRetries)
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp != nil {
+		resp.Body.Close()
+	}
 	if httpErr != nil {
 		return fmt.Errorf("patching lookup failed when trying url %s: %w Attempted (%d) time(s)", url, httpErr, maxRetries)
 	} else {
@@ -239,27 +289,24 @@ func CreateLookup(baseApiUrl string, workerGroup string, token string, lookup_id
 }
 
 func GetDataObj(baseApiUrl string, workerGroup string, token string, id string, objType string) ([]byte, error) {
+	return getDataObj(baseApiUrl, workerGroup, token, id, objType, nil)
+}
 
-	var objEndpoint string
+// getDataObj is GetDataObj with prepare, if not nil, applied to the request, e.g. detachFromRun
+func getDataObj(baseApiUrl string, workerGroup string, token string, id string, objType string, prepare func(*http.Request) *http.Request) ([]byte, error) {
 
-	switch strings.ToLower(objType) {
-	case "source":
-		objEndpoint = "/system/inputs"
-	case "destination":
-		objEndpoint = "/system/outputs"
-	case "pipeline":
-		objEndpoint = "/pipelines"
-	case "globalvariable":
-		objEndpoint = "/lib/vars"
-	default:
-		fmt.Printf("invalid Object Type provided: %s. Valid options are: Source, Destination, Pipeline, Pack, GlobalVariable, or Lookup", objType)
+	objEndpoint, endpointErr := ObjEndpoint(objType)
+	if endpointErr != nil {
+		return nil, endpointErr
 	}
 
 	url := baseApiUrl + "/api/v1/m/" + workerGroup + objEndpoint + "/" + id
 
-	client := &http.Client{}
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header = http.Header{"Authorization": {token}}
+	if prepare != nil {
+		req = prepare(req)
+	}
 
 	var (
 		maxRetries int = 5
@@ -267,7 +314,7 @@ func GetDataObj(baseApiUrl string, workerGroup string, token string, id string,
 		httpErr    error
 	)
 
-	resp, httpErr = retryHttp(client, req, maxRetries)
+	resp, httpErr = retryHttp(req, maxRetries)
 
 	if resp != nil && httpErr == nil {
 		defer resp.Body.Close()
@@ -288,8 +335,8 @@ func GetDataObj(baseApiUrl string, workerGroup string, token string, id string,
 		}
 
 		if len(response.Items) > 0 {
+			// notifications are kept so they can be remapped to the target environment's notification targets
 			delete(response.Items[0], "status")
-			delete(response.Items[0], "notifications")
 
 			objectConfig, marshErr := json.Marshal(response.Items[0])
 			if marshErr != nil {
@@ -298,41 +345,117 @@ func GetDataObj(baseApiUrl string, workerGroup string, token string, id string,
 			return objectConfig, nil
 
 		} else {
-			return nil, fmt.Errorf("%s content for %s returned empty from url %s", objType, id, url)
+			return nil, fmt.Errorf("%s content for %s returned empty from url %s: %w", objType, id, url, ErrObjNotFound)
 		}
 
+	} else if resp != nil && resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s not found at url %s: %w", objType, id, url, ErrObjNotFound)
 	} else {
 		return nil, fmt.Errorf("%s content for %s unable to be retrieved from url %s: %w Attempted (%d) time(s)", objType, id, url, httpErr, maxRetries)
 	}
 }
 
+// ListDataObjs returns every object of a type in a worker group by id, without the leader's status field
+func ListDataObjs(baseApiUrl string, workerGroup string, token string, objType string) (map[string]CribConfig, error) {
+	objEndpoint, endpointErr := ObjEndpoint(objType)
+	if endpointErr != nil {
+		return nil, endpointErr
+	}
+
+	url := baseApiUrl + "/api/v1/m/" + workerGroup + objEndpoint
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header = http.Header{"Authorization": {token}}
+
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+
+	if resp == nil || httpErr != nil {
+		return nil, fmt.Errorf("%s list unable to be retrieved from url %s: %w Attempted (%d) time(s)", objType, url, httpErr, maxRetries)
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Items []CribConfig `json:"items"`
+	}
+	if decodeErr := json.NewDecoder(resp.Body).Decode(&response); decodeErr != nil {
+		return nil, fmt.Errorf("unable to read %s list from url %s: %w", objType, url, decodeErr)
+	}
+
+	objects := map[string]CribConfig{}
+	for _, item := range response.Items {
+		id, _ := item["id"].(string)
+		if id == "" {
+			continue
+		}
+		delete(item, "status")
+		objects[id] = item
+	}
+	return objects, nil
+}
+
+// ListLookups returns the ids of every lookup file in a worker group
+func ListLookups(baseApiUrl string, workerGroup string, token string) ([]string, error) {
+	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/system/lookups"
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header = http.Header{"Authorization": {token}}
+
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+
+	if resp == nil || httpErr != nil {
+		return nil, fmt.Errorf("lookup list unable to be retrieved from url %s: %w Attempted (%d) time(s)", url, httpErr, maxRetries)
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Items []struct {
+			Id string `json:"id"`
+		} `json:"items"`
+	}
+	if decodeErr := json.NewDecoder(resp.Body).Decode(&response); decodeErr != nil {
+		return nil, fmt.Errorf("unable to read lookup list from url %s: %w", url, decodeErr)
+	}
+
+	lookupIds := make([]string, 0, len(response.Items))
+	for _, item := range response.Items {
+		lookupIds = append(lookupIds, item.Id)
+	}
+	sort.Strings(lookupIds)
+	return lookupIds, nil
+}
+
 func UpdateDataObj(baseApiUrl string, workerGroup string, token string, id string, objConfig []byte, objType string) error {
-	var objEndpoint string
-
-	switch strings.ToLower(objType) {
-	case "source":
-		objEndpoint = "/system/inputs"
-	case "destination":
-		objEndpoint = "/system/outputs"
-	case "pipeline":
-		objEndpoint = "/pipelines"
-	case "globalvariable":
-		objEndpoint = "/lib/vars"
-	default:
-		log.Fatalf("invalid Object Type provided: %s. Valid options are: Source, Destination, Pipeline, Pack, GlobalVariable, or Lookup", objType)
-	}
-
-	client := &http.Client{}
+	objEndpoint, endpointErr := ObjEndpoint(objType)
+	if endpointErr != nil {
+		return endpointErr
+	}
+
 	url := baseApiUrl + "/api/v1/m/" + workerGroup + objEndpoint + "/" + id
 	req, _ := http.NewRequest("PATCH", url, bytes.NewBuffer(objConfig))
 	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
 	var (
 		maxRetries int = 5
-		//resp       *http.Response
-		httpErr error
+		resp       *http.Response
+		httpErr    error
 	)
 
-	_, httpErr = retryHttp(client, req, maxRetries)
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp != nil {
+		resp.Body.Close()
+	}
 
 	if httpErr != nil {
 		return fmt.Errorf("patching %s failed when trying url %s: %w, Attempted (%d) time(s)", objType, url, httpErr, maxRetries)
@@ -342,32 +465,24 @@ func UpdateDataObj(baseApiUrl string, workerGroup string, token string, id strin
 }
 
 func CreateDataObj(baseApiUrl string, workerGroup string, token string, id string, objConfig []byte, objType string) error {
-	var objEndpoint string
-
-	switch strings.ToLower(objType) {
-	case "source":
-		objEndpoint = "/system/inputs"
-	case "destination":
-		objEndpoint = "/system/outputs"
-	case "pipeline":
-		objEndpoint = "/pipelines"
-	case "globalvariable":
-		objEndpoint = "/lib/vars"
-	default:
-		log.Fatalf("invalid Object Type provided: %s. Valid options are: Source, Destination, Pipeline, Pack, GlobalVariable, or Lookup", objType)
-	}
-
-	client := &http.Client{}
+	objEndpoint, endpointErr := ObjEndpoint(objType)
+	if endpointErr != nil {
+		return endpointErr
+	}
+
 	url := baseApiUrl + "/api/v1/m/" + workerGroup + objEndpoint
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(objConfig))
 	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
 	var (
 		maxRetries int = 5
-		//resp       *http.Response
-		httpErr error
+		resp       *http.Response
+		httpErr    error
 	)
 
-	_, httpErr = retryHttp(client, req, maxRetries)
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp != nil {
+		resp.Body.Close()
+	}
 
 	if httpErr != nil {
 		return fmt.Errorf("posting %s failed when trying url %s: %w, Attempted (%d) time(s)", objType, url, httpErr, maxRetries)
@@ -375,3 +490,38 @@ func CreateDataObj(baseApiUrl string, workerGroup string, token string, id strin
 		return nil
 	}
 }
+
+func DeleteDataObj(baseApiUrl string, workerGroup string, token string, id string, objType string) error {
+	return deleteDataObj(baseApiUrl, workerGroup, token, id, objType, nil)
+}
+
+// deleteDataObj is DeleteDataObj with prepare, if not nil, applied to the request, e.g. detachFromRun
+func deleteDataObj(baseApiUrl string, workerGroup string, token string, id string, objType string, prepare func(*http.Request) *http.Request) error {
+	objEndpoint, endpointErr := ObjEndpoint(objType)
+	if endpointErr != nil {
+		return endpointErr
+	}
+
+	url := baseApiUrl + "/api/v1/m/" + workerGroup + objEndpoint + "/" + id
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header = http.Header{"Authorization": {token}}
+	if prepare != nil {
+		req = prepare(req)
+	}
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	if httpErr != nil {
+		return fmt.Errorf("deleting %s failed when trying url %s: %w, Attempted (%d) time(s)", objType, url, httpErr, maxRetries)
+	} else {
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+)
+
+// validateGlobalVariableValue checks the value of a /lib/vars entry against its declared type. The leader stores most
+// values as strings, so e.g. a number variable is valid with either 42 or "42". Types not modelled here, like any, are
+// left for the leader to check.
+func validateGlobalVariableValue(id string, varType string, value interface{}) error {
+	strValue, isString := value.(string)
+
+	switch strings.ToLower(varType) {
+	case "number":
+		if _, isNumber := value.(float64); isNumber {
+			return nil
+		}
+		if _, parseErr := strconv.ParseFloat(strings.TrimSpace(strValue), 64); !isString || parseErr != nil {
+			return fmt.Errorf("global variable '%s' is type number but value %s is not a number", id, jsonString(value))
+		}
+	case "boolean":
+		if _, isBool := value.(bool); isBool {
+			return nil
+		}
+		if strValue != "true" && strValue != "false" {
+			return fmt.Errorf("global variable '%s' is type boolean but value %s is not true or false", id, jsonString(value))
+		}
+	case "string":
+		if !isString {
+			return fmt.Errorf("global variable '%s' is type string but value %s is not a string", id, jsonString(value))
+		}
+	case "array":
+		if _, isArray := value.([]interface{}); isArray {
+			return nil
+		}
+		var parsed []interface{}
+		if unMarshErr := json.Unmarshal([]byte(strValue), &parsed); !isString || unMarshErr != nil {
+			return fmt.Errorf("global variable '%s' is type array but value %s is not a JSON array", id, jsonString(value))
+		}
+	case "object":
+		if _, isObject := value.(map[string]interface{}); isObject {
+			return nil
+		}
+		var parsed map[string]interface{}
+		if unMarshErr := json.Unmarshal([]byte(strValue), &parsed); !isString || unMarshErr != nil {
+			return fmt.Errorf("global variable '%s' is type object but value %s is not a JSON object", id, jsonString(value))
+		}
+	case "expression":
+		if !isString {
+			return fmt.Errorf("global variable '%s' is type expression but value %s is not a string", id, jsonString(value))
+		}
+		if parseErr := ParseJsExpression(strValue); parseErr != nil {
+			return fmt.Errorf("global variable '%s' has an invalid expression: %w", id, parseErr)
+		}
+	}
+	return nil
+}
+
+// ParseJsExpression checks that src is a single syntactically valid JavaScript expression
+func ParseJsExpression(src string) error {
+	if strings.TrimSpace(src) == "" {
+		return fmt.Errorf("expression is empty")
+	}
+
+	// Parenthesised so object literals parse as expressions rather than blocks. Newlines keep a trailing
+	// line comment in src from swallowing the closing parenthesis.
+	program, parseErr := parser.ParseFile(nil, "", "(\n"+src+"\n)", 0)
+	if parseErr != nil {
+		return parseErr
+	}
+	if len(program.Body) != 1 {
+		return fmt.Errorf("expected a single expression, found %d statements", len(program.Body))
+	}
+	if _, isExpression := program.Body[0].(*ast.ExpressionStatement); !isExpression {
+		return fmt.Errorf("expected an expression")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package functions
+
+import (
+	"testing"
+)
+
+func TestValidateGlobalVariableValue(t *testing.T) {
+	tests := []struct {
+		varType string
+		value   interface{}
+		valid   bool
+	}{
+		{"number", 42.0, true},
+		{"number", "42", true},
+		{"number", " 1.5 ", true},
+		{"number", "forty two", false},
+		{"number", true, false},
+		{"boolean", true, true},
+		{"boolean", "false", true},
+		{"boolean", "yes", false},
+		{"string", "'us-east-1'", true},
+		{"string", 5.0, false},
+		{"array", `["a", "b"]`, true},
+		{"array", []interface{}{"a"}, true},
+		{"array", `{"a": 1}`, false},
+		{"object", `{"a": 1}`, true},
+		{"object", map[string]interface{}{"a": 1.0}, true},
+		{"object", `[1]`, false},
+		{"expression", "`${C.env.REGION}-logs`", true},
+		{"expression", "{region: 'us', port: 9000}", true},
+		{"expression", "host.startsWith('web') ? 'web' : 'other'", true},
+		{"expression", "value // trailing comment", true},
+		{"expression", "(1 + ", false},
+		{"expression", "1); process.exit(", false},
+		{"expression", "a = 1; b = 2", false},
+		{"expression", "   ", false},
+		{"expression", 7.0, false},
+		{"any", "a+", true},
+		{"any", map[string]interface{}{"a": 1.0}, true},
+	}
+	for _, test := range tests {
+		err := validateGlobalVariableValue("v", test.varType, test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("%s %#v: expected valid %v, got %v", test.varType, test.value, test.valid, err)
+		}
+	}
+}
+
+func TestGlobalVariableValidatedBeforePush(t *testing.T) {
+	if err := ValidateTypedConfig("globalvariable", []byte(`{"id": "region", "type": "expression", "value": "C.env.REGION ||"}`)); err == nil {
+		t.Error("expected a global variable with an invalid expression to fail validation")
+	}
+	if err := ValidateTypedConfig("globalvariable", []byte(`{"id": "region", "type": "expression", "value": "C.env.REGION || 'us-east-1'"}`)); err != nil {
+		t.Errorf("expected a valid expression to pass, got %v", err)
+	}
+	if err := ValidateTypedConfig("globalvariable", []byte(`{"id": "lookup_fields", "type": "any", "value": "['host', 'owner']"}`)); err != nil {
+		t.Errorf("expected a type that isn't modelled to be pushed as it is, got %v", err)
+	}
+}
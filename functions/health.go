@@ -0,0 +1,117 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	metricInEvents      = "total.in_events"
+	metricDroppedEvents = "total.dropped_events"
+)
+
+// GroupHealth is a snapshot of a worker group taken around a rollout wave. The event counters are cumulative totals
+// across the group's workers, so the error rate of a wave comes from the difference between two snapshots.
+type GroupHealth struct {
+	WorkerGroup      string
+	Workers          int
+	ConnectedWorkers int
+	InEvents         float64
+	DroppedEvents    float64
+}
+
+// GetGroupHealth reads the group's workers from /master/workers and its event counters from the group's metrics
+func GetGroupHealth(baseApiUrl string, workerGroup string, token string) (GroupHealth, error) {
+	health := GroupHealth{WorkerGroup: workerGroup}
+
+	var workers struct {
+		Items []struct {
+			Group        string `json:"group"`
+			Disconnected bool   `json:"disconnected"`
+		} `json:"items"`
+	}
+	if getErr := getHealthJson(baseApiUrl+"/api/v1/master/workers", token, &workers); getErr != nil {
+		return health, fmt.Errorf("unable to read workers of worker group %s: %w", workerGroup, getErr)
+	}
+	for _, worker := range workers.Items {
+		if worker.Group != workerGroup {
+			continue
+		}
+		health.Workers++
+		if !worker.Disconnected {
+			health.ConnectedWorkers++
+		}
+	}
+
+	var metrics struct {
+		Items []struct {
+			Name  string  `json:"name"`
+			Value float64 `json:"value"`
+		} `json:"items"`
+	}
+	if getErr := getHealthJson(baseApiUrl+"/api/v1/m/"+workerGroup+"/system/metrics", token, &metrics); getErr != nil {
+		return health, fmt.Errorf("unable to read metrics of worker group %s: %w", workerGroup, getErr)
+	}
+	for _, metric := range metrics.Items {
+		switch metric.Name {
+		case metricInEvents:
+			health.InEvents += metric.Value
+		case metricDroppedEvents:
+			health.DroppedEvents += metric.Value
+		}
+	}
+
+	return health, nil
+}
+
+func getHealthJson(url string, token string, response interface{}) error {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header = http.Header{"Authorization": {token}}
+
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+
+	if resp != nil && httpErr == nil {
+		defer resp.Body.Close()
+
+		responseData, readErr := io.ReadAll(resp.Body)
+		if readErr != nil {
+			return fmt.Errorf("unable to properly read response body %w", readErr)
+		}
+		if unMarshErr := json.Unmarshal(responseData, response); unMarshErr != nil {
+			return fmt.Errorf("unable to parse response body from url %s: %w", url, unMarshErr)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("request to url %s failed: %w Attempted (%d) time(s)", url, httpErr, maxRetries)
+	}
+}
+
+// CheckHealthGate compares a group's health after a wave to before it. The gate fails if the group lost connected
+// workers, has none, or dropped more than maxErrorRate of the events it received in between. Counters that went down,
+// e.g. because a worker restarted, leave the error rate unknown, which fails the gate too.
+func CheckHealthGate(before GroupHealth, after GroupHealth, maxErrorRate float64) error {
+	if after.ConnectedWorkers == 0 {
+		return fmt.Errorf("worker group %s has no connected workers", after.WorkerGroup)
+	}
+	if after.ConnectedWorkers < before.ConnectedWorkers {
+		return fmt.Errorf("worker group %s has %d connected worker(s), %d before the change", after.WorkerGroup, after.ConnectedWorkers, before.ConnectedWorkers)
+	}
+
+	inEvents := after.InEvents - before.InEvents
+	droppedEvents := after.DroppedEvents - before.DroppedEvents
+	if inEvents < 0 || droppedEvents < 0 {
+		return fmt.Errorf("worker group %s's event counters went down since the change (a worker restarted?), its error rate is unknown", after.WorkerGroup)
+	}
+	if inEvents > 0 && droppedEvents/inEvents > maxErrorRate {
+		return fmt.Errorf("worker group %s dropped %.0f of %.0f event(s) (%.2f%%) since the change, the limit is %.2f%%", after.WorkerGroup, droppedEvents, inEvents, 100*droppedEvents/inEvents, 100*maxErrorRate)
+	}
+	return nil
+}
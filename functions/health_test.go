@@ -0,0 +1,58 @@
+package functions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckHealthGate(t *testing.T) {
+	before := GroupHealth{WorkerGroup: "wg1", Workers: 2, ConnectedWorkers: 2, InEvents: 1000, DroppedEvents: 10}
+	tests := []struct {
+		name    string
+		after   GroupHealth
+		wantErr string
+	}{
+		{
+			name:  "healthy",
+			after: GroupHealth{WorkerGroup: "wg1", Workers: 2, ConnectedWorkers: 2, InEvents: 2000, DroppedEvents: 15},
+		},
+		{
+			name:  "no events since the change",
+			after: GroupHealth{WorkerGroup: "wg1", Workers: 2, ConnectedWorkers: 2, InEvents: 1000, DroppedEvents: 10},
+		},
+		{
+			name:    "no connected workers",
+			after:   GroupHealth{WorkerGroup: "wg1", Workers: 2, InEvents: 2000, DroppedEvents: 10},
+			wantErr: "no connected workers",
+		},
+		{
+			name:    "lost a worker",
+			after:   GroupHealth{WorkerGroup: "wg1", Workers: 2, ConnectedWorkers: 1, InEvents: 2000, DroppedEvents: 10},
+			wantErr: "1 connected worker(s), 2 before",
+		},
+		{
+			name:    "dropping events",
+			after:   GroupHealth{WorkerGroup: "wg1", Workers: 2, ConnectedWorkers: 2, InEvents: 2000, DroppedEvents: 110},
+			wantErr: "dropped 100 of 1000",
+		},
+		{
+			name:    "counters reset by a worker restart",
+			after:   GroupHealth{WorkerGroup: "wg1", Workers: 2, ConnectedWorkers: 2, InEvents: 500, DroppedEvents: 400},
+			wantErr: "error rate is unknown",
+		},
+		{
+			name:    "dropped counter reset",
+			after:   GroupHealth{WorkerGroup: "wg1", Workers: 2, ConnectedWorkers: 2, InEvents: 2000, DroppedEvents: 0},
+			wantErr: "error rate is unknown",
+		},
+	}
+	for _, test := range tests {
+		err := CheckHealthGate(before, test.after, 0.01)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: expected the gate to pass, got %v", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.wantErr, err)
+		}
+	}
+}
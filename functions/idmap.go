@@ -0,0 +1,216 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// IdMap maps template object ids to the ids the objects have on the target, per object type, e.g.
+//
+//	{"destination": {"uat_splunk_hec": "prod_splunk_hec"}, "pipeline": {"uat_main": "prod_main"}}
+//
+// Mappings under "*" apply to every object type.
+type IdMap map[string]map[string]string
+
+// Same rule as the -id flag
+var validMappedId = regexp.MustCompile(`^[a-zA-Z0-9_-]+(?:\.csv|\.csv\.gz|\.mmdb)?$`)
+
+// idReferences are the fields that hold the id of another object, by the type of object they are in ("*" for any).
+// Paths use the policy rule syntax.
+var idReferences = []struct {
+	objType string
+	path    string
+	refType string
+}{
+	{"source", "pipeline", "pipeline"},
+	{"source", "output", "destination"},
+	{"source", "connections[*].pipeline", "pipeline"},
+	{"source", "connections[*].output", "destination"},
+	// Post-processing pipeline
+	{"destination", "pipeline", "pipeline"},
+	// Output router destinations
+	{"destination", "rules[*].output", "destination"},
+	{"pipeline", "conf.output", "destination"},
+	{"pipeline", "conf.functions[?id=chain].conf.processor", "pipeline"},
+	{"pipeline", "conf.functions[?id=lookup].conf.file", "lookup"},
+	{"collector", "input.pipeline", "pipeline"},
+	{"collector", "input.output", "destination"},
+	{"*", "tls.certificateName", "certificate"},
+}
+
+// Add maps fromId to toId for the object type ("*" for any)
+func (m IdMap) Add(objType string, fromId string, toId string) error {
+	if !validMappedId.MatchString(fromId) || !validMappedId.MatchString(toId) {
+		return fmt.Errorf("invalid id mapping %s=%s, ids may only contain letters, numbers, '_' and '-'", fromId, toId)
+	}
+	objType = strings.ToLower(objType)
+	if objType != "*" && objType != "lookup" && !IsDataObjType(objType) {
+		return fmt.Errorf("invalid object type %s in id mapping %s=%s", objType, fromId, toId)
+	}
+	if objType == "lookup" && LookupFormat(fromId) != LookupFormat(toId) {
+		return fmt.Errorf("lookup id mapping %s=%s changes the file format", fromId, toId)
+	}
+	if m[objType] == nil {
+		m[objType] = map[string]string{}
+	}
+	m[objType][fromId] = toId
+	return nil
+}
+
+// LoadIdMap reads an id map file, see IdMap for the format
+func LoadIdMap(filePath string) (IdMap, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read id map file %s: %w", filePath, readErr)
+	}
+	var fileMap IdMap
+	if unMarshErr := json.Unmarshal(content, &fileMap); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to parse id map file %s: %w", filePath, unMarshErr)
+	}
+
+	idMap := IdMap{}
+	for objType, mappings := range fileMap {
+		for fromId, toId := range mappings {
+			if addErr := idMap.Add(objType, fromId, toId); addErr != nil {
+				return nil, fmt.Errorf("id map file %s: %w", filePath, addErr)
+			}
+		}
+	}
+	return idMap, nil
+}
+
+// ParseIdMappings adds comma separated [type:]from=to mappings, e.g. "destination:uat_splunk_hec=prod_splunk_hec", to
+// the map, replacing any mapping of the same type and id. A mapping without a type goes under "*" and so renames that
+// id for every object type, including the references to it.
+func (m IdMap) ParseIdMappings(value string) error {
+	for mapping := range strings.SplitSeq(value, ",") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+		objType, ids, hasType := strings.Cut(mapping, ":")
+		if !hasType {
+			objType, ids = "*", mapping
+		}
+		fromId, toId, hasEquals := strings.Cut(ids, "=")
+		if !hasEquals {
+			return fmt.Errorf("id mapping '%s' must be in the form [type:]from=to", mapping)
+		}
+		if addErr := m.Add(objType, strings.TrimSpace(fromId), strings.TrimSpace(toId)); addErr != nil {
+			return addErr
+		}
+	}
+	return nil
+}
+
+// TargetId returns the id an object has on the target, which is its template id unless it is mapped
+func (m IdMap) TargetId(objType string, id string) string {
+	if toId, mapped := m[strings.ToLower(objType)][id]; mapped {
+		return toId
+	}
+	if toId, mapped := m["*"][id]; mapped {
+		return toId
+	}
+	return id
+}
+
+// RemapIds sets the object's own id to its target id and rewrites the ids of other objects it refers to. It also
+// returns a description of each rewrite.
+func RemapIds(objType string, objConfig []byte, idMap IdMap) ([]byte, []string, error) {
+	if len(idMap) == 0 {
+		return objConfig, nil, nil
+	}
+
+	var config CribConfig
+	if unMarshErr := json.Unmarshal(objConfig, &config); unMarshErr != nil {
+		return nil, nil, fmt.Errorf("unable to read config to remap ids: %w", unMarshErr)
+	}
+
+	var rewrites []string
+	rewriteId := func(path string, refType string) func(interface{}) interface{} {
+		return func(value interface{}) interface{} {
+			id, isString := value.(string)
+			if !isString {
+				return value
+			}
+			toId := idMap.TargetId(refType, id)
+			if toId != id {
+				rewrites = append(rewrites, fmt.Sprintf("%s: %s -> %s", path, id, toId))
+			}
+			return toId
+		}
+	}
+
+	root := map[string]interface{}(config)
+	if _, hasId := root["id"]; hasId {
+		root["id"] = rewriteId("id", objType)(root["id"])
+	}
+	for _, ref := range idReferences {
+		if ref.objType != "*" && ref.objType != strings.ToLower(objType) {
+			continue
+		}
+		segments, _ := parsePolicyPath(ref.path)
+		rewritePolicyPath(root, segments, rewriteId(ref.path, ref.refType))
+	}
+
+	if len(rewrites) == 0 {
+		return objConfig, nil, nil
+	}
+	sort.Strings(rewrites)
+	remappedConfig, marshErr := json.Marshal(config)
+	if marshErr != nil {
+		return nil, nil, fmt.Errorf("unable to format config after remapping ids: %w", marshErr)
+	}
+	return remappedConfig, rewrites, nil
+}
+
+// rewritePolicyPath replaces every value the path points at with rewrite(value), in place. It returns the node
+// so array elements and leaves can be replaced by their parent.
+func rewritePolicyPath(node interface{}, segments []policyPathSegment, rewrite func(interface{}) interface{}) interface{} {
+	if len(segments) == 0 {
+		return rewrite(node)
+	}
+
+	segment := segments[0]
+	if segment.key == "" {
+		return rewritePolicyPathSelector(node, segment, segments[1:], rewrite)
+	}
+	obj, isObj := node.(map[string]interface{})
+	if !isObj {
+		return node
+	}
+	value, exists := obj[segment.key]
+	if !exists {
+		return node
+	}
+	obj[segment.key] = rewritePolicyPathSelector(value, segment, segments[1:], rewrite)
+	return obj
+}
+
+func rewritePolicyPathSelector(current interface{}, segment policyPathSegment, rest []policyPathSegment, rewrite func(interface{}) interface{}) interface{} {
+	if !segment.wildcard && !segment.hasIndex && segment.filterKey == "" {
+		return rewritePolicyPath(current, rest, rewrite)
+	}
+
+	arr, isArr := current.([]interface{})
+	if !isArr {
+		return current
+	}
+	for i, element := range arr {
+		switch {
+		case segment.hasIndex && i != segment.index:
+			continue
+		case segment.filterKey != "":
+			obj, isObj := element.(map[string]interface{})
+			if !isObj || fmt.Sprint(obj[segment.filterKey]) != segment.filterValue {
+				continue
+			}
+		}
+		arr[i] = rewritePolicyPath(element, rest, rewrite)
+	}
+	return arr
+}
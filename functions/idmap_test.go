@@ -0,0 +1,41 @@
+package functions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdMapMergesFileAndFlagMappings(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "idmap.json")
+	os.WriteFile(mapFile, []byte(`{"destination": {"uat_hec": "prod_hec", "uat_s3": "prod_s3"}, "pipeline": {"main": "prod_main"}}`), 0600)
+	idMap, err := LoadIdMap(mapFile)
+	if err != nil {
+		t.Fatalf("unable to load id map: %v", err)
+	}
+	if err := idMap.ParseIdMappings("destination:uat_hec=prod_hec2, main=everywhere_main"); err != nil {
+		t.Fatalf("unable to parse id mappings: %v", err)
+	}
+
+	tests := []struct {
+		objType, id, want string
+	}{
+		// Same type and id as the file, the flag wins
+		{"destination", "uat_hec", "prod_hec2"},
+		// Only in the file, kept
+		{"destination", "uat_s3", "prod_s3"},
+		// Typed mapping from the file wins over the untyped one
+		{"pipeline", "main", "prod_main"},
+		// Untyped mapping applies to every other type
+		{"source", "main", "everywhere_main"},
+		{"destination", "unmapped", "unmapped"},
+	}
+	for _, test := range tests {
+		if got := idMap.TargetId(test.objType, test.id); got != test.want {
+			t.Errorf("%s %s: expected %s, got %s", test.objType, test.id, test.want, got)
+		}
+	}
+	if err := idMap.ParseIdMappings("destination:uat_hec"); err == nil {
+		t.Error("expected a mapping without '=' to be rejected")
+	}
+}
@@ -0,0 +1,417 @@
+package functions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LeaderLockVarId is the global variable created in a worker group while a run holds its leader lock. It is a marker
+// only, nothing references it.
+const LeaderLockVarId = "criblpatching_run_lock"
+
+// LockInfo describes who holds a lock and until when. A local lock past its expiry is stale and can be taken over, a
+// stale leader lock has to be removed with force-unlock -leader.
+type LockInfo struct {
+	Owner    string    `json:"owner"`
+	RunId    string    `json:"runId"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (l LockInfo) String() string {
+	return fmt.Sprintf("%s since %s (expires %s)", l.Owner, l.Acquired.Local().Format(time.RFC3339), l.Expires.Local().Format(time.RFC3339))
+}
+
+type heldLock struct {
+	env         string
+	workerGroup string
+	leader      bool
+}
+
+// RunLocker takes a lock per environment and worker group for one run: a local lock file, and optionally a marker
+// global variable on the leader so operators on other machines are locked out too. Held locks are renewed in the
+// background every third of the TTL, so a run that takes longer than the TTL keeps them.
+type RunLocker struct {
+	dir string
+	ttl time.Duration
+	// Guards info and held, which the heartbeat uses while the run does
+	mu   sync.Mutex
+	info LockInfo
+	held []heldLock
+	// Leader to hold marker variables on, "" for local locks only
+	leaderUrl   string
+	leaderToken string
+	// Closed to stop the heartbeat, which closes heartbeatDone once it has
+	stopHeartbeat chan struct{}
+	heartbeatDone chan struct{}
+}
+
+func NewRunLocker(dir string, ttl time.Duration) *RunLocker {
+	runId := make([]byte, 8)
+	rand.Read(runId)
+	hostname, _ := os.Hostname()
+	return &RunLocker{
+		dir: dir,
+		ttl: ttl,
+		info: LockInfo{
+			Owner: Operator() + "@" + hostname + " (pid " + strconv.Itoa(os.Getpid()) + ")",
+			RunId: hex.EncodeToString(runId),
+		},
+	}
+}
+
+// WithLeaderLock also locks each worker group on the leader at baseApiUrl
+func (r *RunLocker) WithLeaderLock(baseApiUrl string, token string) *RunLocker {
+	r.leaderUrl, r.leaderToken = baseApiUrl, token
+	return r
+}
+
+// Acquire locks every worker group, or none of them: if any group is already locked the locks taken so far are released
+func (r *RunLocker) Acquire(env string, workerGroups []string) error {
+	r.mu.Lock()
+	r.info.Acquired = time.Now().UTC()
+	r.info.Expires = r.info.Acquired.Add(r.ttl)
+	acquireErr := r.acquire(env, workerGroups)
+	r.mu.Unlock()
+
+	if acquireErr != nil {
+		r.Release()
+		return acquireErr
+	}
+	r.startHeartbeat()
+	return nil
+}
+
+func (r *RunLocker) acquire(env string, workerGroups []string) error {
+	if mkdirErr := os.MkdirAll(filepath.Join(r.dir, env), 0700); mkdirErr != nil {
+		return fmt.Errorf("unable to create lock directory %s: %w", r.dir, mkdirErr)
+	}
+	for _, workerGroup := range workerGroups {
+		if lockErr := r.lockLocal(env, workerGroup); lockErr != nil {
+			return lockErr
+		}
+		r.held = append(r.held, heldLock{env: env, workerGroup: workerGroup})
+		if r.leaderUrl == "" {
+			continue
+		}
+		if lockErr := r.lockLeader(workerGroup); lockErr != nil {
+			return lockErr
+		}
+		r.held = append(r.held, heldLock{env: env, workerGroup: workerGroup, leader: true})
+	}
+	return nil
+}
+
+// Refresh pushes the expiry of every held lock out to a full TTL from now. It fails for locks that were taken over or
+// force-unlocked since they were acquired.
+func (r *RunLocker) Refresh() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.info.Expires = time.Now().UTC().Add(r.ttl)
+	var refreshErrs []error
+	for _, lock := range r.held {
+		var refreshErr error
+		if lock.leader {
+			refreshErr = r.refreshLeader(lock.workerGroup)
+		} else {
+			refreshErr = r.refreshLocal(lock.env, lock.workerGroup)
+		}
+		if refreshErr != nil {
+			refreshErrs = append(refreshErrs, refreshErr)
+		}
+	}
+	return errors.Join(refreshErrs...)
+}
+
+func (r *RunLocker) startHeartbeat() {
+	if r.ttl/3 <= 0 {
+		return
+	}
+	r.stopHeartbeat, r.heartbeatDone = make(chan struct{}), make(chan struct{})
+	go func(stop chan struct{}, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(r.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if refreshErr := r.Refresh(); refreshErr != nil {
+					log.Printf("WARNING: unable to renew locks, another run may change the same worker groups: %v", refreshErr)
+				}
+			}
+		}
+	}(r.stopHeartbeat, r.heartbeatDone)
+}
+
+// Release removes every lock this run holds, newest first. Locks taken over by another run after expiring are left
+// alone. Leader locks are released even once the run context was cancelled, e.g. by -runTimeout.
+func (r *RunLocker) Release() []error {
+	if r.stopHeartbeat != nil {
+		close(r.stopHeartbeat)
+		<-r.heartbeatDone
+		r.stopHeartbeat, r.heartbeatDone = nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var releaseErrs []error
+	for i := len(r.held) - 1; i >= 0; i-- {
+		lock := r.held[i]
+		var releaseErr error
+		if lock.leader {
+			releaseErr = r.unlockLeader(lock.workerGroup)
+		} else {
+			releaseErr = r.unlockLocal(lock.env, lock.workerGroup)
+		}
+		if releaseErr != nil {
+			releaseErrs = append(releaseErrs, releaseErr)
+		}
+	}
+	r.held = nil
+	return releaseErrs
+}
+
+// lockFilePath is the lock file of a worker group, in a directory per env so no env and group names can collide
+func lockFilePath(dir string, env string, workerGroup string) string {
+	return filepath.Join(dir, env, workerGroup+".lock")
+}
+
+func readLockFile(lockPath string) (LockInfo, error) {
+	var info LockInfo
+	content, readErr := os.ReadFile(lockPath)
+	if readErr != nil {
+		return info, readErr
+	}
+	if unMarshErr := json.Unmarshal(content, &info); unMarshErr != nil {
+		return info, fmt.Errorf("unable to parse lock file %s: %w", lockPath, unMarshErr)
+	}
+	return info, nil
+}
+
+func (r *RunLocker) lockLocal(env string, workerGroup string) error {
+	lockPath := lockFilePath(r.dir, env, workerGroup)
+	infoJson, _ := json.MarshalIndent(r.info, "", "  ")
+
+	// Two attempts: the second one after removing a stale lock
+	for attempt := 0; attempt < 2; attempt++ {
+		lockFile, createErr := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if createErr == nil {
+			_, writeErr := lockFile.Write(infoJson)
+			closeErr := lockFile.Close()
+			if writeErr != nil || closeErr != nil {
+				os.Remove(lockPath)
+				return fmt.Errorf("unable to write lock file %s: %w", lockPath, errors.Join(writeErr, closeErr))
+			}
+			return nil
+		}
+		if !errors.Is(createErr, fs.ErrExist) {
+			return fmt.Errorf("unable to create lock file %s: %w", lockPath, createErr)
+		}
+
+		existing, readErr := readLockFile(lockPath)
+		if readErr != nil {
+			return fmt.Errorf("worker group %s (%s) is locked by %s, which can't be read: %w", workerGroup, env, lockPath, readErr)
+		}
+		if time.Now().Before(existing.Expires) {
+			return fmt.Errorf("worker group %s (%s) is locked by %s. Wait for that run or use force-unlock", workerGroup, env, existing)
+		}
+		// Another run may take over the same stale lock at the same time, only the stale lock itself is removed
+		if _, removeErr := removeLockFile(lockPath, existing.RunId, r.info.RunId); removeErr != nil {
+			return removeErr
+		}
+	}
+	return fmt.Errorf("worker group %s (%s) was locked by another run while taking over its stale lock", workerGroup, env)
+}
+
+func (r *RunLocker) unlockLocal(env string, workerGroup string) error {
+	_, removeErr := removeLockFile(lockFilePath(r.dir, env, workerGroup), r.info.RunId, r.info.RunId)
+	return removeErr
+}
+
+// removeLockFile removes the lock at lockPath if it is held by runId, reporting whether it did. The lock is renamed to
+// a name only ownRunId uses before it is checked, so a lock another run created in the meantime is put back instead
+// of being removed by mistake.
+func removeLockFile(lockPath string, runId string, ownRunId string) (bool, error) {
+	tombstone := lockPath + "." + ownRunId + ".removing"
+	if renameErr := os.Rename(lockPath, tombstone); renameErr != nil {
+		if errors.Is(renameErr, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to remove lock file %s: %w", lockPath, renameErr)
+	}
+	renamed, readErr := readLockFile(tombstone)
+	if readErr == nil && renamed.RunId == runId {
+		if removeErr := os.Remove(tombstone); removeErr != nil {
+			return true, fmt.Errorf("unable to remove lock file %s: %w", tombstone, removeErr)
+		}
+		return true, nil
+	}
+
+	// Linking rather than renaming back fails instead of overwriting a lock yet another run took since
+	defer os.Remove(tombstone)
+	if linkErr := os.Link(tombstone, lockPath); linkErr != nil {
+		return false, fmt.Errorf("lock file %s changed hands while it was being removed and couldn't be put back, the run holding it may have lost it: %w", lockPath, linkErr)
+	}
+	return false, nil
+}
+
+// refreshLocal rewrites a held lock file with the current expiry. The file is given a second name first and rewritten
+// through that name, so the lock never disappears while it is renewed, and a lock that is force-unlocked in the
+// meantime is not brought back: only the removed file gets the new expiry.
+func (r *RunLocker) refreshLocal(env string, workerGroup string) error {
+	lockPath := lockFilePath(r.dir, env, workerGroup)
+	heldPath := lockPath + "." + r.info.RunId + ".renewing"
+	os.Remove(heldPath)
+	if linkErr := os.Link(lockPath, heldPath); linkErr != nil {
+		if errors.Is(linkErr, fs.ErrNotExist) {
+			return fmt.Errorf("lock of worker group %s (%s) was removed", workerGroup, env)
+		}
+		return fmt.Errorf("unable to renew lock of worker group %s (%s): %w", workerGroup, env, linkErr)
+	}
+	defer os.Remove(heldPath)
+
+	existing, readErr := readLockFile(heldPath)
+	if readErr != nil {
+		return fmt.Errorf("unable to renew lock of worker group %s (%s): %w", workerGroup, env, readErr)
+	}
+	if existing.RunId != r.info.RunId {
+		return fmt.Errorf("lock of worker group %s (%s) is now held by %s", workerGroup, env, existing)
+	}
+	heldInfo, statErr := os.Stat(heldPath)
+	if statErr != nil {
+		return fmt.Errorf("unable to renew lock of worker group %s (%s): %w", workerGroup, env, statErr)
+	}
+
+	infoJson, _ := json.MarshalIndent(r.info, "", "  ")
+	if writeErr := os.WriteFile(heldPath, infoJson, 0600); writeErr != nil {
+		return fmt.Errorf("unable to renew lock of worker group %s (%s): %w", workerGroup, env, writeErr)
+	}
+	if current, currentErr := os.Stat(lockPath); currentErr != nil || !os.SameFile(current, heldInfo) {
+		return fmt.Errorf("lock of worker group %s (%s) was removed while it was being renewed", workerGroup, env)
+	}
+	return nil
+}
+
+// leaderLock reads the marker variable on a worker group, returning false if there is none. prepare is applied to the
+// request, see getDataObj.
+func leaderLock(baseApiUrl string, workerGroup string, token string, prepare func(*http.Request) *http.Request) (LockInfo, bool, error) {
+	var info LockInfo
+	markerBytes, getErr := getDataObj(baseApiUrl, workerGroup, token, LeaderLockVarId, "globalvariable", prepare)
+	if errors.Is(getErr, ErrObjNotFound) {
+		return info, false, nil
+	}
+	if getErr != nil {
+		return info, false, getErr
+	}
+
+	var marker GlobalVariable
+	if unMarshErr := json.Unmarshal(markerBytes, &marker); unMarshErr != nil {
+		return info, true, fmt.Errorf("unable to read lock variable %s: %w", LeaderLockVarId, unMarshErr)
+	}
+	if unMarshErr := json.Unmarshal([]byte(marker.Description), &info); unMarshErr != nil {
+		return info, true, fmt.Errorf("lock variable %s on worker group %s wasn't created by this tool: %w", LeaderLockVarId, workerGroup, unMarshErr)
+	}
+	return info, true, nil
+}
+
+func (r *RunLocker) lockLeader(workerGroup string) error {
+	existing, locked, readErr := leaderLock(r.leaderUrl, workerGroup, r.leaderToken, nil)
+	if readErr != nil {
+		return fmt.Errorf("unable to check the leader lock of worker group %s: %w", workerGroup, readErr)
+	}
+	// Stale leader locks aren't taken over: without a compare-and-swap on the leader, two runs taking over the same
+	// stale marker could each delete the other's new one and both go ahead
+	if locked && time.Now().Before(existing.Expires) {
+		return fmt.Errorf("worker group %s is locked on the leader by %s. Wait for that run or use force-unlock -leader", workerGroup, existing)
+	}
+	if locked {
+		return fmt.Errorf("worker group %s has a stale leader lock from %s, the run that took it likely died. Check no run is still changing it, then use force-unlock -leader", workerGroup, existing)
+	}
+
+	// Creating fails if another run created the marker since we checked, so only one run can win
+	if createErr := CreateDataObj(r.leaderUrl, workerGroup, r.leaderToken, LeaderLockVarId, r.marker(), "globalvariable"); createErr != nil {
+		return fmt.Errorf("unable to take the leader lock of worker group %s: %w", workerGroup, createErr)
+	}
+	return nil
+}
+
+// marker is the body of the lock variable, the LockInfo is kept in its description
+func (r *RunLocker) marker() []byte {
+	infoJson, _ := json.Marshal(r.info)
+	marker, _ := json.Marshal(GlobalVariable{
+		Id:          LeaderLockVarId,
+		Type:        "string",
+		Value:       "'locked by " + r.info.Owner + "'",
+		Description: string(infoJson),
+		Tags:        "criblPatching",
+	})
+	return marker
+}
+
+func (r *RunLocker) refreshLeader(workerGroup string) error {
+	existing, locked, readErr := leaderLock(r.leaderUrl, workerGroup, r.leaderToken, nil)
+	if readErr != nil {
+		return fmt.Errorf("unable to renew the leader lock of worker group %s: %w", workerGroup, readErr)
+	}
+	if !locked {
+		return fmt.Errorf("leader lock of worker group %s was removed", workerGroup)
+	}
+	if existing.RunId != r.info.RunId {
+		return fmt.Errorf("leader lock of worker group %s is now held by %s", workerGroup, existing)
+	}
+	if updateErr := UpdateDataObj(r.leaderUrl, workerGroup, r.leaderToken, LeaderLockVarId, r.marker(), "globalvariable"); updateErr != nil {
+		return fmt.Errorf("unable to renew the leader lock of worker group %s: %w", workerGroup, updateErr)
+	}
+	return nil
+}
+
+func (r *RunLocker) unlockLeader(workerGroup string) error {
+	existing, locked, readErr := leaderLock(r.leaderUrl, workerGroup, r.leaderToken, detachFromRun)
+	if readErr != nil {
+		return fmt.Errorf("unable to check the leader lock of worker group %s: %w", workerGroup, readErr)
+	}
+	if !locked || existing.RunId != r.info.RunId {
+		return nil
+	}
+	return deleteDataObj(r.leaderUrl, workerGroup, r.leaderToken, LeaderLockVarId, "globalvariable", detachFromRun)
+}
+
+// ForceUnlockLocal removes a local lock whoever holds it, returning who did. false means there was no lock.
+func ForceUnlockLocal(dir string, env string, workerGroup string) (LockInfo, bool, error) {
+	lockPath := lockFilePath(dir, env, workerGroup)
+	existing, readErr := readLockFile(lockPath)
+	if errors.Is(readErr, fs.ErrNotExist) {
+		return existing, false, nil
+	}
+	if removeErr := os.Remove(lockPath); removeErr != nil {
+		return existing, true, fmt.Errorf("unable to remove lock file %s: %w", lockPath, removeErr)
+	}
+	return existing, true, nil
+}
+
+// ForceUnlockLeader removes a worker group's leader lock whoever holds it, returning who did. false means there was no lock.
+func ForceUnlockLeader(baseApiUrl string, workerGroup string, token string) (LockInfo, bool, error) {
+	existing, locked, readErr := leaderLock(baseApiUrl, workerGroup, token, nil)
+	if !locked {
+		return existing, false, readErr
+	}
+	// A marker that can't be parsed is still removed, that is what forcing is for
+	if deleteErr := DeleteDataObj(baseApiUrl, workerGroup, token, LeaderLockVarId, "globalvariable"); deleteErr != nil {
+		return existing, true, deleteErr
+	}
+	return existing, true, nil
+}
@@ -0,0 +1,195 @@
+package functions
+
+import (
+	"context"
+	"criblPatching/fakeleader"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLockerContention(t *testing.T) {
+	dir := t.TempDir()
+	first, second := NewRunLocker(dir, time.Hour), NewRunLocker(dir, time.Hour)
+
+	if err := first.Acquire("prod", []string{"wg1", "wg2"}); err != nil {
+		t.Fatalf("unable to acquire: %v", err)
+	}
+	if err := second.Acquire("prod", []string{"wg3", "wg2"}); err == nil || !strings.Contains(err.Error(), "is locked by") {
+		t.Errorf("expected wg2 to be locked, got %v", err)
+	}
+	if _, err := os.Stat(lockFilePath(dir, "prod", "wg3")); !os.IsNotExist(err) {
+		t.Error("expected the lock taken on wg3 to be released when wg2 couldn't be locked")
+	}
+	if err := second.Acquire("uat", []string{"wg2"}); err != nil {
+		t.Errorf("expected the same group in another env to be free, got %v", err)
+	}
+	second.Release()
+	// Names joined with a separator would give both of these the same lock file
+	if err := second.Acquire("prod_wg1", []string{"x"}); err != nil {
+		t.Errorf("expected env and group names not to collide, got %v", err)
+	}
+	second.Release()
+	if err := second.Acquire("prod", []string{"wg1_x"}); err != nil {
+		t.Errorf("expected env and group names not to collide, got %v", err)
+	}
+	second.Release()
+
+	if errs := first.Release(); len(errs) != 0 {
+		t.Errorf("unable to release: %v", errs)
+	}
+	if err := second.Acquire("prod", []string{"wg1", "wg2"}); err != nil {
+		t.Errorf("expected released locks to be free, got %v", err)
+	}
+	second.Release()
+}
+
+func TestRunLockerTakesOverExpiredLock(t *testing.T) {
+	dir := t.TempDir()
+	expired, second := NewRunLocker(dir, time.Nanosecond), NewRunLocker(dir, time.Hour)
+	if err := expired.Acquire("prod", []string{"wg1"}); err != nil {
+		t.Fatalf("unable to acquire: %v", err)
+	}
+
+	if err := second.Acquire("prod", []string{"wg1"}); err != nil {
+		t.Fatalf("expected the expired lock to be taken over, got %v", err)
+	}
+	expired.Release()
+	if holder, err := readLockFile(lockFilePath(dir, "prod", "wg1")); err != nil || holder.RunId != second.info.RunId {
+		t.Errorf("expected releasing the expired lock to leave the new holder's lock alone, got %+v %v", holder, err)
+	}
+	if err := expired.Refresh(); err != nil {
+		t.Errorf("expected a released locker to have nothing to renew, got %v", err)
+	}
+	second.Release()
+}
+
+func TestRemoveLockFilePutsBackAnotherRunsLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "prod_wg1.lock")
+	// The stale lock was taken over by another run between reading it and removing it
+	os.WriteFile(lockPath, []byte(`{"runId": "fresh"}`), 0600)
+
+	removed, err := removeLockFile(lockPath, "stale", "mine")
+	if removed || err != nil {
+		t.Fatalf("expected the fresh lock not to be removed, got %v %v", removed, err)
+	}
+	if holder, err := readLockFile(lockPath); err != nil || holder.RunId != "fresh" {
+		t.Errorf("expected the fresh lock to be put back, got %+v %v", holder, err)
+	}
+	if leftovers, _ := filepath.Glob(lockPath + ".*"); len(leftovers) != 0 {
+		t.Errorf("expected no leftover files, got %v", leftovers)
+	}
+	if removed, err := removeLockFile(lockPath, "fresh", "mine"); !removed || err != nil {
+		t.Errorf("expected the lock to be removed by its run id, got %v %v", removed, err)
+	}
+}
+
+func TestRunLockerHeartbeatRenewsLocks(t *testing.T) {
+	dir := t.TempDir()
+	first, second := NewRunLocker(dir, 300*time.Millisecond), NewRunLocker(dir, time.Hour)
+	if err := first.Acquire("prod", []string{"wg1"}); err != nil {
+		t.Fatalf("unable to acquire: %v", err)
+	}
+	defer first.Release()
+
+	time.Sleep(time.Second)
+	if err := second.Acquire("prod", []string{"wg1"}); err == nil {
+		second.Release()
+		t.Fatal("expected the lock to still be held after its TTL while the run is going")
+	}
+}
+
+func TestRunLockerRefreshDoesNotBringBackRemovedLocks(t *testing.T) {
+	dir := t.TempDir()
+	first, second := NewRunLocker(dir, time.Hour), NewRunLocker(dir, time.Hour)
+	if err := first.Acquire("prod", []string{"wg1", "wg2"}); err != nil {
+		t.Fatalf("unable to acquire: %v", err)
+	}
+	defer first.Release()
+
+	ForceUnlockLocal(dir, "prod", "wg1")
+	if err := first.Refresh(); err == nil {
+		t.Error("expected renewing a force-unlocked lock to fail")
+	}
+	if _, err := os.Stat(lockFilePath(dir, "prod", "wg1")); !os.IsNotExist(err) {
+		t.Error("renewing brought back the force-unlocked lock")
+	}
+	if holder, err := readLockFile(lockFilePath(dir, "prod", "wg2")); err != nil || holder.RunId != first.info.RunId {
+		t.Errorf("expected the lock still held to be renewed, got %+v %v", holder, err)
+	}
+
+	if err := second.Acquire("prod", []string{"wg1"}); err != nil {
+		t.Fatalf("expected the force-unlocked group to be free, got %v", err)
+	}
+	defer second.Release()
+	if err := first.Refresh(); err == nil {
+		t.Error("expected renewing a lock another run holds to fail")
+	}
+	if holder, err := readLockFile(lockFilePath(dir, "prod", "wg1")); err != nil || holder.RunId != second.info.RunId {
+		t.Errorf("expected the other run's lock to be left in place, got %+v %v", holder, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "prod", "*.renewing")); len(leftovers) != 0 {
+		t.Errorf("expected no leftover files, got %v", leftovers)
+	}
+}
+
+func TestRunLockerLeaderLocks(t *testing.T) {
+	leader := fakeleader.New("admin", "secret", "wg1", "wg2")
+	defer leader.Close()
+	token, err := TokenApiCall(leader.URL, "admin", "secret")
+	if err != nil {
+		t.Fatalf("unable to login: %v", err)
+	}
+
+	// Separate lock directories stand in for operators on different machines
+	first := NewRunLocker(t.TempDir(), time.Hour).WithLeaderLock(leader.URL, token)
+	second := NewRunLocker(t.TempDir(), time.Hour).WithLeaderLock(leader.URL, token)
+	if err := first.Acquire("prod", []string{"wg1"}); err != nil {
+		t.Fatalf("unable to acquire: %v", err)
+	}
+	if err := second.Acquire("prod", []string{"wg1"}); err == nil || !strings.Contains(err.Error(), "locked on the leader") {
+		t.Errorf("expected wg1 to be locked on the leader, got %v", err)
+	}
+
+	holder, locked, err := ForceUnlockLeader(leader.URL, "wg1", token)
+	if err != nil || !locked || holder.RunId != first.info.RunId {
+		t.Fatalf("expected force-unlock to remove the first run's lock, got %+v %v %v", holder, locked, err)
+	}
+	if err := second.Acquire("prod", []string{"wg1"}); err != nil {
+		t.Fatalf("expected the force-unlocked group to be free, got %v", err)
+	}
+	if err := first.Refresh(); err == nil {
+		t.Error("expected renewing a lock that was taken over to fail")
+	}
+	first.Release()
+	if _, exists := leader.Object("wg1", "lib/vars", LeaderLockVarId); !exists {
+		t.Error("releasing the force-unlocked run removed the new holder's lock")
+	}
+
+	// A run that died leaves its leader lock to expire, which another run doesn't take over by itself
+	expired := NewRunLocker(t.TempDir(), time.Nanosecond).WithLeaderLock(leader.URL, token)
+	if err := expired.Acquire("prod", []string{"wg2"}); err != nil {
+		t.Fatalf("unable to acquire: %v", err)
+	}
+	if err := second.Acquire("prod", []string{"wg2"}); err == nil || !strings.Contains(err.Error(), "force-unlock -leader") {
+		t.Errorf("expected the stale leader lock to need force-unlock, got %v", err)
+	}
+	if holder, _, _ := leaderLock(leader.URL, "wg2", token, nil); holder.RunId != expired.info.RunId {
+		t.Errorf("expected the stale leader lock to be left alone, got %+v", holder)
+	}
+	expired.Release()
+
+	// The run was cancelled, e.g. by -runTimeout, its locks are still released
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	SetRunContext(cancelled)
+	defer SetRunContext(context.Background())
+	if errs := second.Release(); len(errs) != 0 {
+		t.Errorf("unable to release after the run was cancelled: %v", errs)
+	}
+	if _, exists := leader.Object("wg1", "lib/vars", LeaderLockVarId); exists {
+		t.Error("expected the leader lock to be released")
+	}
+}
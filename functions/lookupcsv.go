@@ -0,0 +1,205 @@
+package functions
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// How many offending rows are included in a validation error
+const maxReportedCsvProblems = 5
+
+// LookupCsvRules are the optional, per lookup checks on top of the basic ones every CSV lookup gets
+// (a header row, a consistent column count and UTF-8 encoding). Example rules file:
+//
+//	{"requiredColumns": ["host", "owner"], "keyColumn": "host", "columnTypes": {"port": "integer", "ip": "ip"}}
+//
+// Column types are string, number, integer, boolean, ip or cidr. Empty values are allowed for every type.
+type LookupCsvRules struct {
+	RequiredColumns []string          `json:"requiredColumns"`
+	KeyColumn       string            `json:"keyColumn"`
+	ColumnTypes     map[string]string `json:"columnTypes"`
+}
+
+func LoadLookupCsvRules(filePath string) (*LookupCsvRules, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read lookup rules file %s: %w", filePath, readErr)
+	}
+	var rules LookupCsvRules
+	if unMarshErr := json.Unmarshal(content, &rules); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to parse lookup rules file %s: %w", filePath, unMarshErr)
+	}
+	for column, columnType := range rules.ColumnTypes {
+		if _, known := csvTypeCheckers[strings.ToLower(columnType)]; !known {
+			return nil, fmt.Errorf("lookup rules file %s has unknown type '%s' for column '%s'. Valid options are: string, number, integer, boolean, ip, or cidr", filePath, columnType, column)
+		}
+	}
+	return &rules, nil
+}
+
+var csvTypeCheckers = map[string]func(string) bool{
+	"string": func(string) bool { return true },
+	"number": func(v string) bool {
+		_, err := strconv.ParseFloat(v, 64)
+		return err == nil
+	},
+	"integer": func(v string) bool {
+		_, err := strconv.ParseInt(v, 10, 64)
+		return err == nil
+	},
+	"boolean": func(v string) bool {
+		_, err := strconv.ParseBool(v)
+		return err == nil
+	},
+	"ip": func(v string) bool { return net.ParseIP(v) != nil },
+	"cidr": func(v string) bool {
+		_, _, err := net.ParseCIDR(v)
+		return err == nil
+	},
+}
+
+// ValidateLookupCsvFile checks a CSV (or gzipped CSV) lookup staged on disk. Binary lookups are not checked.
+func ValidateLookupCsvFile(lookupId string, filePath string, rules *LookupCsvRules) error {
+	if !isCsvLookup(lookupId) {
+		return nil
+	}
+
+	lookupFile, openErr := os.Open(filePath)
+	if openErr != nil {
+		return fmt.Errorf("unable to open lookup file %s for validation: %w", filePath, openErr)
+	}
+	defer lookupFile.Close()
+
+	return validateLookupCsvStream(lookupId, bufio.NewReader(lookupFile), rules)
+}
+
+func isCsvLookup(lookupId string) bool {
+	format := LookupFormat(lookupId)
+	return format == "csv" || format == "csv.gz"
+}
+
+func validateLookupCsvStream(lookupId string, content io.Reader, rules *LookupCsvRules) error {
+	if LookupFormat(lookupId) == "csv.gz" {
+		gzReader, gzErr := gzip.NewReader(content)
+		if gzErr != nil {
+			return fmt.Errorf("lookup %s has an invalid gzip header: %w", lookupId, gzErr)
+		}
+		defer gzReader.Close()
+		content = gzReader
+	}
+	return ValidateLookupCsv(lookupId, content, rules)
+}
+
+// ValidateLookupCsv reads the whole CSV and returns an error listing the first offending rows, if any.
+// rules may be nil for the basic checks only.
+func ValidateLookupCsv(lookupId string, content io.Reader, rules *LookupCsvRules) error {
+	if rules == nil {
+		rules = &LookupCsvRules{}
+	}
+
+	csvReader := csv.NewReader(content)
+	csvReader.FieldsPerRecord = -1
+	csvReader.ReuseRecord = true
+
+	header, headerErr := csvReader.Read()
+	if errors.Is(headerErr, io.EOF) {
+		return fmt.Errorf("lookup %s is empty, a header row is required", lookupId)
+	}
+	if headerErr != nil {
+		return fmt.Errorf("lookup %s has an unreadable header row: %w", lookupId, headerErr)
+	}
+	header = slices.Clone(header)
+	header[0] = strings.TrimPrefix(header[0], "\uFEFF")
+
+	var problems []string
+	addProblem := func(row int, reason string, record []string) {
+		problems = append(problems, fmt.Sprintf("row %d: %s: %s", row, reason, strings.Join(record, ",")))
+	}
+
+	columnIndex := map[string]int{}
+	for i, column := range header {
+		if !utf8.ValidString(column) {
+			addProblem(1, "header is not valid UTF-8", header)
+		}
+		if strings.TrimSpace(column) == "" {
+			addProblem(1, fmt.Sprintf("header column %d is empty", i+1), header)
+		}
+		if _, duplicate := columnIndex[column]; duplicate {
+			addProblem(1, fmt.Sprintf("header column '%s' is repeated", column), header)
+		}
+		columnIndex[column] = i
+	}
+
+	for _, required := range rules.RequiredColumns {
+		if _, found := columnIndex[required]; !found {
+			addProblem(1, fmt.Sprintf("required column '%s' is missing", required), header)
+		}
+	}
+	keyIndex := -1
+	if rules.KeyColumn != "" {
+		index, found := columnIndex[rules.KeyColumn]
+		if !found {
+			addProblem(1, fmt.Sprintf("key column '%s' is missing", rules.KeyColumn), header)
+		} else {
+			keyIndex = index
+		}
+	}
+	typeChecks := map[int]func(string) bool{}
+	for column, columnType := range rules.ColumnTypes {
+		if index, found := columnIndex[column]; found {
+			typeChecks[index] = csvTypeCheckers[strings.ToLower(columnType)]
+		}
+	}
+
+	seenKeys := map[string]int{}
+	for {
+		record, readErr := csvReader.Read()
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			// A parse error (e.g. unbalanced quotes) means the rest of the file can't be trusted
+			problems = append(problems, fmt.Sprintf("unreadable CSV: %v", readErr))
+			break
+		}
+		row, _ := csvReader.FieldPos(0)
+
+		if len(record) != len(header) {
+			addProblem(row, fmt.Sprintf("has %d column(s), header has %d", len(record), len(header)), record)
+			continue
+		}
+		for i, field := range record {
+			if !utf8.ValidString(field) {
+				addProblem(row, fmt.Sprintf("column '%s' is not valid UTF-8", header[i]), record)
+			}
+			if check, hasType := typeChecks[i]; hasType && field != "" && !check(field) {
+				addProblem(row, fmt.Sprintf("column '%s' value '%s' is not of type %s", header[i], field, rules.ColumnTypes[header[i]]), record)
+			}
+		}
+		if keyIndex >= 0 {
+			key := record[keyIndex]
+			if firstRow, duplicate := seenKeys[key]; duplicate {
+				addProblem(row, fmt.Sprintf("duplicate key '%s' in column '%s' (first seen on row %d)", key, rules.KeyColumn, firstRow), record)
+			} else {
+				seenKeys[key] = row
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	reported := problems[:min(len(problems), maxReportedCsvProblems)]
+	return fmt.Errorf("lookup %s failed CSV validation with %d problem(s), first %d:\n  %s", lookupId, len(problems), len(reported), strings.Join(reported, "\n  "))
+}
@@ -0,0 +1,80 @@
+package functions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateLookupCsv(t *testing.T) {
+	rules := &LookupCsvRules{
+		RequiredColumns: []string{"host", "owner"},
+		KeyColumn:       "host",
+		ColumnTypes:     map[string]string{"port": "integer", "ip": "ip"},
+	}
+	tests := []struct {
+		name    string
+		content string
+		rules   *LookupCsvRules
+		wantErr string
+	}{
+		{name: "basic", content: "host,owner\nweb01,ops\n"},
+		{name: "bom and quoted fields", content: "\uFEFFhost,owner\n\"web01, eu\",\"ops \"\"core\"\"\"\n", rules: rules},
+		{name: "empty values pass type checks", content: "host,owner,port,ip\nweb01,ops,,\n", rules: rules},
+		{name: "typed columns", content: "host,owner,port,ip\nweb01,ops,443,10.0.0.1\n", rules: rules},
+		{name: "empty file", content: "", wantErr: "is empty"},
+		{name: "empty header column", content: "host,,owner\na,b,c\n", wantErr: "header column 2 is empty"},
+		{name: "repeated header column", content: "host,host\na,b\n", wantErr: "header column 'host' is repeated"},
+		{name: "ragged row", content: "host,owner\nweb01\n", wantErr: "row 2: has 1 column(s), header has 2"},
+		{name: "invalid utf-8", content: "host,owner\nweb01,\xff\n", wantErr: "column 'owner' is not valid UTF-8"},
+		{name: "unbalanced quotes", content: "host,owner\n\"web01,ops\n", wantErr: "unreadable CSV"},
+		{name: "missing required column", content: "host\nweb01\n", rules: rules, wantErr: "required column 'owner' is missing"},
+		{name: "duplicate key", content: "host,owner\nweb01,a\nweb02,b\nweb01,c\n", rules: rules, wantErr: "duplicate key 'web01' in column 'host' (first seen on row 2)"},
+		{name: "wrong type", content: "host,owner,port\nweb01,ops,https\n", rules: rules, wantErr: "column 'port' value 'https' is not of type integer"},
+	}
+	for _, test := range tests {
+		err := ValidateLookupCsv("test.csv", strings.NewReader(test.content), test.rules)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.wantErr, err)
+		}
+	}
+}
+
+func TestValidateLookupCsvLimitsReportedProblems(t *testing.T) {
+	content := "host,owner\n" + strings.Repeat("ragged\n", 20)
+	err := ValidateLookupCsv("test.csv", strings.NewReader(content), nil)
+	if err == nil || !strings.Contains(err.Error(), "20 problem(s), first 5") {
+		t.Errorf("expected 20 problems with the first 5 reported, got %v", err)
+	}
+}
+
+func TestValidateLookupCsvFile(t *testing.T) {
+	dir := t.TempDir()
+	var gzContent bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzContent)
+	gzWriter.Write([]byte("host,owner\nweb01\n"))
+	gzWriter.Close()
+	os.WriteFile(filepath.Join(dir, "hosts.csv.gz"), gzContent.Bytes(), 0600)
+	os.WriteFile(filepath.Join(dir, "geo.mmdb"), []byte("not,a\ncsv"), 0600)
+
+	if err := ValidateLookupCsvFile("hosts.csv.gz", filepath.Join(dir, "hosts.csv.gz"), nil); err == nil || !strings.Contains(err.Error(), "header has 2") {
+		t.Errorf("expected the gzipped CSV to be decompressed and checked, got %v", err)
+	}
+	if err := ValidateLookupCsvFile("geo.mmdb", filepath.Join(dir, "geo.mmdb"), nil); err != nil {
+		t.Errorf("expected binary lookups to be skipped, got %v", err)
+	}
+}
+
+func TestLoadLookupCsvRulesRejectsUnknownType(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(rulesFile, []byte(`{"columnTypes": {"port": "int"}}`), 0600)
+	if _, err := LoadLookupCsvRules(rulesFile); err == nil {
+		t.Error("expected an unknown column type to be rejected")
+	}
+}
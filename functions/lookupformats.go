@@ -0,0 +1,129 @@
+package functions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// MaxMind DB files end with a metadata section that starts with this marker.
+// The spec places it within the last 128KiB of the file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const mmdbMetadataMaxSize = 128 * 1024
+
+// IsSupportedLookup reports whether the lookup id has a file extension we know how to replicate
+func IsSupportedLookup(lookupId string) bool {
+	return LookupFormat(lookupId) != ""
+}
+
+// LookupFormat returns the lookup format based on the file extension: csv, csv.gz, mmdb, or "" if unsupported
+func LookupFormat(lookupId string) string {
+	lowerId := strings.ToLower(lookupId)
+	switch {
+	case strings.HasSuffix(lowerId, ".csv.gz"):
+		return "csv.gz"
+	case strings.HasSuffix(lowerId, ".csv"):
+		return "csv"
+	case strings.HasSuffix(lowerId, ".mmdb"):
+		return "mmdb"
+	default:
+		return ""
+	}
+}
+
+// LookupContentType returns the content type to use when uploading the lookup file
+func LookupContentType(lookupId string) string {
+	switch LookupFormat(lookupId) {
+	case "csv.gz":
+		return "application/gzip"
+	case "mmdb":
+		return "application/octet-stream"
+	default:
+		return "text/csv"
+	}
+}
+
+// LookupContentHash returns the sha256 of a lookup file's content. A gzip lookup is hashed decompressed, so the same
+// CSV compressed by different tools or at a different level hashes the same.
+func LookupContentHash(lookupId string, filePath string) (string, error) {
+	if LookupFormat(lookupId) != "csv.gz" {
+		return FileHash(filePath)
+	}
+	lookupFile, openErr := os.Open(filePath)
+	if openErr != nil {
+		return "", fmt.Errorf("unable to open %s to hash: %w", filePath, openErr)
+	}
+	defer lookupFile.Close()
+
+	gzReader, gzErr := gzip.NewReader(lookupFile)
+	if gzErr != nil {
+		return "", fmt.Errorf("lookup %s has an invalid gzip header: %w", lookupId, gzErr)
+	}
+	defer gzReader.Close()
+	hasher := sha256.New()
+	if _, copyErr := io.Copy(hasher, gzReader); copyErr != nil {
+		return "", fmt.Errorf("unable to decompress lookup %s to hash: %w", lookupId, copyErr)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ValidateLookupFile checks that a lookup staged on disk looks like what its extension says before it is sent anywhere,
+// without reading the whole file into memory
+func ValidateLookupFile(lookupId string, filePath string) error {
+	lookupFile, openErr := os.Open(filePath)
+	if openErr != nil {
+		return fmt.Errorf("unable to open lookup file %s for validation: %w", filePath, openErr)
+	}
+	defer lookupFile.Close()
+
+	fileInfo, statErr := lookupFile.Stat()
+	if statErr != nil {
+		return fmt.Errorf("unable to stat lookup file %s for validation: %w", filePath, statErr)
+	}
+
+	return validateLookup(lookupId, lookupFile, fileInfo.Size())
+}
+
+func validateLookup(lookupId string, content io.ReaderAt, size int64) error {
+	magic := make([]byte, 2)
+	magicLen, _ := content.ReadAt(magic, 0)
+	isGzip := magicLen == 2 && magic[0] == 0x1f && magic[1] == 0x8b
+
+	switch LookupFormat(lookupId) {
+	case "csv.gz":
+		if !isGzip {
+			return fmt.Errorf("lookup %s does not start with gzip magic bytes", lookupId)
+		}
+		gzReader, gzErr := gzip.NewReader(io.NewSectionReader(content, 0, size))
+		if gzErr != nil {
+			return fmt.Errorf("lookup %s has an invalid gzip header: %w", lookupId, gzErr)
+		}
+		defer gzReader.Close()
+		// Reading through to the end verifies the CRC and length in the gzip trailer
+		if _, copyErr := io.Copy(io.Discard, gzReader); copyErr != nil {
+			return fmt.Errorf("lookup %s failed gzip integrity check: %w", lookupId, copyErr)
+		}
+	case "mmdb":
+		searchStart := max(size-mmdbMetadataMaxSize, 0)
+		tail := make([]byte, size-searchStart)
+		if _, readErr := content.ReadAt(tail, searchStart); readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("unable to read lookup %s: %w", lookupId, readErr)
+		}
+		if !bytes.Contains(tail, mmdbMetadataMarker) {
+			return fmt.Errorf("lookup %s is missing the MaxMind DB metadata marker, file may be truncated or not an mmdb", lookupId)
+		}
+	case "csv":
+		if isGzip {
+			return fmt.Errorf("lookup %s is gzip compressed but does not end with .csv.gz", lookupId)
+		}
+	default:
+		return fmt.Errorf("lookup %s has an unsupported extension. Supported extensions are .csv, .csv.gz and .mmdb", lookupId)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package functions
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// How often (in percent of the file) upload/download progress is logged
+const progressLogStep = 10
+
+// progressReader logs how far through a transfer we are as the body is read
+type progressReader struct {
+	reader      io.Reader
+	label       string
+	total       int64
+	transferred int64
+	nextLogPct  int64
+}
+
+func newProgressReader(reader io.Reader, label string, total int64) *progressReader {
+	return &progressReader{reader: reader, label: label, total: total, nextLogPct: progressLogStep}
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.reader.Read(buf)
+	p.transferred += int64(n)
+
+	if p.total > 0 {
+		pct := p.transferred * 100 / p.total
+		if pct >= p.nextLogPct {
+			log.Printf("%s: %d%% (%s / %s)", p.label, pct, formatBytes(p.transferred), formatBytes(p.total))
+			for p.nextLogPct <= pct {
+				p.nextLogPct += progressLogStep
+			}
+		}
+	} else if err == io.EOF {
+		log.Printf("%s: done (%s)", p.label, formatBytes(p.transferred))
+	}
+
+	return n, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// DownloadLookupToFile streams the lookup content from the leader into a temp file and validates it.
+// The caller is responsible for removing the returned file once every target has been updated.
+func DownloadLookupToFile(baseApiUrl string, workerGroup string, token string, lookupId string) (string, error) {
+	rawParam := "0"
+	if LookupFormat(lookupId) != "csv" {
+		rawParam = "1"
+	}
+	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/system/lookups/" + lookupId + "/content?raw=" + rawParam
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header = http.Header{"Authorization": {token}}
+	req = asTransfer(req)
+
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp == nil || httpErr != nil {
+		return "", fmt.Errorf("lookup content for %s unable to be retrieved from url %s : %w Attempted (%d) time(s)", lookupId, url, httpErr, maxRetries)
+	}
+	defer resp.Body.Close()
+
+	// Keep the lookup extension on the temp file so it is obvious what it is if it gets left behind
+	tempFile, createErr := os.CreateTemp("", "cribl-lookup-*-"+filepath.Base(lookupId))
+	if createErr != nil {
+		return "", fmt.Errorf("unable to create temp file for lookup %s: %w", lookupId, createErr)
+	}
+
+	progress := newProgressReader(resp.Body, fmt.Sprintf("Downloading lookup '%s'", lookupId), resp.ContentLength)
+	_, copyErr := io.Copy(tempFile, progress)
+	closeErr := tempFile.Close()
+	if copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("unable to write lookup %s to temp file: %w", lookupId, copyErr)
+	}
+
+	if validateErr := ValidateLookupFile(lookupId, tempFile.Name()); validateErr != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("lookup content failed validation, not uploading: %w", validateErr)
+	}
+
+	return tempFile.Name(), nil
+}
+
+// UploadLookupFile streams a lookup staged on disk to a worker group. Each retry re-reads the file from the start,
+// so only a buffer's worth of the lookup is ever in memory. contentHash is the file's FileHash, for the audit log.
+func UploadLookupFile(baseApiUrl string, workerGroup string, token string, lookup_id string, filePath string, contentHash string) ([]byte, error) {
+	fileInfo, statErr := os.Stat(filePath)
+	if statErr != nil {
+		return nil, fmt.Errorf("unable to stat lookup file %s: %w", filePath, statErr)
+	}
+
+	progressLabel := fmt.Sprintf("Uploading lookup '%s' to worker group '%s'", lookup_id, workerGroup)
+	openBody := func() (io.ReadCloser, error) {
+		lookupFile, openErr := os.Open(filePath)
+		if openErr != nil {
+			return nil, openErr
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{newProgressReader(lookupFile, progressLabel, fileInfo.Size()), lookupFile}, nil
+	}
+
+	body, openErr := openBody()
+	if openErr != nil {
+		return nil, fmt.Errorf("unable to open lookup file %s: %w", filePath, openErr)
+	}
+
+	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/system/lookups/?filename=" + lookup_id
+	req, _ := http.NewRequest("PUT", url, body)
+	req.ContentLength = fileInfo.Size()
+	req.GetBody = openBody
+	req.Header = http.Header{"Authorization": {token}, "content-type": {LookupContentType(lookup_id)}}
+	// The caller already hashed the file, reading it again just for the audit log would double the disk reads
+	req = withPayloadHash(asTransfer(req), contentHash)
+
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+
+	if resp != nil && httpErr == nil {
+		defer resp.Body.Close()
+		return lookupPatchPayload(lookup_id, resp.Body)
+	} else {
+		return nil, fmt.Errorf("uploading lookup failed when trying url %s : %w Attempted (%d) time(s)", url, httpErr, maxRetries)
+	}
+}
@@ -0,0 +1,302 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The typed models below cover the fields the tool reasons about (validation, diffing, dependencies). Every model keeps
+// the JSON it was decoded from, so fields we don't model, and modelled fields that weren't changed, are written back
+// exactly as the leader sent them.
+
+// rawFields is embedded in each model to carry the original JSON through a decode/encode round trip
+type rawFields struct {
+	raw     map[string]json.RawMessage
+	decoded map[string]json.RawMessage
+}
+
+func (r *rawFields) decode(data []byte, known interface{}) error {
+	if err := json.Unmarshal(data, &r.raw); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, known); err != nil {
+		return err
+	}
+	decoded, err := knownFieldsJson(known)
+	r.decoded = decoded
+	return err
+}
+
+func (r rawFields) encode(known interface{}) ([]byte, error) {
+	current, err := knownFieldsJson(known)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]json.RawMessage, len(r.raw)+len(current))
+	for key, value := range r.raw {
+		out[key] = value
+	}
+	for key, value := range current {
+		if previous, wasDecoded := r.decoded[key]; wasDecoded && bytes.Equal(previous, value) {
+			// Unchanged since decode, keep the original bytes (or the original absence of the field)
+			continue
+		}
+		if r.decoded == nil && isZeroJson(value) {
+			// Built in code rather than decoded, don't invent empty fields
+			continue
+		}
+		out[key] = value
+	}
+	return json.Marshal(out)
+}
+
+// Extra returns the raw JSON of a field that isn't modelled, e.g. a destination type specific setting
+func (r rawFields) Extra(key string) (json.RawMessage, bool) {
+	value, found := r.raw[key]
+	return value, found
+}
+
+func knownFieldsJson(known interface{}) (map[string]json.RawMessage, error) {
+	knownJson, err := json.Marshal(known)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(knownJson, &fields)
+	return fields, err
+}
+
+func isZeroJson(value json.RawMessage) bool {
+	switch string(value) {
+	case `""`, "0", "false", "null", "[]", "{}":
+		return true
+	default:
+		return false
+	}
+}
+
+// PipelineFunction is one step of a pipeline
+type PipelineFunction struct {
+	Id          string     `json:"id"`
+	Filter      string     `json:"filter"`
+	Disabled    bool       `json:"disabled"`
+	Final       bool       `json:"final"`
+	Description string     `json:"description"`
+	GroupId     string     `json:"groupId"`
+	Conf        CribConfig `json:"conf"`
+	rawFields
+}
+
+type plainPipelineFunction PipelineFunction
+
+func (f *PipelineFunction) UnmarshalJSON(data []byte) error {
+	return f.rawFields.decode(data, (*plainPipelineFunction)(f))
+}
+
+func (f PipelineFunction) MarshalJSON() ([]byte, error) {
+	return f.rawFields.encode(plainPipelineFunction(f))
+}
+
+type PipelineConf struct {
+	Description string             `json:"description"`
+	Output      string             `json:"output"`
+	Functions   []PipelineFunction `json:"functions"`
+	rawFields
+}
+
+type plainPipelineConf PipelineConf
+
+func (c *PipelineConf) UnmarshalJSON(data []byte) error {
+	return c.rawFields.decode(data, (*plainPipelineConf)(c))
+}
+
+func (c PipelineConf) MarshalJSON() ([]byte, error) {
+	return c.rawFields.encode(plainPipelineConf(c))
+}
+
+type Pipeline struct {
+	Id   string       `json:"id"`
+	Conf PipelineConf `json:"conf"`
+	rawFields
+}
+
+type plainPipeline Pipeline
+
+func (p *Pipeline) UnmarshalJSON(data []byte) error {
+	return p.rawFields.decode(data, (*plainPipeline)(p))
+}
+
+func (p Pipeline) MarshalJSON() ([]byte, error) {
+	return p.rawFields.encode(plainPipeline(p))
+}
+
+func (p *Pipeline) Validate() error {
+	if p.Id == "" {
+		return fmt.Errorf("pipeline is missing an id")
+	}
+	for i, function := range p.Conf.Functions {
+		if function.Id == "" {
+			return fmt.Errorf("pipeline '%s' function %d is missing a function id", p.Id, i+1)
+		}
+	}
+	return nil
+}
+
+// Destination is an output, only the common connection fields are modelled
+type Destination struct {
+	Id       string      `json:"id"`
+	Type     string      `json:"type"`
+	Host     string      `json:"host"`
+	Port     interface{} `json:"port,omitempty"`
+	Url      string      `json:"url"`
+	Pipeline string      `json:"pipeline"`
+	Disabled bool        `json:"disabled"`
+	rawFields
+}
+
+type plainDestination Destination
+
+func (d *Destination) UnmarshalJSON(data []byte) error {
+	return d.rawFields.decode(data, (*plainDestination)(d))
+}
+
+func (d Destination) MarshalJSON() ([]byte, error) {
+	return d.rawFields.encode(plainDestination(d))
+}
+
+func (d *Destination) Validate() error {
+	if d.Id == "" {
+		return fmt.Errorf("destination is missing an id")
+	}
+	if d.Type == "" {
+		return fmt.Errorf("destination '%s' is missing a type", d.Id)
+	}
+	return validatePort("destination", d.Id, d.Port)
+}
+
+// Source is an input, only the common listener fields are modelled
+type Source struct {
+	Id       string      `json:"id"`
+	Type     string      `json:"type"`
+	Host     string      `json:"host"`
+	Port     interface{} `json:"port,omitempty"`
+	Pipeline string      `json:"pipeline"`
+	Disabled bool        `json:"disabled"`
+	rawFields
+}
+
+type plainSource Source
+
+func (s *Source) UnmarshalJSON(data []byte) error {
+	return s.rawFields.decode(data, (*plainSource)(s))
+}
+
+func (s Source) MarshalJSON() ([]byte, error) {
+	return s.rawFields.encode(plainSource(s))
+}
+
+func (s *Source) Validate() error {
+	if s.Id == "" {
+		return fmt.Errorf("source is missing an id")
+	}
+	if s.Type == "" {
+		return fmt.Errorf("source '%s' is missing a type", s.Id)
+	}
+	return validatePort("source", s.Id, s.Port)
+}
+
+// validatePort range checks ports given as a number or a numeric string. The leader also accepts an expression
+// string (e.g. a global variable reference) that it resolves itself, so other strings are left for it to check.
+func validatePort(objType string, id string, port interface{}) error {
+	var portNum float64
+	switch typed := port.(type) {
+	case nil:
+		return nil
+	case float64:
+		portNum = typed
+	case string:
+		trimmed := strings.TrimSpace(typed)
+		parsed, parseErr := strconv.ParseFloat(trimmed, 64)
+		if trimmed == "" || parseErr != nil {
+			return nil
+		}
+		portNum = parsed
+	default:
+		return fmt.Errorf("%s '%s' has an invalid port %s", objType, id, jsonString(port))
+	}
+	if portNum != math.Trunc(portNum) || portNum < 0 || portNum > 65535 {
+		return fmt.Errorf("%s '%s' has an invalid port %s", objType, id, jsonString(port))
+	}
+	return nil
+}
+
+// GlobalVariable is a /lib/vars entry. Value is usually a string holding the value or expression for Type.
+type GlobalVariable struct {
+	Id          string      `json:"id"`
+	Type        string      `json:"type"`
+	Value       interface{} `json:"value"`
+	Description string      `json:"description"`
+	Tags        string      `json:"tags"`
+	rawFields
+}
+
+type plainGlobalVariable GlobalVariable
+
+func (v *GlobalVariable) UnmarshalJSON(data []byte) error {
+	return v.rawFields.decode(data, (*plainGlobalVariable)(v))
+}
+
+func (v GlobalVariable) MarshalJSON() ([]byte, error) {
+	return v.rawFields.encode(plainGlobalVariable(v))
+}
+
+func (v *GlobalVariable) Validate() error {
+	if v.Id == "" {
+		return fmt.Errorf("global variable is missing an id")
+	}
+	if v.Type == "" {
+		return fmt.Errorf("global variable '%s' is missing a type", v.Id)
+	}
+	return validateGlobalVariableValue(v.Id, v.Type, v.Value)
+}
+
+// TypedConfig is implemented by every model
+type TypedConfig interface {
+	Validate() error
+}
+
+// ParseTypedConfig decodes an object's config into its model. Object types without a model return nil and no error.
+func ParseTypedConfig(objType string, objConfig []byte) (TypedConfig, error) {
+	var typed TypedConfig
+	switch strings.ToLower(objType) {
+	case "pipeline":
+		typed = &Pipeline{}
+	case "destination":
+		typed = &Destination{}
+	case "source":
+		typed = &Source{}
+	case "globalvariable":
+		typed = &GlobalVariable{}
+	default:
+		return nil, nil
+	}
+
+	if unMarshErr := json.Unmarshal(objConfig, typed); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to read %s config: %w", objType, unMarshErr)
+	}
+	return typed, nil
+}
+
+// ValidateTypedConfig runs the model's validation for object types that have one
+func ValidateTypedConfig(objType string, objConfig []byte) error {
+	typed, parseErr := ParseTypedConfig(objType, objConfig)
+	if parseErr != nil || typed == nil {
+		return parseErr
+	}
+	return typed.Validate()
+}
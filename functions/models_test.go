@@ -0,0 +1,92 @@
+package functions
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTypedConfigRoundTripKeepsUnknownFields(t *testing.T) {
+	tests := map[string]string{
+		"destination":    `{"id":"splunk","type":"splunk_hec","host":"hec.example.com","port":8088,"tls":{"disabled":false,"servername":"hec"},"maxPayloadSizeKB":4096,"compress":true,"extraHttpHeaders":[{"name":"x","value":"1.50"}]}`,
+		"source":         `{"id":"http","type":"http","host":"0.0.0.0","port":"10080","authTokens":[{"token":"#42:abc"}],"connections":[{"pipeline":"main","output":"splunk"}],"weirdNumber":1.50}`,
+		"pipeline":       `{"id":"main","conf":{"output":"default","asyncFuncTimeout":1000,"functions":[{"id":"eval","filter":"true","conf":{"add":[{"name":"env","value":"'prod'"}]},"unknownFlag":1e3}],"groups":{"g1":{"name":"Group"}}}}`,
+		"globalvariable": `{"id":"region","type":"string","value":"'us-east-1'","lib":"custom","tags":"a,b"}`,
+	}
+	for objType, original := range tests {
+		typed, err := ParseTypedConfig(objType, []byte(original))
+		if err != nil {
+			t.Fatalf("%s: unable to parse: %v", objType, err)
+		}
+		encoded, err := json.Marshal(typed)
+		if err != nil {
+			t.Fatalf("%s: unable to encode: %v", objType, err)
+		}
+
+		var want, got map[string]json.RawMessage
+		json.Unmarshal([]byte(original), &want)
+		json.Unmarshal(encoded, &got)
+		if len(want) != len(got) {
+			t.Errorf("%s: expected fields %v, got %s", objType, want, encoded)
+		}
+		for key, value := range want {
+			// Raw bytes, so number formatting like 1.50 and 1e3 must survive untouched
+			if string(got[key]) != string(value) {
+				t.Errorf("%s: field %s changed from %s to %s", objType, key, value, got[key])
+			}
+		}
+	}
+}
+
+func TestTypedConfigEditOnlyChangesEditedField(t *testing.T) {
+	original := `{"id":"splunk","type":"splunk_hec","host":"old","port":8088,"tls":{"disabled":false}}`
+	var destination Destination
+	if err := json.Unmarshal([]byte(original), &destination); err != nil {
+		t.Fatalf("unable to parse: %v", err)
+	}
+	destination.Host = "new"
+	encoded, _ := json.Marshal(destination)
+
+	var got, want map[string]interface{}
+	json.Unmarshal(encoded, &got)
+	json.Unmarshal([]byte(strings.Replace(original, `"old"`, `"new"`, 1)), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestValidateTypedConfigPorts(t *testing.T) {
+	tests := []struct {
+		config string
+		valid  bool
+	}{
+		{`{"id":"in","type":"tcp","port":9000}`, true},
+		{`{"id":"in","type":"tcp","port":"9000"}`, true},
+		{`{"id":"in","type":"tcp"}`, true},
+		{`{"id":"in","type":"tcp","port":""}`, true},
+		// Expressions the leader resolves itself
+		{"{\"id\":\"in\",\"type\":\"tcp\",\"port\":\"`${C.vars.tcpPort}`\"}", true},
+		{`{"id":"in","type":"tcp","port":"C.vars.tcpPort"}`, true},
+		{`{"id":"in","type":"tcp","port":70000}`, false},
+		{`{"id":"in","type":"tcp","port":"-1"}`, false},
+		{`{"id":"in","type":"tcp","port":9000.5}`, false},
+		{`{"id":"in","type":"tcp","port":true}`, false},
+		{`{"id":"in","port":9000}`, false},
+	}
+	for _, test := range tests {
+		err := ValidateTypedConfig("source", []byte(test.config))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.config, test.valid, err)
+		}
+	}
+}
+
+func TestValidateTypedConfigPipelineFunctions(t *testing.T) {
+	if err := ValidateTypedConfig("pipeline", []byte(`{"id":"main","conf":{"functions":[{"id":"eval"},{"filter":"true"}]}}`)); err == nil {
+		t.Error("expected a pipeline function without an id to fail validation")
+	}
+	if err := ValidateTypedConfig("grok", []byte(`{"anything": "goes"}`)); err != nil {
+		t.Errorf("expected object types without a model to pass, got %v", err)
+	}
+}
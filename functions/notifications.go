@@ -0,0 +1,140 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// NotificationTargetMap maps template notification target ids to the ids of the equivalent targets in the target environment
+type NotificationTargetMap map[string]string
+
+// LoadNotificationTargetMap reads the mapping for one environment from a file keyed by env, e.g.
+//
+//	{"uat": {"slack_template": "slack_uat"}, "prod": {"slack_template": "pagerduty_prod"}, "default": {"email_template": "email_ops"}}
+//
+// Entries under "default" apply to every environment unless the environment overrides them.
+func LoadNotificationTargetMap(filePath string, env string) (NotificationTargetMap, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read notification target mapping file %s: %w", filePath, readErr)
+	}
+
+	var envMaps map[string]map[string]string
+	if unMarshErr := json.Unmarshal(content, &envMaps); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to parse notification target mapping file %s: %w", filePath, unMarshErr)
+	}
+
+	targetMap := NotificationTargetMap{}
+	for templateTarget, envTarget := range envMaps["default"] {
+		targetMap[templateTarget] = envTarget
+	}
+	for mapEnv, mapping := range envMaps {
+		if !strings.EqualFold(mapEnv, env) {
+			continue
+		}
+		for templateTarget, envTarget := range mapping {
+			targetMap[templateTarget] = envTarget
+		}
+	}
+	return targetMap, nil
+}
+
+// RemapNotifications points notification definitions at the target environment's notification targets.
+// For a notification object the top level "targets" are remapped, for any other object the "notifications"
+// attached to it are. Without a mapping, notifications attached to objects are dropped as the template's targets
+// can't be assumed to exist on the target, and a notification object is left as is: CheckNotificationTargets must then
+// confirm each of its targets exists on the target worker groups under the same id.
+func RemapNotifications(objType string, objConfig []byte, targetMap NotificationTargetMap) ([]byte, error) {
+	var config CribConfig
+	if unMarshErr := json.Unmarshal(objConfig, &config); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to read %s config for notification remapping: %w", objType, unMarshErr)
+	}
+
+	if strings.ToLower(objType) == "notification" {
+		if targetMap == nil {
+			return objConfig, nil
+		}
+		if remapErr := remapNotificationTargets(config, targetMap); remapErr != nil {
+			return nil, remapErr
+		}
+	} else {
+		notifications, hasNotifications := config["notifications"].([]interface{})
+		if !hasNotifications || targetMap == nil {
+			delete(config, "notifications")
+		} else {
+			for _, notification := range notifications {
+				notificationConfig, isObj := notification.(map[string]interface{})
+				if !isObj {
+					continue
+				}
+				if remapErr := remapNotificationTargets(notificationConfig, targetMap); remapErr != nil {
+					return nil, remapErr
+				}
+			}
+		}
+	}
+
+	remapped, marshErr := json.Marshal(config)
+	if marshErr != nil {
+		return nil, fmt.Errorf("unable to format %s config after notification remapping: %w", objType, marshErr)
+	}
+	return remapped, nil
+}
+
+// CheckNotificationTargets checks that every notification target a notification object sends to exists in a worker
+// group under the same id. It is used when there is no mapping for the environment, so the template's ids are pushed.
+func CheckNotificationTargets(baseApiUrl string, workerGroup string, token string, objConfig []byte) error {
+	var config CribConfig
+	if unMarshErr := json.Unmarshal(objConfig, &config); unMarshErr != nil {
+		return fmt.Errorf("unable to read notification config to check its targets: %w", unMarshErr)
+	}
+	targets, _ := config["targets"].([]interface{})
+	if len(targets) == 0 {
+		return nil
+	}
+
+	existing, listErr := ListDataObjs(baseApiUrl, workerGroup, token, "notificationtarget")
+	if listErr != nil {
+		return fmt.Errorf("unable to list notification targets on worker group %s: %w", workerGroup, listErr)
+	}
+	var missing []string
+	for _, target := range targets {
+		if targetId, isString := target.(string); isString {
+			if _, exists := existing[targetId]; !exists {
+				missing = append(missing, targetId)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("notification '%v' sends to target(s) that don't exist on worker group %s: %s (use -notificationMap to map them to this environment's targets)", config["id"], workerGroup, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func remapNotificationTargets(notification map[string]interface{}, targetMap NotificationTargetMap) error {
+	targets, hasTargets := notification["targets"].([]interface{})
+	if !hasTargets {
+		return nil
+	}
+
+	var unmapped []string
+	for i, target := range targets {
+		targetId, isString := target.(string)
+		if !isString {
+			continue
+		}
+		envTarget, mapped := targetMap[targetId]
+		if !mapped {
+			unmapped = append(unmapped, targetId)
+			continue
+		}
+		targets[i] = envTarget
+	}
+
+	if len(unmapped) > 0 {
+		return fmt.Errorf("notification '%v' uses target(s) with no mapping for this environment: %s", notification["id"], strings.Join(unmapped, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package functions
+
+import (
+	"criblPatching/fakeleader"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadNotificationTargetMapOverridesDefaults(t *testing.T) {
+	mapFile := filepath.Join(t.TempDir(), "notifications.json")
+	os.WriteFile(mapFile, []byte(`{"default": {"slack_template": "slack_ops", "email_template": "email_ops"}, "Prod": {"slack_template": "pagerduty_prod"}}`), 0600)
+
+	targetMap, err := LoadNotificationTargetMap(mapFile, "prod")
+	if err != nil {
+		t.Fatalf("unable to load mapping: %v", err)
+	}
+	want := NotificationTargetMap{"slack_template": "pagerduty_prod", "email_template": "email_ops"}
+	if !reflect.DeepEqual(targetMap, want) {
+		t.Errorf("expected %v, got %v", want, targetMap)
+	}
+}
+
+func TestRemapNotifications(t *testing.T) {
+	targetMap := NotificationTargetMap{"slack_uat": "slack_prod"}
+	tests := []struct {
+		name      string
+		objType   string
+		config    string
+		targetMap NotificationTargetMap
+		want      string
+		wantErr   string
+	}{
+		{"notification targets mapped", "notification",
+			`{"id": "n1", "targets": ["slack_uat"]}`, targetMap,
+			`{"id": "n1", "targets": ["slack_prod"]}`, ""},
+		{"notification target with no mapping", "notification",
+			`{"id": "n1", "targets": ["slack_uat", "email_uat"]}`, targetMap,
+			"", "no mapping for this environment: email_uat"},
+		// Left for CheckNotificationTargets to confirm against the target
+		{"notification without a mapping file", "notification",
+			`{"id": "n1", "targets": ["slack_uat"]}`, nil,
+			`{"id": "n1", "targets": ["slack_uat"]}`, ""},
+		{"attached notifications mapped", "destination",
+			`{"id": "d1", "notifications": [{"id": "backpressure", "targets": ["slack_uat"]}]}`, targetMap,
+			`{"id": "d1", "notifications": [{"id": "backpressure", "targets": ["slack_prod"]}]}`, ""},
+		{"attached notifications dropped without a mapping file", "destination",
+			`{"id": "d1", "notifications": [{"id": "backpressure", "targets": ["slack_uat"]}]}`, nil,
+			`{"id": "d1"}`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remapped, err := RemapNotifications(test.objType, []byte(test.config), test.targetMap)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", test.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to remap: %v", err)
+			}
+			var got, want CribConfig
+			json.Unmarshal(remapped, &got)
+			json.Unmarshal([]byte(test.want), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %s, got %s", test.want, remapped)
+			}
+		})
+	}
+}
+
+func TestCheckNotificationTargets(t *testing.T) {
+	leader := fakeleader.New("admin", "secret", "wg1")
+	defer leader.Close()
+	leader.SetObject("wg1", "notification-targets", "slack_ops", map[string]interface{}{"id": "slack_ops", "type": "slack"})
+	token, err := TokenApiCall(leader.URL, "admin", "secret")
+	if err != nil {
+		t.Fatalf("unable to login: %v", err)
+	}
+
+	if err := CheckNotificationTargets(leader.URL, "wg1", token, []byte(`{"id": "n1", "targets": ["slack_ops"]}`)); err != nil {
+		t.Errorf("expected a target with the same id on the worker group to pass, got %v", err)
+	}
+	err = CheckNotificationTargets(leader.URL, "wg1", token, []byte(`{"id": "n1", "targets": ["slack_ops", "slack_uat"]}`))
+	if err == nil || !strings.Contains(err.Error(), "don't exist on worker group wg1: slack_uat") {
+		t.Errorf("expected the missing target to be reported, got %v", err)
+	}
+}
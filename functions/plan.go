@@ -0,0 +1,122 @@
+package functions
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+const planVersion = 1
+
+// Plan is a reviewed change that can be applied later exactly as it was approved. Each worker group records the payload
+// to send and the hash of the object it expects to find there, so a group that changed since planning is not touched.
+type Plan struct {
+	Version   int         `json:"version"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Operator  string      `json:"operator"`
+	Env       string      `json:"env"`
+	TargetUrl string      `json:"targetUrl"`
+	Action    string      `json:"action"`
+	ObjType   string      `json:"objType"`
+	ObjId     string      `json:"objId"`
+	Groups    []PlanGroup `json:"groups"`
+	// HMAC-SHA256 of the rest of the plan, keyed with the plan signing key
+	Signature string `json:"signature"`
+}
+
+type PlanGroup struct {
+	WorkerGroup string `json:"workerGroup"`
+	// ConfigHash of the object on the worker group when the plan was made, "" if it didn't exist
+	ExpectedHash string          `json:"expectedHash"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// NewPlan starts an unsigned plan for one object
+func NewPlan(env string, targetUrl string, action string, objType string, objId string) *Plan {
+	return &Plan{
+		Version:   planVersion,
+		CreatedAt: time.Now().UTC(),
+		Operator:  Operator(),
+		Env:       env,
+		TargetUrl: targetUrl,
+		Action:    action,
+		ObjType:   objType,
+		ObjId:     objId,
+	}
+}
+
+func planSignature(plan Plan, signingKey string) (string, error) {
+	plan.Signature = ""
+	planJson, marshErr := json.Marshal(plan)
+	if marshErr != nil {
+		return "", fmt.Errorf("unable to format plan for signing: %w", marshErr)
+	}
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write(planJson)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// WritePlan signs the plan and writes it to filePath
+func WritePlan(filePath string, plan *Plan, signingKey string) error {
+	if signingKey == "" {
+		return fmt.Errorf("no signing key provided for plan %s", filePath)
+	}
+	signature, signErr := planSignature(*plan, signingKey)
+	if signErr != nil {
+		return signErr
+	}
+	plan.Signature = signature
+
+	planJson, marshErr := json.MarshalIndent(plan, "", "  ")
+	if marshErr != nil {
+		return fmt.Errorf("unable to format plan %s: %w", filePath, marshErr)
+	}
+	if writeErr := os.WriteFile(filePath, planJson, 0600); writeErr != nil {
+		return fmt.Errorf("unable to write plan %s: %w", filePath, writeErr)
+	}
+	return nil
+}
+
+// LoadPlan reads a plan and checks it was signed with signingKey and hasn't been edited since
+func LoadPlan(filePath string, signingKey string) (*Plan, error) {
+	if signingKey == "" {
+		return nil, fmt.Errorf("no signing key provided to verify plan %s", filePath)
+	}
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read plan %s: %w", filePath, readErr)
+	}
+
+	var plan Plan
+	if unMarshErr := json.Unmarshal(content, &plan); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to parse plan %s: %w", filePath, unMarshErr)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("plan %s has version %d, this tool applies version %d", filePath, plan.Version, planVersion)
+	}
+
+	expected, signErr := planSignature(plan, signingKey)
+	if signErr != nil {
+		return nil, signErr
+	}
+	if !hmac.Equal([]byte(expected), []byte(plan.Signature)) {
+		return nil, fmt.Errorf("plan %s has an invalid signature, it was edited or signed with a different key", filePath)
+	}
+	return &plan, nil
+}
+
+// Operator identifies who is running the tool: CRIBL_OPERATOR if set, otherwise the OS user
+func Operator() string {
+	if operator := os.Getenv("CRIBL_OPERATOR"); operator != "" {
+		return operator
+	}
+	if current, userErr := user.Current(); userErr == nil {
+		return current.Username
+	}
+	return "unknown"
+}
@@ -0,0 +1,309 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Policy is a set of rules evaluated against an object's config before it is created or updated on a target.
+//
+// Example policy file:
+//
+//	{"rules": [
+//	  {"name": "no-disabled-destinations", "objTypes": ["destination"], "path": "disabled", "assert": "forbidden",
+//	   "values": [true], "levels": {"prod": "block", "uat": "warn"}},
+//	  {"name": "no-wildcard-bind", "objTypes": ["source"], "path": "host", "assert": "forbidden", "values": ["0.0.0.0"]},
+//	  {"name": "no-drop-all", "objTypes": ["pipeline"], "path": "conf.functions[?id=drop].filter", "assert": "forbidden",
+//	   "values": ["true"], "message": "pipeline would drop every event"}
+//	]}
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule asserts something about the values found at Path.
+//
+// Path is dot separated keys, where each key may be followed by [N] (array index), [*] (every array element)
+// or [?key=value] (array elements whose key equals value).
+//
+// Assert is one of:
+//   - required: the path must resolve to at least one non-null value
+//   - absent: the path must not resolve to any value
+//   - forbidden: no value at the path may be one of Values
+//   - allowed: every value at the path must be one of Values
+type PolicyRule struct {
+	Name     string            `json:"name"`
+	ObjTypes []string          `json:"objTypes"`
+	Path     string            `json:"path"`
+	Assert   string            `json:"assert"`
+	Values   []interface{}     `json:"values"`
+	Message  string            `json:"message"`
+	Level    string            `json:"level"`
+	Levels   map[string]string `json:"levels"`
+}
+
+const (
+	PolicyLevelBlock = "block"
+	PolicyLevelWarn  = "warn"
+	PolicyLevelOff   = "off"
+)
+
+// PolicyViolation is a rule that matched an object, and the level it applies at for the environment
+type PolicyViolation struct {
+	Rule   string
+	Level  string
+	Detail string
+}
+
+func (v PolicyViolation) String() string {
+	return fmt.Sprintf("[%s] rule '%s': %s", strings.ToUpper(v.Level), v.Rule, v.Detail)
+}
+
+func LoadPolicy(filePath string) (*Policy, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read policy file %s: %w", filePath, readErr)
+	}
+
+	var policy Policy
+	if unMarshErr := json.Unmarshal(content, &policy); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to parse policy file %s: %w", filePath, unMarshErr)
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("policy rule %d in %s is missing a name", i+1, filePath)
+		}
+		if _, pathErr := parsePolicyPath(rule.Path); pathErr != nil {
+			return nil, fmt.Errorf("policy rule '%s' has an invalid path: %w", rule.Name, pathErr)
+		}
+		switch rule.Assert {
+		case "required", "absent":
+		case "forbidden", "allowed":
+			if len(rule.Values) == 0 {
+				return nil, fmt.Errorf("policy rule '%s' uses '%s' but lists no values", rule.Name, rule.Assert)
+			}
+		default:
+			return nil, fmt.Errorf("policy rule '%s' has unknown assert '%s'. Valid options are: required, absent, forbidden, or allowed", rule.Name, rule.Assert)
+		}
+		for env, level := range rule.Levels {
+			if !isPolicyLevel(level) {
+				return nil, fmt.Errorf("policy rule '%s' has unknown level '%s' for env %s. Valid options are: block, warn, or off", rule.Name, level, env)
+			}
+		}
+		if rule.Level != "" && !isPolicyLevel(rule.Level) {
+			return nil, fmt.Errorf("policy rule '%s' has unknown level '%s'. Valid options are: block, warn, or off", rule.Name, rule.Level)
+		}
+	}
+
+	return &policy, nil
+}
+
+func isPolicyLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case PolicyLevelBlock, PolicyLevelWarn, PolicyLevelOff:
+		return true
+	default:
+		return false
+	}
+}
+
+// levelFor returns the rule's level for the environment, falling back to the rule default and then to block
+func (r PolicyRule) levelFor(env string) string {
+	for ruleEnv, level := range r.Levels {
+		if strings.EqualFold(ruleEnv, env) {
+			return strings.ToLower(level)
+		}
+	}
+	if r.Level != "" {
+		return strings.ToLower(r.Level)
+	}
+	return PolicyLevelBlock
+}
+
+func (r PolicyRule) appliesTo(objType string) bool {
+	if len(r.ObjTypes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.ObjTypes, func(t string) bool { return strings.EqualFold(t, objType) })
+}
+
+// Evaluate returns every rule the config violates for the object type and environment. Rules at level off are skipped.
+func (p *Policy) Evaluate(objType string, env string, config CribConfig) []PolicyViolation {
+	var violations []PolicyViolation
+
+	for _, rule := range p.Rules {
+		level := rule.levelFor(env)
+		if level == PolicyLevelOff || !rule.appliesTo(objType) {
+			continue
+		}
+
+		detail := rule.check(config)
+		if detail == "" {
+			continue
+		}
+		if rule.Message != "" {
+			detail = rule.Message + " (" + detail + ")"
+		}
+		violations = append(violations, PolicyViolation{Rule: rule.Name, Level: level, Detail: detail})
+	}
+
+	return violations
+}
+
+// HasBlockingViolation reports whether any violation should stop the change
+func HasBlockingViolation(violations []PolicyViolation) bool {
+	return slices.ContainsFunc(violations, func(v PolicyViolation) bool { return v.Level == PolicyLevelBlock })
+}
+
+// check returns a description of why the rule matched, or "" if the config passes. Rules are checked after secrets
+// are filled in, so credentials found at the path are redacted from the description.
+func (r PolicyRule) check(config CribConfig) string {
+	segments, _ := parsePolicyPath(r.Path)
+	found := resolvePolicyPath(map[string]interface{}(config), segments)
+	describe := func(value interface{}) string {
+		if IsSensitivePath(r.Path) {
+			return RedactedValue
+		}
+		return jsonString(redactValue(value))
+	}
+
+	switch r.Assert {
+	case "required":
+		for _, value := range found {
+			if value != nil {
+				return ""
+			}
+		}
+		return fmt.Sprintf("required field '%s' is missing", r.Path)
+	case "absent":
+		if len(found) > 0 {
+			return fmt.Sprintf("field '%s' must not be set, found %s", r.Path, describe(found[0]))
+		}
+	case "forbidden":
+		for _, value := range found {
+			if containsJsonValue(r.Values, value) {
+				return fmt.Sprintf("'%s' has forbidden value %s", r.Path, describe(value))
+			}
+		}
+	case "allowed":
+		for _, value := range found {
+			if !containsJsonValue(r.Values, value) {
+				return fmt.Sprintf("'%s' has value %s, allowed values are %s", r.Path, describe(value), jsonString(r.Values))
+			}
+		}
+	}
+	return ""
+}
+
+type policyPathSegment struct {
+	key         string
+	index       int
+	wildcard    bool
+	filterKey   string
+	filterValue string
+	hasIndex    bool
+}
+
+func parsePolicyPath(path string) ([]policyPathSegment, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, fmt.Errorf("path is empty")
+	}
+
+	var segments []policyPathSegment
+	for part := range strings.SplitSeq(path, ".") {
+		key, selector, hasSelector := strings.Cut(part, "[")
+		segment := policyPathSegment{key: key}
+		if hasSelector {
+			selector, closed := strings.CutSuffix(selector, "]")
+			if !closed {
+				return nil, fmt.Errorf("unterminated '[' in '%s'", part)
+			}
+			switch {
+			case selector == "*":
+				segment.wildcard = true
+			case strings.HasPrefix(selector, "?"):
+				filterKey, filterValue, hasEquals := strings.Cut(strings.TrimPrefix(selector, "?"), "=")
+				if !hasEquals || filterKey == "" {
+					return nil, fmt.Errorf("filter '%s' must be in the form [?key=value]", selector)
+				}
+				segment.filterKey = filterKey
+				segment.filterValue = strings.Trim(filterValue, `'"`)
+			default:
+				index, atoiErr := strconv.Atoi(selector)
+				if atoiErr != nil {
+					return nil, fmt.Errorf("invalid array selector '[%s]'", selector)
+				}
+				segment.index = index
+				segment.hasIndex = true
+			}
+		}
+		if segment.key == "" && !hasSelector {
+			return nil, fmt.Errorf("empty key in path '%s'", path)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// resolvePolicyPath returns every value the path points at. Missing keys simply resolve to nothing.
+func resolvePolicyPath(node interface{}, segments []policyPathSegment) []interface{} {
+	if len(segments) == 0 {
+		return []interface{}{node}
+	}
+
+	segment := segments[0]
+	current := node
+	if segment.key != "" {
+		obj, isObj := current.(map[string]interface{})
+		if !isObj {
+			return nil
+		}
+		value, exists := obj[segment.key]
+		if !exists {
+			return nil
+		}
+		current = value
+	}
+
+	if !segment.wildcard && !segment.hasIndex && segment.filterKey == "" {
+		return resolvePolicyPath(current, segments[1:])
+	}
+
+	arr, isArr := current.([]interface{})
+	if !isArr {
+		return nil
+	}
+
+	var found []interface{}
+	for i, element := range arr {
+		switch {
+		case segment.hasIndex && i != segment.index:
+			continue
+		case segment.filterKey != "":
+			obj, isObj := element.(map[string]interface{})
+			if !isObj || fmt.Sprint(obj[segment.filterKey]) != segment.filterValue {
+				continue
+			}
+		}
+		found = append(found, resolvePolicyPath(element, segments[1:])...)
+	}
+	return found
+}
+
+func containsJsonValue(values []interface{}, value interface{}) bool {
+	valueJson := jsonString(value)
+	return slices.ContainsFunc(values, func(v interface{}) bool { return jsonString(v) == valueJson })
+}
+
+func jsonString(value interface{}) string {
+	var valueJson bytes.Buffer
+	encoder := json.NewEncoder(&valueJson)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return strings.TrimSuffix(valueJson.String(), "\n")
+}
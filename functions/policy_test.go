@@ -0,0 +1,142 @@
+package functions
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicyPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []policyPathSegment
+		wantErr bool
+	}{
+		{path: "host", want: []policyPathSegment{{key: "host"}}},
+		{path: "conf.output", want: []policyPathSegment{{key: "conf"}, {key: "output"}}},
+		{path: "rules[2].output", want: []policyPathSegment{{key: "rules", index: 2, hasIndex: true}, {key: "output"}}},
+		{path: "connections[*].pipeline", want: []policyPathSegment{{key: "connections", wildcard: true}, {key: "pipeline"}}},
+		{path: "conf.functions[?id='drop'].filter", want: []policyPathSegment{{key: "conf"}, {key: "functions", filterKey: "id", filterValue: "drop"}, {key: "filter"}}},
+		{path: "", wantErr: true},
+		{path: "conf..output", wantErr: true},
+		{path: "rules[1", wantErr: true},
+		{path: "rules[x]", wantErr: true},
+		{path: "rules[?id]", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parsePolicyPath(test.path)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: expected error %v, got %v", test.path, test.wantErr, err)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %+v, got %+v", test.path, test.want, got)
+		}
+	}
+}
+
+func TestResolvePolicyPath(t *testing.T) {
+	var config map[string]interface{}
+	json.Unmarshal([]byte(`{"conf": {"functions": [
+		{"id": "eval", "filter": "true"},
+		{"id": "drop", "filter": "status == 500"},
+		{"id": "drop", "filter": "true"}
+	]}}`), &config)
+
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"conf.functions[*].id", []interface{}{"eval", "drop", "drop"}},
+		{"conf.functions[?id=drop].filter", []interface{}{"status == 500", "true"}},
+		{"conf.functions[0].filter", []interface{}{"true"}},
+		{"conf.functions[9].filter", nil},
+		{"conf.missing", nil},
+		{"conf.functions.id", nil},
+	}
+	for _, test := range tests {
+		segments, _ := parsePolicyPath(test.path)
+		if got := resolvePolicyPath(config, segments); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.path, test.want, got)
+		}
+	}
+}
+
+func TestPolicyEvaluateLevels(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(policyFile, []byte(`{"rules": [
+		{"name": "no-disabled", "objTypes": ["destination"], "path": "disabled", "assert": "forbidden", "values": [true],
+		 "levels": {"prod": "block", "uat": "warn"}},
+		{"name": "needs-description", "path": "description", "assert": "required", "level": "warn"},
+		{"name": "known-types", "objTypes": ["destination"], "path": "type", "assert": "allowed", "values": ["splunk", "s3"],
+		 "levels": {"uat": "off"}}
+	]}`), 0600)
+	policy, err := LoadPolicy(policyFile)
+	if err != nil {
+		t.Fatalf("unable to load policy: %v", err)
+	}
+
+	config := CribConfig{"type": "kafka", "disabled": true}
+	tests := []struct {
+		env, objType string
+		wantRules    []string
+		wantBlocking bool
+	}{
+		{"prod", "destination", []string{"no-disabled", "needs-description", "known-types"}, true},
+		{"uat", "destination", []string{"no-disabled", "needs-description"}, false},
+		{"uat", "source", []string{"needs-description"}, false},
+	}
+	for _, test := range tests {
+		violations := policy.Evaluate(test.objType, test.env, config)
+		var gotRules []string
+		for _, violation := range violations {
+			gotRules = append(gotRules, violation.Rule)
+		}
+		if !reflect.DeepEqual(gotRules, test.wantRules) {
+			t.Errorf("%s/%s: expected rules %v, got %v", test.env, test.objType, test.wantRules, gotRules)
+		}
+		if HasBlockingViolation(violations) != test.wantBlocking {
+			t.Errorf("%s/%s: expected blocking %v, got %v", test.env, test.objType, test.wantBlocking, violations)
+		}
+	}
+
+	if violations := policy.Evaluate("destination", "prod", CribConfig{"type": "s3", "disabled": false, "description": "x"}); len(violations) != 0 {
+		t.Errorf("expected a compliant config to pass, got %v", violations)
+	}
+}
+
+func TestLoadPolicyRejectsInvalidRules(t *testing.T) {
+	invalid := map[string]string{
+		"no name":        `{"rules": [{"path": "host", "assert": "absent"}]}`,
+		"bad path":       `{"rules": [{"name": "r", "path": "a[", "assert": "absent"}]}`,
+		"unknown assert": `{"rules": [{"name": "r", "path": "host", "assert": "equals"}]}`,
+		"no values":      `{"rules": [{"name": "r", "path": "host", "assert": "forbidden"}]}`,
+		"unknown level":  `{"rules": [{"name": "r", "path": "host", "assert": "absent", "levels": {"prod": "fatal"}}]}`,
+	}
+	for name, content := range invalid {
+		policyFile := filepath.Join(t.TempDir(), "policy.json")
+		os.WriteFile(policyFile, []byte(content), 0600)
+		if _, err := LoadPolicy(policyFile); err == nil {
+			t.Errorf("%s: expected the policy to be rejected", name)
+		}
+	}
+}
+
+func TestPolicyViolationsRedactCredentials(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{
+		{Name: "no-password", Path: "password", Assert: "absent"},
+		{Name: "no-auth", Path: "auth", Assert: "absent"},
+	}}
+	violations := policy.Evaluate("destination", "prod", CribConfig{"password": "prod-password", "auth": map[string]interface{}{"token": "t0k3n"}})
+	if len(violations) != 2 {
+		t.Fatalf("expected both rules to match, got %v", violations)
+	}
+	for _, violation := range violations {
+		if strings.Contains(violation.Detail, "prod-password") || strings.Contains(violation.Detail, "t0k3n") || !strings.Contains(violation.Detail, RedactedValue) {
+			t.Errorf("expected the credential to be redacted, got %s", violation)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package functions
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// LoadEvents reads sample or expected events from a file. Both a JSON array of events and NDJSON are accepted.
+func LoadEvents(filePath string) ([]CribConfig, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read events file %s: %w", filePath, readErr)
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	var events []CribConfig
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if unMarshErr := json.Unmarshal(trimmed, &events); unMarshErr != nil {
+			return nil, fmt.Errorf("unable to parse events file %s as a JSON array: %w", filePath, unMarshErr)
+		}
+		return events, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var event CribConfig
+		if unMarshErr := json.Unmarshal([]byte(line), &event); unMarshErr != nil {
+			return nil, fmt.Errorf("unable to parse line %d of events file %s: %w", lineNum, filePath, unMarshErr)
+		}
+		events = append(events, event)
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		return nil, fmt.Errorf("unable to read events file %s: %w", filePath, scanErr)
+	}
+	return events, nil
+}
+
+// PreviewPipeline runs sample events through a pipeline on the leader's preview endpoint and returns the output events
+func PreviewPipeline(baseApiUrl string, workerGroup string, token string, pipelineId string, sampleEvents []CribConfig) ([]CribConfig, error) {
+	url := baseApiUrl + "/api/v1/m/" + workerGroup + "/preview"
+
+	previewBody := map[string]interface{}{
+		"mode":       "pipe",
+		"pipelineId": pipelineId,
+		"level":      3,
+		"dropped":    false,
+		"events":     sampleEvents,
+	}
+	previewBodyJson, marshErr := json.Marshal(previewBody)
+	if marshErr != nil {
+		return nil, fmt.Errorf("unable to format preview request for pipeline %s: %w", pipelineId, marshErr)
+	}
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(previewBodyJson))
+	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
+
+	var (
+		maxRetries int = 5
+		resp       *http.Response
+		httpErr    error
+	)
+
+	resp, httpErr = retryHttp(req, maxRetries)
+
+	if resp != nil && httpErr == nil {
+		defer resp.Body.Close()
+
+		responseData, readErr := io.ReadAll(resp.Body)
+		if readErr != nil {
+			return nil, fmt.Errorf("unable to properly read response body %w", readErr)
+		}
+
+		var response struct {
+			Items []CribConfig `json:"items"`
+			Count int          `json:"count"`
+		}
+		if unMarshErr := json.Unmarshal(responseData, &response); unMarshErr != nil {
+			return nil, fmt.Errorf("unable to extract preview events from response body: %w", unMarshErr)
+		}
+		return response.Items, nil
+	} else {
+		return nil, fmt.Errorf("preview of pipeline %s failed when trying url %s: %w Attempted (%d) time(s)", pipelineId, url, httpErr, maxRetries)
+	}
+}
+
+// ValidatePipelinePreview runs the sample file through the pipeline and compares the output to the expected (golden) file.
+// Internal fields (prefixed with "__") are ignored since they are added by the preview itself.
+func ValidatePipelinePreview(baseApiUrl string, workerGroup string, token string, pipelineId string, samplePath string, expectedPath string) error {
+	sampleEvents, sampleErr := LoadEvents(samplePath)
+	if sampleErr != nil {
+		return sampleErr
+	}
+	expectedEvents, expectedErr := LoadEvents(expectedPath)
+	if expectedErr != nil {
+		return expectedErr
+	}
+
+	outputEvents, previewErr := PreviewPipeline(baseApiUrl, workerGroup, token, pipelineId, sampleEvents)
+	if previewErr != nil {
+		return previewErr
+	}
+
+	if len(outputEvents) != len(expectedEvents) {
+		return fmt.Errorf("pipeline %s produced %d event(s) from the sample, expected %d", pipelineId, len(outputEvents), len(expectedEvents))
+	}
+
+	for i := range outputEvents {
+		got := stripInternalFields(outputEvents[i])
+		want := stripInternalFields(expectedEvents[i])
+		if !reflect.DeepEqual(got, want) {
+			gotJson, _ := json.Marshal(got)
+			wantJson, _ := json.Marshal(want)
+			return fmt.Errorf("pipeline %s output event %d differs from expected:\n  got:      %s\n  expected: %s", pipelineId, i+1, gotJson, wantJson)
+		}
+	}
+
+	return nil
+}
+
+func stripInternalFields(event CribConfig) CribConfig {
+	stripped := CribConfig{}
+	for key, value := range event {
+		if !strings.HasPrefix(key, "__") {
+			stripped[key] = value
+		}
+	}
+	return stripped
+}
@@ -0,0 +1,335 @@
+package functions
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	secretsEndpoint = "/system/secrets"
+	// Prefix of environment variables that provide text secrets, e.g. CRIBL_SECRET_PROD_HEC_TOKEN
+	secretEnvPrefix = "CRIBL_SECRET_"
+	pbkdf2Rounds    = 600000
+)
+
+// Values the leader has encrypted with its own key look like "#42:<ciphertext>" and can't be used on another leader
+var encryptedValueRegex = regexp.MustCompile(`^#\d+:`)
+
+var secretEnvVarInvalidChars = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// SecretRef is a field of an object that refers to a stored Cribl secret by name
+type SecretRef struct {
+	Path string
+	Name string
+}
+
+// FindSecretReferences walks a config and returns the stored secrets it refers to (fields named "secret" or ending in
+// "Secret", e.g. textSecret, credentialsSecret, awsSecret) and the paths of values encrypted by the template leader.
+func FindSecretReferences(config CribConfig) ([]SecretRef, []string) {
+	var (
+		refs      []SecretRef
+		encrypted []string
+	)
+
+	var walk func(node interface{}, path string)
+	walk = func(node interface{}, path string) {
+		switch typed := node.(type) {
+		case map[string]interface{}:
+			for _, key := range sortedConfigKeys(typed) {
+				childPath := key
+				if path != "" {
+					childPath = path + "." + key
+				}
+				if strValue, isString := typed[key].(string); isString && strValue != "" && isSecretRefKey(key) && !encryptedValueRegex.MatchString(strValue) {
+					refs = append(refs, SecretRef{Path: childPath, Name: strValue})
+					continue
+				}
+				walk(typed[key], childPath)
+			}
+		case []interface{}:
+			for i, element := range typed {
+				walk(element, fmt.Sprintf("%s[%d]", path, i))
+			}
+		case string:
+			if encryptedValueRegex.MatchString(typed) {
+				encrypted = append(encrypted, path)
+			}
+		}
+	}
+	walk(map[string]interface{}(config), "")
+
+	return refs, encrypted
+}
+
+func isSecretRefKey(key string) bool {
+	return key == "secret" || strings.HasSuffix(key, "Secret")
+}
+
+func sortedConfigKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SecretStore resolves secret values for one target environment, from a decrypted secrets file and/or environment variables.
+//
+// The secrets file (before encryption) is keyed by env, then by secret name. Entries are the body of the Cribl
+// secret without its id, e.g. {"prod": {"hec_token": {"secretType": "text", "value": "..."}}}. Replacement values for
+// encrypted fields are keyed "<object id>.<field path>", e.g. {"prod": {"splunk_hec.token": {"value": "..."}}}.
+type SecretStore struct {
+	env     string
+	entries map[string]CribConfig
+}
+
+// LoadSecretStore decrypts the secrets file (if given) with the passphrase and selects the entries for env.
+// Environment variables are consulted for anything not in the file.
+func LoadSecretStore(filePath string, passphrase string, env string) (*SecretStore, error) {
+	store := &SecretStore{env: strings.ToLower(env), entries: map[string]CribConfig{}}
+	if filePath == "" {
+		return store, nil
+	}
+
+	plaintext, decryptErr := DecryptSecretsFile(filePath, passphrase)
+	if decryptErr != nil {
+		return nil, decryptErr
+	}
+
+	var envSecrets map[string]map[string]CribConfig
+	if unMarshErr := json.Unmarshal(plaintext, &envSecrets); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to parse decrypted secrets file %s: %w", filePath, unMarshErr)
+	}
+	for fileEnv, secrets := range envSecrets {
+		if strings.EqualFold(fileEnv, env) {
+			store.entries = secrets
+		}
+	}
+	return store, nil
+}
+
+// Lookup returns the secret body for name. Environment variables only provide text secrets.
+func (s *SecretStore) Lookup(name string) (CribConfig, bool) {
+	if entry, found := s.entries[name]; found {
+		return entry, true
+	}
+	if value, found := os.LookupEnv(secretEnvVarName(s.env, name)); found {
+		return CribConfig{"secretType": "text", "value": value}, true
+	}
+	return nil, false
+}
+
+func secretEnvVarName(env string, name string) string {
+	normalized := secretEnvVarInvalidChars.ReplaceAllString(strings.ToUpper(env+"_"+name), "_")
+	return secretEnvPrefix + normalized
+}
+
+// ResolveSecretRefs looks up every referenced secret, failing with the full list of any that are missing
+func (s *SecretStore) ResolveSecretRefs(refs []SecretRef) (map[string]CribConfig, error) {
+	resolved := map[string]CribConfig{}
+	var missing []string
+	for _, ref := range refs {
+		secret, found := s.Lookup(ref.Name)
+		if !found {
+			missing = append(missing, fmt.Sprintf("%s (referenced by %s, or set %s)", ref.Name, ref.Path, secretEnvVarName(s.env, ref.Name)))
+			continue
+		}
+		resolved[ref.Name] = secret
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no value for secret(s) in env %s: %s", s.env, strings.Join(missing, "; "))
+	}
+	return resolved, nil
+}
+
+// ReplaceEncryptedFields swaps values encrypted by the template leader for plaintext values from the store.
+// The target leader encrypts them again with its own key when the object is saved.
+func (s *SecretStore) ReplaceEncryptedFields(objId string, config CribConfig, encryptedPaths []string) error {
+	var missing []string
+	for _, path := range encryptedPaths {
+		entry, found := s.Lookup(objId + "." + path)
+		value, isString := entry["value"].(string)
+		if !found || !isString {
+			missing = append(missing, fmt.Sprintf("%s.%s (or set %s)", objId, path, secretEnvVarName(s.env, objId+"."+path)))
+			continue
+		}
+		setConfigPath(map[string]interface{}(config), path, value)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("encrypted field(s) can't be copied between leaders and have no value in env %s: %s", s.env, strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// setConfigPath sets a value at a path produced by FindSecretReferences (keys joined by ".", array elements as [N])
+func setConfigPath(config map[string]interface{}, path string, value interface{}) {
+	var node interface{} = config
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		key, indexes, _ := strings.Cut(part, "[")
+		obj, isObj := node.(map[string]interface{})
+		if !isObj {
+			return
+		}
+		if indexes == "" {
+			if i == len(parts)-1 {
+				obj[key] = value
+				return
+			}
+			node = obj[key]
+			continue
+		}
+
+		node = obj[key]
+		indexList := strings.Split(strings.TrimSuffix(indexes, "]"), "][")
+		for j, indexStr := range indexList {
+			var index int
+			fmt.Sscanf(indexStr, "%d", &index)
+			arr, isArr := node.([]interface{})
+			if !isArr || index >= len(arr) {
+				return
+			}
+			if i == len(parts)-1 && j == len(indexList)-1 {
+				arr[index] = value
+				return
+			}
+			node = arr[index]
+		}
+	}
+}
+
+// EnsureSecret creates the secret in the worker group, or updates it if it already exists
+func EnsureSecret(baseApiUrl string, workerGroup string, token string, name string, secret CribConfig) error {
+	secretBody := CribConfig{}
+	for key, value := range secret {
+		secretBody[key] = value
+	}
+	secretBody["id"] = name
+	secretBodyJson, marshErr := json.Marshal(secretBody)
+	if marshErr != nil {
+		return fmt.Errorf("unable to format secret %s: %w", name, marshErr)
+	}
+
+	itemUrl := baseApiUrl + "/api/v1/m/" + workerGroup + secretsEndpoint + "/" + name
+	getReq, _ := http.NewRequest("GET", itemUrl, nil)
+	getReq.Header = http.Header{"Authorization": {token}}
+
+	var maxRetries int = 5
+
+	resp, httpErr := retryHttp(getReq, maxRetries)
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	var method, url string
+	switch {
+	case httpErr == nil:
+		method, url = "PATCH", itemUrl
+	case resp != nil && resp.StatusCode == http.StatusNotFound:
+		method, url = "POST", baseApiUrl+"/api/v1/m/"+workerGroup+secretsEndpoint
+	default:
+		return fmt.Errorf("unable to check for secret %s at url %s: %w Attempted (%d) time(s)", name, itemUrl, httpErr, maxRetries)
+	}
+
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(secretBodyJson))
+	req.Header = http.Header{"Authorization": {token}, "content-type": {"application/json"}}
+
+	resp, httpErr = retryHttp(req, maxRetries)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if httpErr != nil {
+		return fmt.Errorf("saving secret %s failed when trying url %s: %w, Attempted (%d) time(s)", name, url, httpErr, maxRetries)
+	}
+	return nil
+}
+
+type encryptedSecretsFile struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func secretsCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("no passphrase provided for the secrets file")
+	}
+	key, keyErr := pbkdf2.Key(sha256.New, passphrase, salt, pbkdf2Rounds, 32)
+	if keyErr != nil {
+		return nil, fmt.Errorf("unable to derive secrets file key: %w", keyErr)
+	}
+	block, blockErr := aes.NewCipher(key)
+	if blockErr != nil {
+		return nil, blockErr
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecretsFile encrypts a plaintext secrets JSON file with AES-256-GCM using a key derived from the passphrase
+func EncryptSecretsFile(plainPath string, outPath string, passphrase string) error {
+	plaintext, readErr := os.ReadFile(plainPath)
+	if readErr != nil {
+		return fmt.Errorf("unable to read secrets file %s: %w", plainPath, readErr)
+	}
+	if !json.Valid(plaintext) {
+		return fmt.Errorf("secrets file %s is not valid JSON", plainPath)
+	}
+
+	salt := make([]byte, 16)
+	if _, randErr := io.ReadFull(rand.Reader, salt); randErr != nil {
+		return randErr
+	}
+	aead, cipherErr := secretsCipher(passphrase, salt)
+	if cipherErr != nil {
+		return cipherErr
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, randErr := io.ReadFull(rand.Reader, nonce); randErr != nil {
+		return randErr
+	}
+
+	encrypted := encryptedSecretsFile{Salt: salt, Nonce: nonce, Ciphertext: aead.Seal(nil, nonce, plaintext, nil)}
+	encryptedJson, marshErr := json.MarshalIndent(encrypted, "", "  ")
+	if marshErr != nil {
+		return marshErr
+	}
+	return os.WriteFile(outPath, encryptedJson, 0600)
+}
+
+// DecryptSecretsFile returns the plaintext JSON of an encrypted secrets file
+func DecryptSecretsFile(filePath string, passphrase string) ([]byte, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read secrets file %s: %w", filePath, readErr)
+	}
+
+	var encrypted encryptedSecretsFile
+	if unMarshErr := json.Unmarshal(content, &encrypted); unMarshErr != nil {
+		return nil, fmt.Errorf("unable to parse secrets file %s: %w", filePath, unMarshErr)
+	}
+	aead, cipherErr := secretsCipher(passphrase, encrypted.Salt)
+	if cipherErr != nil {
+		return nil, cipherErr
+	}
+	if len(encrypted.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("secrets file %s has an invalid nonce", filePath)
+	}
+	plaintext, openErr := aead.Open(nil, encrypted.Nonce, encrypted.Ciphertext, nil)
+	if openErr != nil {
+		return nil, fmt.Errorf("unable to decrypt secrets file %s, wrong passphrase or file was modified", filePath)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,118 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeEncryptedSecrets(t *testing.T, plaintext string, passphrase string) string {
+	t.Helper()
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "secrets.json")
+	encryptedPath := filepath.Join(dir, "secrets.enc")
+	os.WriteFile(plainPath, []byte(plaintext), 0600)
+	if err := EncryptSecretsFile(plainPath, encryptedPath, passphrase); err != nil {
+		t.Fatalf("unable to encrypt secrets file: %v", err)
+	}
+	return encryptedPath
+}
+
+func TestSecretsFileRoundTrip(t *testing.T) {
+	plaintext := `{"prod": {"hec_token": {"secretType": "text", "value": "s3cr3t"}}}`
+	encryptedPath := writeEncryptedSecrets(t, plaintext, "correct horse")
+
+	encrypted, _ := os.ReadFile(encryptedPath)
+	if bytes.Contains(encrypted, []byte("s3cr3t")) {
+		t.Fatal("secret value is readable in the encrypted file")
+	}
+	decrypted, err := DecryptSecretsFile(encryptedPath, "correct horse")
+	if err != nil {
+		t.Fatalf("unable to decrypt with the right passphrase: %v", err)
+	}
+	if string(decrypted) != plaintext {
+		t.Errorf("expected %s after decrypting, got %s", plaintext, decrypted)
+	}
+}
+
+func TestSecretsFileRejectsWrongPassphraseAndTampering(t *testing.T) {
+	encryptedPath := writeEncryptedSecrets(t, `{"prod": {}}`, "correct horse")
+
+	if _, err := DecryptSecretsFile(encryptedPath, "battery staple"); err == nil {
+		t.Error("expected decrypting with the wrong passphrase to fail")
+	}
+	if _, err := DecryptSecretsFile(encryptedPath, ""); err == nil {
+		t.Error("expected decrypting without a passphrase to fail")
+	}
+
+	var encrypted encryptedSecretsFile
+	content, _ := os.ReadFile(encryptedPath)
+	json.Unmarshal(content, &encrypted)
+	encrypted.Ciphertext[0] ^= 0xff
+	tampered, _ := json.Marshal(encrypted)
+	os.WriteFile(encryptedPath, tampered, 0600)
+	if _, err := DecryptSecretsFile(encryptedPath, "correct horse"); err == nil {
+		t.Error("expected decrypting a modified file to fail")
+	}
+}
+
+func TestSecretStoreResolvesFromFileThenEnv(t *testing.T) {
+	encryptedPath := writeEncryptedSecrets(t, `{
+		"prod": {"hec_token": {"secretType": "text", "value": "from-file"}},
+		"uat":  {"hec_token": {"secretType": "text", "value": "uat-value"}}
+	}`, "pass")
+	t.Setenv("CRIBL_SECRET_PROD_S3_KEY", "from-env")
+
+	store, err := LoadSecretStore(encryptedPath, "pass", "Prod")
+	if err != nil {
+		t.Fatalf("unable to load secret store: %v", err)
+	}
+	resolved, err := store.ResolveSecretRefs([]SecretRef{{Path: "textSecret", Name: "hec_token"}, {Path: "awsSecret", Name: "s3-key"}})
+	if err != nil {
+		t.Fatalf("unable to resolve secrets: %v", err)
+	}
+	if resolved["hec_token"]["value"] != "from-file" || resolved["s3-key"]["value"] != "from-env" {
+		t.Errorf("secrets resolved from the wrong place: %v", resolved)
+	}
+
+	if _, err := store.ResolveSecretRefs([]SecretRef{{Path: "secret", Name: "missing"}}); err == nil {
+		t.Error("expected a missing secret to fail")
+	}
+	if _, err := LoadSecretStore(encryptedPath, "wrong", "prod"); err == nil {
+		t.Error("expected loading with the wrong passphrase to fail")
+	}
+}
+
+func TestFindAndReplaceEncryptedFields(t *testing.T) {
+	var config CribConfig
+	json.Unmarshal([]byte(`{
+		"textSecret": "hec_token",
+		"token": "#42:abcdef",
+		"headers": [{"name": "auth", "value": "#42:123456"}],
+		"secret": "#42:notareference"
+	}`), &config)
+
+	refs, encrypted := FindSecretReferences(config)
+	if !reflect.DeepEqual(refs, []SecretRef{{Path: "textSecret", Name: "hec_token"}}) {
+		t.Errorf("unexpected secret references: %v", refs)
+	}
+	wantEncrypted := []string{"headers[0].value", "secret", "token"}
+	if !reflect.DeepEqual(encrypted, wantEncrypted) {
+		t.Errorf("expected encrypted paths %v, got %v", wantEncrypted, encrypted)
+	}
+
+	t.Setenv("CRIBL_SECRET_PROD_SPLUNK_TOKEN", "plain-token")
+	t.Setenv("CRIBL_SECRET_PROD_SPLUNK_HEADERS_0_VALUE", "plain-header")
+	t.Setenv("CRIBL_SECRET_PROD_SPLUNK_SECRET", "plain-secret")
+	store, _ := LoadSecretStore("", "", "prod")
+	if err := store.ReplaceEncryptedFields("splunk", config, encrypted); err != nil {
+		t.Fatalf("unable to replace encrypted fields: %v", err)
+	}
+	header := config["headers"].([]interface{})[0].(map[string]interface{})
+	if config["token"] != "plain-token" || header["value"] != "plain-header" || config["secret"] != "plain-secret" {
+		t.Errorf("encrypted fields were not replaced: %v", config)
+	}
+}
@@ -0,0 +1,93 @@
+package functions
+
+import (
+	"strings"
+)
+
+// What sensitive values are replaced with in diffs
+const RedactedValue = "<redacted>"
+
+// Keys that hold credentials, matched case-insensitively against the end of a key so authToken, hecToken and
+// awsSecretKey are covered. Secret references (textSecret, credentialsSecret) only hold a name and aren't sensitive.
+var sensitiveKeySuffixes = []string{"password", "passwd", "passphrase", "token", "apikey", "secretkey", "secretaccesskey", "privatekey", "clientsecret"}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, suffix := range sensitiveKeySuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSensitivePath reports whether the last key of a diff path, e.g. authTokens[id=x].token, holds a credential
+func IsSensitivePath(path string) bool {
+	for strings.HasSuffix(path, "]") {
+		open := strings.LastIndex(path, "[")
+		if open < 0 {
+			break
+		}
+		path = path[:open]
+	}
+	return isSensitiveKey(path[strings.LastIndex(path, ".")+1:])
+}
+
+// isEncryptedValue reports whether value was encrypted by a leader, these come back different from what was sent
+func isEncryptedValue(value interface{}) bool {
+	strValue, isString := value.(string)
+	return isString && encryptedValueRegex.MatchString(strValue)
+}
+
+// isMaskedValue reports whether value is a credential the leader hides when it is read back, e.g. "******"
+func isMaskedValue(value interface{}) bool {
+	strValue, isString := value.(string)
+	return isString && strValue != "" && strings.Trim(strValue, "*") == ""
+}
+
+// RedactChanges returns changes with the values of credentials and leader-encrypted values replaced, including inside
+// objects that were added or removed whole
+func RedactChanges(changes []DiffChange) []DiffChange {
+	redacted := make([]DiffChange, 0, len(changes))
+	for _, change := range changes {
+		if IsSensitivePath(change.Path) {
+			if change.Before != nil {
+				change.Before = RedactedValue
+			}
+			if change.After != nil {
+				change.After = RedactedValue
+			}
+		} else {
+			change.Before = redactValue(change.Before)
+			change.After = redactValue(change.After)
+		}
+		redacted = append(redacted, change)
+	}
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(typed))
+		for key, child := range typed {
+			if isSensitiveKey(key) && child != nil {
+				redacted[key] = RedactedValue
+			} else {
+				redacted[key] = redactValue(child)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(typed))
+		for i, element := range typed {
+			redacted[i] = redactValue(element)
+		}
+		return redacted
+	default:
+		if isEncryptedValue(value) {
+			return RedactedValue
+		}
+		return value
+	}
+}
@@ -0,0 +1,48 @@
+package functions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsSensitivePath(t *testing.T) {
+	tests := map[string]bool{
+		"password":                  true,
+		"conf.authToken":            true,
+		"authTokens[id=a].token":    true,
+		"authTokens[0].token":       true,
+		"awsSecretKey":              true,
+		"tokenTimeoutSecs":          false,
+		"textSecret":                false,
+		"authTokens":                false,
+		"conf.functions[id=eval#2]": false,
+	}
+	for path, want := range tests {
+		if got := IsSensitivePath(path); got != want {
+			t.Errorf("%s: expected sensitive %v, got %v", path, want, got)
+		}
+	}
+}
+
+func TestRedactChanges(t *testing.T) {
+	changes := diffJson(t,
+		`{"host": "a", "password": "hunter2", "authTokens": [], "secret": "#42:abc"}`,
+		`{"host": "b", "password": "swordfish", "authTokens": [{"token": "t0k3n", "description": "ci"}], "secret": "#43:def"}`)
+
+	got := map[string][2]interface{}{}
+	for _, change := range RedactChanges(changes) {
+		got[change.Path] = [2]interface{}{change.Before, change.After}
+	}
+	want := map[string][2]interface{}{
+		"host":          {"a", "b"},
+		"password":      {RedactedValue, RedactedValue},
+		"authTokens[0]": {nil, map[string]interface{}{"token": RedactedValue, "description": "ci"}},
+		"secret":        {RedactedValue, RedactedValue},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if changes[1].After == RedactedValue {
+		t.Error("redacting changed the original changes")
+	}
+}
@@ -0,0 +1,195 @@
+package functions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version of state files written as a single JSON document. Newer files are a JSON record per line, which lets
+// concurrent runs append without overwriting each other. Version 1 files are still read, and appended to.
+const legacyStateVersion = 1
+
+// StateEntry records one object the tool successfully deployed to a worker group
+type StateEntry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Operator    string    `json:"operator"`
+	Env         string    `json:"env"`
+	TargetUrl   string    `json:"targetUrl"`
+	WorkerGroup string    `json:"workerGroup"`
+	ObjType     string    `json:"objType"`
+	ObjId       string    `json:"objId"`
+	// ConfigHash of the payload for JSON config objects, FileHash of the file for lookups
+	ContentHash string `json:"contentHash"`
+	// created or updated
+	Result string `json:"result"`
+}
+
+type legacyStateFile struct {
+	Version *int         `json:"version"`
+	Entries []StateEntry `json:"entries"`
+}
+
+// StateStore is a local file of everything deployed, oldest entry first
+type StateStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func OpenStateStore(filePath string) *StateStore {
+	return &StateStore{path: filePath}
+}
+
+// Entries returns every recorded deployment. A store that hasn't been written to yet has none.
+func (s *StateStore) Entries() ([]StateEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+func (s *StateStore) read() ([]StateEntry, error) {
+	stateFile, openErr := os.Open(s.path)
+	if errors.Is(openErr, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if openErr != nil {
+		return nil, fmt.Errorf("unable to read state file %s: %w", s.path, openErr)
+	}
+	defer stateFile.Close()
+
+	var entries []StateEntry
+	decoder := json.NewDecoder(stateFile)
+	for recordNum := 1; ; recordNum++ {
+		var record json.RawMessage
+		decodeErr := decoder.Decode(&record)
+		if errors.Is(decodeErr, io.EOF) {
+			return entries, nil
+		}
+		if decodeErr != nil {
+			return nil, fmt.Errorf("unable to parse record %d of state file %s: %w", recordNum, s.path, decodeErr)
+		}
+
+		var legacy legacyStateFile
+		if unMarshErr := json.Unmarshal(record, &legacy); unMarshErr == nil && legacy.Version != nil {
+			if recordNum != 1 || *legacy.Version != legacyStateVersion {
+				return nil, fmt.Errorf("state file %s has an unsupported version %d record", s.path, *legacy.Version)
+			}
+			entries = append(entries, legacy.Entries...)
+			continue
+		}
+		var entry StateEntry
+		if unMarshErr := json.Unmarshal(record, &entry); unMarshErr != nil {
+			return nil, fmt.Errorf("unable to parse record %d of state file %s: %w", recordNum, s.path, unMarshErr)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Record adds an entry, filling in the timestamp and operator if they aren't set. The entry is appended with a
+// single write so runs recording at the same time don't lose each other's entries.
+func (s *StateStore) Record(entry StateEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	if entry.Operator == "" {
+		entry.Operator = Operator()
+	}
+
+	entryJson, marshErr := json.Marshal(entry)
+	if marshErr != nil {
+		return fmt.Errorf("unable to format state entry: %w", marshErr)
+	}
+	if mkdirErr := os.MkdirAll(filepath.Dir(s.path), 0700); mkdirErr != nil {
+		return fmt.Errorf("unable to create the directory for state file %s: %w", s.path, mkdirErr)
+	}
+	stateFile, openErr := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if openErr != nil {
+		return fmt.Errorf("unable to open state file %s: %w", s.path, openErr)
+	}
+	_, writeErr := stateFile.Write(append(entryJson, '\n'))
+	closeErr := stateFile.Close()
+	if writeErr != nil || closeErr != nil {
+		return fmt.Errorf("unable to write state file %s: %w", s.path, errors.Join(writeErr, closeErr))
+	}
+	return nil
+}
+
+// StateFilter selects entries, empty fields match everything. Matching is case insensitive.
+type StateFilter struct {
+	Env         string
+	WorkerGroup string
+	ObjType     string
+	ObjId       string
+}
+
+func (f StateFilter) matches(entry StateEntry) bool {
+	matchField := func(want string, got string) bool { return want == "" || strings.EqualFold(want, got) }
+	return matchField(f.Env, entry.Env) && matchField(f.WorkerGroup, entry.WorkerGroup) &&
+		matchField(f.ObjType, entry.ObjType) && matchField(f.ObjId, entry.ObjId)
+}
+
+// History returns the matching entries, oldest first
+func (s *StateStore) History(filter StateFilter) ([]StateEntry, error) {
+	entries, readErr := s.Entries()
+	if readErr != nil {
+		return nil, readErr
+	}
+	var matching []StateEntry
+	for _, entry := range entries {
+		if filter.matches(entry) {
+			matching = append(matching, entry)
+		}
+	}
+	return matching, nil
+}
+
+// Current returns the latest matching entry for each env, worker group and object, i.e. what is deployed where
+func (s *StateStore) Current(filter StateFilter) ([]StateEntry, error) {
+	history, historyErr := s.History(filter)
+	if historyErr != nil {
+		return nil, historyErr
+	}
+
+	latest := map[string]StateEntry{}
+	for _, entry := range history {
+		latest[strings.ToLower(strings.Join([]string{entry.Env, entry.WorkerGroup, entry.ObjType, entry.ObjId}, "\x00"))] = entry
+	}
+	current := make([]StateEntry, 0, len(latest))
+	for _, entry := range latest {
+		current = append(current, entry)
+	}
+	slices.SortFunc(current, func(a, b StateEntry) int {
+		return strings.Compare(
+			strings.Join([]string{a.Env, a.WorkerGroup, a.ObjType, a.ObjId}, "\x00"),
+			strings.Join([]string{b.Env, b.WorkerGroup, b.ObjType, b.ObjId}, "\x00"))
+	})
+	return current, nil
+}
+
+// FileHash returns the sha256 of a file, used as the content hash of lookups
+func FileHash(filePath string) (string, error) {
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		return "", fmt.Errorf("unable to open %s to hash: %w", filePath, openErr)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, copyErr := io.Copy(hasher, file); copyErr != nil {
+		return "", fmt.Errorf("unable to read %s to hash: %w", filePath, copyErr)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
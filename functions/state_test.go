@@ -0,0 +1,92 @@
+package functions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateStoreConcurrentRunsKeepEveryEntry(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	// Separate stores stand in for separate runs, they share nothing but the file
+	var wg sync.WaitGroup
+	for run := 0; run < 4; run++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := OpenStateStore(statePath)
+			for i := 0; i < 25; i++ {
+				if err := store.Record(StateEntry{Env: "prod", WorkerGroup: fmt.Sprintf("wg%d", run), ObjType: "pipeline", ObjId: fmt.Sprint(i), Result: "updated"}); err != nil {
+					t.Errorf("unable to record: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	entries, err := OpenStateStore(statePath).Entries()
+	if err != nil {
+		t.Fatalf("unable to read state: %v", err)
+	}
+	if len(entries) != 100 {
+		t.Errorf("expected 100 entries, got %d", len(entries))
+	}
+}
+
+func TestStateStoreReadsAndAppendsToVersion1Files(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(statePath, []byte(`{
+  "version": 1,
+  "entries": [
+    {"timestamp": "2026-01-01T00:00:00Z", "env": "prod", "workerGroup": "wg1", "objType": "pipeline", "objId": "main", "contentHash": "old", "result": "created"}
+  ]
+}`), 0600)
+
+	store := OpenStateStore(statePath)
+	if err := store.Record(StateEntry{Env: "prod", WorkerGroup: "wg1", ObjType: "pipeline", ObjId: "main", ContentHash: "new", Result: "updated"}); err != nil {
+		t.Fatalf("unable to record: %v", err)
+	}
+	entries, err := store.Entries()
+	if err != nil {
+		t.Fatalf("unable to read state: %v", err)
+	}
+	if len(entries) != 2 || entries[0].ContentHash != "old" || entries[1].ContentHash != "new" {
+		t.Errorf("expected the version 1 entry followed by the new one, got %+v", entries)
+	}
+
+	os.WriteFile(statePath, []byte(`{"version": 2, "entries": []}`), 0600)
+	if _, err := store.Entries(); err == nil {
+		t.Error("expected an unknown state file version to be rejected")
+	}
+}
+
+func TestStateStoreHistoryAndCurrent(t *testing.T) {
+	// Its directory is created on first use, like the default per-user one
+	store := OpenStateStore(filepath.Join(t.TempDir(), "criblPatching", "state.json"))
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, entry := range []StateEntry{
+		{Env: "prod", WorkerGroup: "wg1", ObjType: "pipeline", ObjId: "main", ContentHash: "a"},
+		{Env: "prod", WorkerGroup: "wg2", ObjType: "pipeline", ObjId: "main", ContentHash: "a"},
+		{Env: "prod", WorkerGroup: "wg1", ObjType: "pipeline", ObjId: "main", ContentHash: "b"},
+		{Env: "uat", WorkerGroup: "wg1", ObjType: "pipeline", ObjId: "main", ContentHash: "c"},
+	} {
+		entry.Timestamp = start.Add(time.Duration(i) * time.Minute)
+		store.Record(entry)
+	}
+
+	history, _ := store.History(StateFilter{Env: "PROD", WorkerGroup: "wg1"})
+	if len(history) != 2 || history[0].ContentHash != "a" || history[1].ContentHash != "b" {
+		t.Errorf("expected wg1's two prod deployments oldest first, got %+v", history)
+	}
+	current, _ := store.Current(StateFilter{Env: "prod"})
+	if len(current) != 2 || current[0].WorkerGroup != "wg1" || current[0].ContentHash != "b" || current[1].WorkerGroup != "wg2" {
+		t.Errorf("expected the latest deployment per worker group, got %+v", current)
+	}
+	if entries, err := OpenStateStore(filepath.Join(t.TempDir(), "missing.json")).Entries(); err != nil || len(entries) != 0 {
+		t.Errorf("expected a missing state file to have no entries, got %v %v", entries, err)
+	}
+}
@@ -0,0 +1,87 @@
+package functions
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	transferRequestKey struct{}
+	detachedRequestKey struct{}
+)
+
+var (
+	timeoutsMu sync.RWMutex
+	// Cancelled to abort every in-flight request, e.g. on a second Ctrl-C or when the whole run times out
+	runCtx = context.Background()
+	// Applies to each attempt of a normal API call, including reading the response body
+	requestTimeout = 60 * time.Second
+	// Applies to each attempt of a lookup file upload/download, which can legitimately take a long time
+	transferTimeout = 30 * time.Minute
+)
+
+// SetRunContext makes every request made from now on abort when ctx is cancelled
+func SetRunContext(ctx context.Context) {
+	timeoutsMu.Lock()
+	defer timeoutsMu.Unlock()
+	runCtx = ctx
+}
+
+// SetTimeouts sets the per-attempt timeouts for API calls and for lookup file transfers. Zero leaves a timeout unchanged.
+func SetTimeouts(request time.Duration, transfer time.Duration) {
+	timeoutsMu.Lock()
+	defer timeoutsMu.Unlock()
+	if request > 0 {
+		requestTimeout = request
+	}
+	if transfer > 0 {
+		transferTimeout = transfer
+	}
+}
+
+// asTransfer marks a request as a file transfer so it gets the longer transfer timeout
+func asTransfer(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), transferRequestKey{}, true))
+}
+
+// detachFromRun lets a request go ahead after the run context was cancelled, for cleanup like releasing locks. It
+// still gets the per-attempt timeout.
+func detachFromRun(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), detachedRequestKey{}, true))
+}
+
+// attemptContext returns the context for one attempt of req, bounded by the run context and the request's timeout
+func attemptContext(req *http.Request) (context.Context, context.CancelFunc) {
+	timeoutsMu.RLock()
+	timeout := requestTimeout
+	if req.Context().Value(transferRequestKey{}) != nil {
+		timeout = transferTimeout
+	}
+	timeoutsMu.RUnlock()
+	return context.WithTimeout(requestRunContext(req), timeout)
+}
+
+// requestRunContext returns the run context req is bound by, which for a detached request is never cancelled
+func requestRunContext(req *http.Request) context.Context {
+	if req.Context().Value(detachedRequestKey{}) != nil {
+		return context.Background()
+	}
+	timeoutsMu.RLock()
+	defer timeoutsMu.RUnlock()
+	return runCtx
+}
+
+// cancelOnClose releases an attempt's context once the caller is done reading the response body
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
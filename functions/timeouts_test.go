@@ -0,0 +1,81 @@
+package functions
+
+import (
+	"context"
+	"criblPatching/fakeleader"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowLeader starts a fake leader that holds every request whose path contains pathContains for delay before
+// handling it, and counts them
+func slowLeader(t *testing.T, pathContains string, delay time.Duration) (*fakeleader.Leader, string, *atomic.Int32) {
+	t.Helper()
+	leader := fakeleader.New("admin", "secret", "wg1")
+	t.Cleanup(leader.Close)
+	token, err := TokenApiCall(leader.URL, "admin", "secret")
+	if err != nil {
+		t.Fatalf("unable to login: %v", err)
+	}
+
+	var delayed atomic.Int32
+	leader.OnRequest(func(req fakeleader.RecordedRequest) {
+		if strings.Contains(req.Path, pathContains) {
+			delayed.Add(1)
+			time.Sleep(delay)
+		}
+	})
+	t.Cleanup(func() { SetTimeouts(60*time.Second, 30*time.Minute) })
+	return leader, token, &delayed
+}
+
+func TestRequestTimeoutAppliesToEachAttempt(t *testing.T) {
+	leader, token, delayed := slowLeader(t, "/lib/vars", 300*time.Millisecond)
+	leader.SetObject("wg1", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	SetTimeouts(50*time.Millisecond, 0)
+
+	start := time.Now()
+	if _, err := GetDataObj(leader.URL, "wg1", token, "region", "globalvariable"); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected each attempt to time out after 50ms, the request took %s", elapsed)
+	}
+	if attempts := delayed.Load(); attempts != 5 {
+		t.Errorf("expected a timed out attempt to be retried, got %d attempt(s)", attempts)
+	}
+}
+
+func TestTransferTimeoutAppliesToLookupFiles(t *testing.T) {
+	leader, token, _ := slowLeader(t, "/system/lookups/hosts.csv/content", 200*time.Millisecond)
+	leader.SetLookup("wg1", "hosts.csv", []byte("host,owner\na,b\n"))
+	SetTimeouts(50*time.Millisecond, 5*time.Second)
+
+	lookupFile, err := DownloadLookupToFile(leader.URL, "wg1", token, "hosts.csv")
+	if err != nil {
+		t.Fatalf("expected a lookup download to get the longer transfer timeout, got %v", err)
+	}
+	os.Remove(lookupFile)
+}
+
+func TestCancelledRunStopsRetrying(t *testing.T) {
+	leader, token, delayed := slowLeader(t, "/lib/vars", time.Second)
+	runCtx, cancelRun := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelRun()
+	SetRunContext(runCtx)
+	defer SetRunContext(context.Background())
+
+	start := time.Now()
+	if _, err := GetDataObj(leader.URL, "wg1", token, "region", "globalvariable"); err == nil {
+		t.Fatal("expected the request to be cancelled with the run")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the in-flight request to be cancelled when the run timed out, it took %s", elapsed)
+	}
+	if attempts := delayed.Load(); attempts != 1 {
+		t.Errorf("expected no retries once the run was cancelled, got %d attempt(s)", attempts)
+	}
+}
@@ -0,0 +1,164 @@
+package functions
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TransportSettings controls how we connect to one leader
+type TransportSettings struct {
+	// PEM bundle of CAs to trust in addition to the system roots
+	CABundle string
+	// Client certificate and key for mTLS
+	ClientCert string
+	ClientKey  string
+	// Explicit HTTP(S) proxy, overrides HTTP_PROXY/HTTPS_PROXY
+	Proxy string
+	// "1.2" or "1.3", defaults to TLS 1.2
+	MinTLSVersion string
+	// Disables certificate verification, only for labs
+	InsecureSkipVerify bool
+}
+
+// TransportSettingsFromEnv reads transport settings for a leader from environment variables with the given prefix,
+// e.g. PROD_CA_BUNDLE, PROD_CLIENT_CERT, PROD_CLIENT_KEY, PROD_PROXY, PROD_TLS_MIN_VERSION and PROD_INSECURE_SKIP_VERIFY
+func TransportSettingsFromEnv(prefix string) TransportSettings {
+	return TransportSettings{
+		CABundle:           os.Getenv(prefix + "_CA_BUNDLE"),
+		ClientCert:         os.Getenv(prefix + "_CLIENT_CERT"),
+		ClientKey:          os.Getenv(prefix + "_CLIENT_KEY"),
+		Proxy:              os.Getenv(prefix + "_PROXY"),
+		MinTLSVersion:      os.Getenv(prefix + "_TLS_MIN_VERSION"),
+		InsecureSkipVerify: strings.EqualFold(os.Getenv(prefix+"_INSECURE_SKIP_VERIFY"), "true"),
+	}
+}
+
+var (
+	clientsMu sync.RWMutex
+	// HTTP clients configured per leader (scheme://host:port), anything not registered uses a default client
+	clients = map[string]leaderClient{}
+)
+
+type leaderClient struct {
+	settings TransportSettings
+	client   *http.Client
+}
+
+// leaderKey identifies the leader a url belongs to by its scheme, host and port, with the scheme's default port filled in
+func leaderKey(rawUrl string) (string, error) {
+	parsed, parseErr := url.Parse(rawUrl)
+	if parseErr != nil {
+		return "", fmt.Errorf("invalid leader url %s: %w", rawUrl, parseErr)
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme == "" || parsed.Hostname() == "" {
+		return "", fmt.Errorf("invalid leader url %s: expected scheme://host[:port]", rawUrl)
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	return scheme + "://" + strings.ToLower(parsed.Hostname()) + ":" + port, nil
+}
+
+// ConfigureTransport builds the HTTP client used for every request to the leader at baseUrl
+// Leaders configured more than once (e.g. template and target on the same url) must use the same settings.
+func ConfigureTransport(baseUrl string, settings TransportSettings) error {
+	key, keyErr := leaderKey(baseUrl)
+	if keyErr != nil {
+		return keyErr
+	}
+	clientsMu.RLock()
+	existing, configured := clients[key]
+	clientsMu.RUnlock()
+	if configured {
+		if existing.settings != settings {
+			return fmt.Errorf("leader %s is configured more than once with different transport settings", key)
+		}
+		return nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch settings.MinTLSVersion {
+	case "", "1.2":
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("invalid minimum TLS version %s for %s. Valid options are: 1.2 or 1.3", settings.MinTLSVersion, baseUrl)
+	}
+
+	if settings.CABundle != "" {
+		caPem, readErr := os.ReadFile(settings.CABundle)
+		if readErr != nil {
+			return fmt.Errorf("unable to read CA bundle %s: %w", settings.CABundle, readErr)
+		}
+		rootCAs, poolErr := x509.SystemCertPool()
+		if poolErr != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("no certificates could be loaded from CA bundle %s", settings.CABundle)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if settings.ClientCert != "" || settings.ClientKey != "" {
+		if settings.ClientCert == "" || settings.ClientKey == "" {
+			return fmt.Errorf("both a client certificate and client key are needed for mTLS to %s", baseUrl)
+		}
+		clientCert, certErr := tls.LoadX509KeyPair(settings.ClientCert, settings.ClientKey)
+		if certErr != nil {
+			return fmt.Errorf("unable to load client certificate %s: %w", settings.ClientCert, certErr)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	if settings.InsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+		log.Print("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+		log.Printf("!!! WARNING: TLS certificate verification is DISABLED for %s", baseUrl)
+		log.Print("!!! Credentials and config sent to this leader can be intercepted. Labs only.")
+		log.Print("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if settings.Proxy != "" {
+		proxyUrl, parseErr := url.Parse(settings.Proxy)
+		if parseErr != nil {
+			return fmt.Errorf("invalid proxy url %s: %w", settings.Proxy, parseErr)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	clients[key] = leaderClient{settings: settings, client: &http.Client{Transport: transport}}
+	return nil
+}
+
+// httpClient returns the client configured for the leader that requestUrl belongs to
+func httpClient(requestUrl string) *http.Client {
+	key, keyErr := leaderKey(requestUrl)
+	if keyErr != nil {
+		return &http.Client{}
+	}
+
+	clientsMu.RLock()
+	defer clientsMu.RUnlock()
+	if configured, found := clients[key]; found {
+		return configured.client
+	}
+	return &http.Client{}
+}
@@ -0,0 +1,51 @@
+package functions
+
+import (
+	"testing"
+)
+
+func TestLeaderKey(t *testing.T) {
+	tests := map[string]string{
+		"https://Leader.example.com":               "https://leader.example.com:443",
+		"https://leader.example.com:443/api/v1/m/": "https://leader.example.com:443",
+		"http://leader.example.com/api":            "http://leader.example.com:80",
+		"https://leader.example.com:900":           "https://leader.example.com:900",
+		"https://leader.example.com:9000/api/v1":   "https://leader.example.com:9000",
+	}
+	for rawUrl, want := range tests {
+		if got, err := leaderKey(rawUrl); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s (%v)", rawUrl, want, got, err)
+		}
+	}
+	if _, err := leaderKey("leader.example.com:9000"); err == nil {
+		t.Error("expected a url without a scheme to be rejected")
+	}
+}
+
+func TestHttpClientMatchesLeaderExactly(t *testing.T) {
+	if err := ConfigureTransport("https://transport-test:900", TransportSettings{MinTLSVersion: "1.3"}); err != nil {
+		t.Fatalf("unable to configure transport: %v", err)
+	}
+	configured := httpClient("https://transport-test:900/api/v1/auth/login")
+	if configured.Transport == nil {
+		t.Fatal("expected the configured client for the leader's own url")
+	}
+	if other := httpClient("https://transport-test:9000/api/v1/auth/login"); other == configured {
+		t.Error("a leader on port 9000 used the client configured for port 900")
+	}
+	if other := httpClient("http://transport-test:900/api"); other == configured {
+		t.Error("a plain http url used the client configured for https")
+	}
+}
+
+func TestConfigureTransportRejectsConflictingSettings(t *testing.T) {
+	if err := ConfigureTransport("https://transport-shared:9000", TransportSettings{Proxy: "http://proxy:3128"}); err != nil {
+		t.Fatalf("unable to configure transport: %v", err)
+	}
+	if err := ConfigureTransport("https://transport-shared:9000/", TransportSettings{Proxy: "http://proxy:3128"}); err != nil {
+		t.Errorf("expected the same settings for the same leader to be accepted, got %v", err)
+	}
+	if err := ConfigureTransport("https://transport-shared:9000", TransportSettings{InsecureSkipVerify: true}); err == nil {
+		t.Error("expected different settings for the same leader to be rejected instead of overwriting")
+	}
+}
@@ -0,0 +1,50 @@
+package functions
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VerifyReadBack compares a config that was pushed with what the leader returns for it afterwards. Fields the leader
+// added (usually defaults), values that only changed JSON type (e.g. "9000" stored as 9000) and values the leader read
+// back encrypted or masked are minor. Fields the leader dropped or changed are significant, they mean the object isn't
+// running the config that was pushed. That includes a credential read back as a different plaintext.
+func VerifyReadBack(sent []byte, readBack []byte, ignoreFields []string) ([]DiffChange, []DiffChange, error) {
+	changes, diffErr := DiffConfigJson(sent, readBack, ignoreFields)
+	if diffErr != nil {
+		return nil, nil, diffErr
+	}
+
+	var significant, minor []DiffChange
+	for _, change := range changes {
+		switch {
+		case change.Kind == DiffAdded:
+			minor = append(minor, change)
+		case change.Kind == DiffChanged && isScalar(change.Before) && isScalar(change.After) && fmt.Sprint(change.Before) == fmt.Sprint(change.After):
+			minor = append(minor, change)
+		case change.Kind == DiffChanged && (isEncryptedValue(change.After) || isMaskedValue(change.After)):
+			minor = append(minor, change)
+		default:
+			significant = append(significant, change)
+		}
+	}
+	return significant, minor, nil
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, float64, bool:
+		return true
+	default:
+		return false
+	}
+}
+
+// DescribeChanges lists changes on one line each as "path (kind)"
+func DescribeChanges(changes []DiffChange) string {
+	described := make([]string, 0, len(changes))
+	for _, change := range changes {
+		described = append(described, change.Path+" ("+change.Kind+")")
+	}
+	return strings.Join(described, ", ")
+}
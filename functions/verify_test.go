@@ -0,0 +1,63 @@
+package functions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVerifyReadBack(t *testing.T) {
+	sent := `{"host": "splunk", "port": "8088", "password": "hunter2", "auth": {"token": "t0k3n"}}`
+	tests := []struct {
+		name            string
+		readBack        string
+		ignore          []string
+		wantSignificant []string
+		wantMinor       []string
+	}{
+		{
+			name:     "stored as sent",
+			readBack: sent,
+		},
+		{
+			name:      "default added and port stored as a number",
+			readBack:  `{"host": "splunk", "port": 8088, "password": "hunter2", "auth": {"token": "t0k3n"}, "compress": true}`,
+			wantMinor: []string{"compress", "port"},
+		},
+		{
+			name:      "credentials encrypted and masked",
+			readBack:  `{"host": "splunk", "port": "8088", "password": "#42:ciphertext", "auth": {"token": "*****"}}`,
+			wantMinor: []string{"auth.token", "password"},
+		},
+		{
+			name:            "credential stored as a different plaintext",
+			readBack:        `{"host": "splunk", "port": "8088", "password": "swordfish", "auth": {"token": "t0k3n"}}`,
+			wantSignificant: []string{"password"},
+		},
+		{
+			name:            "field dropped",
+			readBack:        `{"port": "8088", "password": "hunter2", "auth": {"token": "t0k3n"}}`,
+			wantSignificant: []string{"host"},
+		},
+		{
+			name:     "field changed but ignored",
+			readBack: `{"host": "other", "port": "8088", "password": "hunter2", "auth": {"token": "t0k3n"}}`,
+			ignore:   []string{"host"},
+		},
+	}
+	paths := func(changes []DiffChange) []string {
+		var changed []string
+		for _, change := range changes {
+			changed = append(changed, change.Path)
+		}
+		return changed
+	}
+	for _, test := range tests {
+		significant, minor, err := VerifyReadBack([]byte(sent), []byte(test.readBack), test.ignore)
+		if err != nil {
+			t.Fatalf("%s: unable to verify: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(paths(significant), test.wantSignificant) || !reflect.DeepEqual(paths(minor), test.wantMinor) {
+			t.Errorf("%s: expected significant %v and minor %v, got %v and %v", test.name, test.wantSignificant, test.wantMinor, significant, minor)
+		}
+	}
+}
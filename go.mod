@@ -2,4 +2,12 @@ module criblPatching
 
 go 1.24.4
 
-require github.com/joho/godotenv v1.5.1 // indirect
+require (
+	github.com/dop251/goja v0.0.0-20260106131823-651366fbe6e3
+	github.com/joho/godotenv v1.5.1
+)
+
+require (
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	golang.org/x/text v0.34.0 // indirect
+)
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"criblPatching/functions"
 	"criblPatching/vars"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,118 +27,780 @@ import (
 
 // Worker Group List for what is being targetted
 
-func replicateConfigPatch(origBaseApiUrl string, origWorkerGroup string, origToken string, targetBaseApiUrl string, targetWorkerGroups []string, targetToken string, objType string, objId string) {
+// replicateOptions holds the optional behaviour toggled by flags that isn't needed to identify the object being copied
+type replicateOptions struct {
+	// Sample events and the expected (golden) output used to preview a pipeline before it is pushed
+	previewSample   string
+	previewExpected string
+	// Rules checked against the object before it is pushed, with levels that depend on env
+	policy *functions.Policy
+	env    string
+	// Collector jobs are created/updated with their schedule turned off
+	deployDisabled bool
+	// Template notification target ids mapped to the target environment's, nil to drop notifications attached to objects
+	notificationTargets functions.NotificationTargetMap
+	// Template object ids copied under a different id on the target, and rewritten wherever other objects refer to them
+	idMap functions.IdMap
+	// Source of secret values for the target env, nil to push secret references unchanged
+	secrets *functions.SecretStore
+	// Certificates expiring within this window are warned about, private keys are only copied when allowed
+	certExpiryWarn   time.Duration
+	allowPrivateKeys bool
+	// Extra checks for CSV lookups, nil for the basic header/column count/UTF-8 checks only
+	lookupRules *functions.LookupCsvRules
+	// Format to print the differences between the template and each target worker group's object in, "" for none
+	diffFormat string
+	// Signed plan file to write instead of changing anything, applied later with the apply command
+	planOut        string
+	planSigningKey string
+	// Local record of what was deployed where, nil to not record
+	state *functions.StateStore
+	// Staged rollout: the first worker group is a canary and the rest follow in waves of waveSize (0 for one wave). Each
+	// wave must pass the health gates before the next starts, and changed groups can be restored if one fails.
+	canary         bool
+	waveSize       int
+	healthWait     time.Duration
+	maxErrorRate   float64
+	rollbackOnFail bool
+	// Read each object back after it is pushed and fail the worker group if the leader didn't store what was sent.
+	// verifyIgnore are paths that are expected to differ.
+	verify       bool
+	verifyIgnore []string
+	// Update worker groups even if their object was edited by someone else after the run started
+	force bool
+	// Locks each target worker group for the duration of the changes, nil to not lock
+	locker *functions.RunLocker
+	// Cancelled when the operator asks the run to stop, no new worker groups are started after that
+	stop context.Context
+}
+
+func (opts replicateOptions) stopRequested() bool {
+	return opts.stop != nil && opts.stop.Err() != nil
+}
+
+// prepareAndCheck prepares the template's config for the target worker groups, then runs the pre-push gates on the
+// result so they check what is actually pushed, e.g. a policy on conf.output sees the id it is remapped to
+func prepareAndCheck(origBaseApiUrl string, origWorkerGroup string, origToken string, objType string, objId string, objectConfigBytes []byte, opts replicateOptions) ([]byte, map[string]functions.CribConfig, error) {
+	preparedBytes, objectSecrets, prepareErr := prepareForTarget(objType, objId, objectConfigBytes, opts)
+	if prepareErr != nil {
+		return nil, nil, fmt.Errorf("unable to prepare it for the target worker groups: %w", prepareErr)
+	}
+	if gateErr := runPreGates(origBaseApiUrl, origWorkerGroup, origToken, objType, objId, preparedBytes, opts); gateErr != nil {
+		return nil, nil, gateErr
+	}
+	return preparedBytes, objectSecrets, nil
+}
+
+// runPreGates runs the checks that must pass against the config prepared for the targets before anything is pushed.
+// The pipeline preview can only run on the template leader, so it runs the template's pipeline.
+func runPreGates(origBaseApiUrl string, origWorkerGroup string, origToken string, objType string, objId string, objectConfigBytes []byte, opts replicateOptions) error {
+	if validateErr := functions.ValidateTypedConfig(objType, objectConfigBytes); validateErr != nil {
+		return validateErr
+	}
+
+	if opts.policy != nil {
+		var objectConfig functions.CribConfig
+		if unMarshErr := json.Unmarshal(objectConfigBytes, &objectConfig); unMarshErr != nil {
+			return fmt.Errorf("unable to read %s '%s' for policy checks: %w", objType, objId, unMarshErr)
+		}
+		violations := opts.policy.Evaluate(objType, opts.env, objectConfig)
+		for _, violation := range violations {
+			log.Printf("Policy %s", violation)
+		}
+		if functions.HasBlockingViolation(violations) {
+			return fmt.Errorf("%s '%s' is blocked by policy for env %s", objType, objId, opts.env)
+		}
+	}
+
+	if strings.ToLower(objType) == "certificate" {
+		certWarnings, certErr := functions.CheckCertificate(objectConfigBytes, opts.certExpiryWarn, opts.allowPrivateKeys)
+		if certErr != nil {
+			return certErr
+		}
+		for _, certWarning := range certWarnings {
+			log.Printf("Warning: certificate '%s' %s", objId, certWarning)
+		}
+	}
+
+	if strings.ToLower(objType) == "pipeline" && opts.previewSample != "" {
+		previewErr := functions.ValidatePipelinePreview(origBaseApiUrl, origWorkerGroup, origToken, objId, opts.previewSample, opts.previewExpected)
+		if previewErr != nil {
+			return fmt.Errorf("pipeline preview validation failed: %w", previewErr)
+		}
+		log.Printf("Pipeline '%s' preview output matches expected events in %s", objId, opts.previewExpected)
+	}
+	return nil
+}
+
+// prepareForTarget adjusts the template's config before it is sent to the target worker groups. It also returns the
+// secrets the object refers to, which need to exist in each worker group before the object is pushed.
+func prepareForTarget(objType string, objId string, objectConfigBytes []byte, opts replicateOptions) ([]byte, map[string]functions.CribConfig, error) {
+	if strings.ToLower(objType) == "collector" && opts.deployDisabled {
+		disabledConfig, disabled, disableErr := functions.DisableCollectorSchedule(objectConfigBytes)
+		if disableErr != nil {
+			return nil, nil, disableErr
+		}
+		if disabled {
+			log.Printf("Collector '%s' will be deployed with its schedule disabled", objId)
+		} else {
+			log.Printf("Collector '%s' has no schedule to disable, it only runs when started", objId)
+		}
+		objectConfigBytes = disabledConfig
+	}
+
+	remappedConfig, remapErr := functions.RemapNotifications(objType, objectConfigBytes, opts.notificationTargets)
+	if remapErr != nil {
+		return nil, nil, remapErr
+	}
+
+	remappedConfig, idRewrites, idMapErr := functions.RemapIds(objType, remappedConfig, opts.idMap)
+	if idMapErr != nil {
+		return nil, nil, idMapErr
+	}
+	for _, rewrite := range idRewrites {
+		log.Printf("Remapped id in '%s' for the target: %s", objId, rewrite)
+	}
+
+	return prepareSecrets(objId, remappedConfig, opts)
+}
+
+// prepareSecrets resolves the secrets an object refers to and replaces values encrypted with the template leader's key
+func prepareSecrets(objId string, objectConfigBytes []byte, opts replicateOptions) ([]byte, map[string]functions.CribConfig, error) {
+	var objectConfig functions.CribConfig
+	if unMarshErr := json.Unmarshal(objectConfigBytes, &objectConfig); unMarshErr != nil {
+		return nil, nil, fmt.Errorf("unable to read config for secret detection: %w", unMarshErr)
+	}
+
+	secretRefs, encryptedPaths := functions.FindSecretReferences(objectConfig)
+	if opts.secrets == nil {
+		for _, ref := range secretRefs {
+			log.Printf("Warning: '%s' refers to secret '%s' at %s, it must already exist on each target worker group (use -secrets to manage it)", objId, ref.Name, ref.Path)
+		}
+		for _, path := range encryptedPaths {
+			log.Printf("Warning: '%s' has a value encrypted by the template leader at %s, it will not decrypt on another leader (use -secrets to replace it)", objId, path)
+		}
+		return objectConfigBytes, nil, nil
+	}
+
+	if replaceErr := opts.secrets.ReplaceEncryptedFields(objId, objectConfig, encryptedPaths); replaceErr != nil {
+		return nil, nil, replaceErr
+	}
+	resolvedSecrets, resolveErr := opts.secrets.ResolveSecretRefs(secretRefs)
+	if resolveErr != nil {
+		return nil, nil, resolveErr
+	}
+
+	if len(encryptedPaths) == 0 {
+		return objectConfigBytes, resolvedSecrets, nil
+	}
+	replacedConfig, marshErr := json.Marshal(objectConfig)
+	if marshErr != nil {
+		return nil, nil, fmt.Errorf("unable to format config after replacing encrypted fields: %w", marshErr)
+	}
+	return replacedConfig, resolvedSecrets, nil
+}
+
+// ensureSecrets creates or updates the secrets an object refers to on one worker group
+func ensureSecrets(targetBaseApiUrl string, workerGroup string, targetToken string, secrets map[string]functions.CribConfig) error {
+	for name, secret := range secrets {
+		if secretErr := functions.EnsureSecret(targetBaseApiUrl, workerGroup, targetToken, name, secret); secretErr != nil {
+			return secretErr
+		}
+		log.Printf("Secret '%s' is up to date on worker group '%s'", name, workerGroup)
+	}
+	return nil
+}
+
+// showTargetDiff prints what an update is about to change on a worker group. It is informational only, so a failure to
+// read the target's current object is logged rather than stopping the update.
+func showTargetDiff(targetBaseApiUrl string, workerGroup string, targetToken string, objType string, objId string, objectConfigBytes []byte, diffFormat string) {
+	currentConfigBytes, getErr := functions.GetDataObj(targetBaseApiUrl, workerGroup, targetToken, objId, objType)
+	if getErr != nil {
+		log.Printf("Unable to show differences for %s '%s' on worker group '%s': %v", objType, objId, workerGroup, getErr)
+		return
+	}
+	changes, rendered, diffErr := renderTargetDiff(currentConfigBytes, objectConfigBytes, workerGroup, "template (to be pushed)", diffFormat)
+	if diffErr != nil {
+		log.Printf("Unable to show differences for %s '%s' on worker group '%s': %v", objType, objId, workerGroup, diffErr)
+		return
+	}
+	log.Printf("%d difference(s) for %s '%s' on worker group '%s':", len(changes), objType, objId, workerGroup)
+	fmt.Print(rendered)
+}
+
+// renderTargetDiff diffs a worker group's current object against what is about to be sent to it. The config sent can
+// hold plaintext credentials from the secrets store and the diff ends up in CI logs and PR comments, so they are redacted.
+func renderTargetDiff(currentConfigBytes []byte, objectConfigBytes []byte, workerGroup string, afterLabel string, diffFormat string) ([]functions.DiffChange, string, error) {
+	changes, diffErr := functions.DiffConfigJson(currentConfigBytes, objectConfigBytes, nil)
+	if diffErr != nil {
+		return nil, "", diffErr
+	}
+	return changes, functions.RenderDiff(functions.RedactChanges(changes), "worker group '"+workerGroup+"' (current)", afterLabel, diffFormat), nil
+}
+
+func replicateConfigPatch(origBaseApiUrl string, origWorkerGroup string, origToken string, targetBaseApiUrl string, targetWorkerGroups []string, targetToken string, objType string, objId string, opts replicateOptions) *runSummary {
+	return replicateConfig("update", origBaseApiUrl, origWorkerGroup, origToken, targetBaseApiUrl, targetWorkerGroups, targetToken, objType, objId, opts)
+}
+
+func replicateConfigCreate(origBaseApiUrl string, origWorkerGroup string, origToken string, targetBaseApiUrl string, targetWorkerGroups []string, targetToken string, objType string, objId string, opts replicateOptions) *runSummary {
+	return replicateConfig("create", origBaseApiUrl, origWorkerGroup, origToken, targetBaseApiUrl, targetWorkerGroups, targetToken, objType, objId, opts)
+}
 
-	switch strings.ToLower(objType) {
-	case "source", "destination", "pipeline", "globalvariable":
+// replicateConfig copies one object from the template worker group to each target worker group, creating or updating it
+// depending on action. Worker groups are done one at a time and the loop stops early if the run is interrupted.
+func replicateConfig(action string, origBaseApiUrl string, origWorkerGroup string, origToken string, targetBaseApiUrl string, targetWorkerGroups []string, targetToken string, objType string, objId string, opts replicateOptions) *runSummary {
+	verb, pastVerb := "updating", "updated"
+	if action == "create" {
+		verb, pastVerb = "creating", "created"
+	}
+
+	summary := newRunSummary(targetWorkerGroups)
+	// The object's id on the target worker groups, see -idMap
+	targetId := opts.idMap.TargetId(objType, objId)
+	if targetId != objId {
+		log.Printf("%s '%s' will be copied to the target worker groups as '%s'", objType, objId, targetId)
+	}
+
+	// Temp files removed when the run ends. log.Fatalf skips deferred calls, so once a temp file exists fatal errors
+	// go through abortf to remove it first.
+	var tempFiles []string
+	defer func() {
+		for _, tempFile := range tempFiles {
+			os.Remove(tempFile)
+		}
+	}()
+	abortf := func(format string, args ...interface{}) {
+		for _, tempFile := range tempFiles {
+			os.Remove(tempFile)
+		}
+		log.Fatalf(format, args...)
+	}
+
+	var (
+		pushToGroup func(workerGroup string) error
+		contentHash string
+		hashErr     error
+		// Each worker group's config before it was changed, nil if the object didn't exist, for -rollbackOnFail
+		previousConfigs = map[string][]byte{}
+	)
+
+	switch {
+	case functions.IsDataObjType(objType):
 		objectConfigBytes, getDataErr := functions.GetDataObj(origBaseApiUrl, origWorkerGroup, origToken, objId, objType)
 		if getDataErr != nil {
 			log.Fatalf("Fatal error encountered with initial GET for %s '%s': %v", objType, objId, getDataErr)
 		}
-		for _, workerGroup := range targetWorkerGroups {
-			updateErr := functions.UpdateDataObj(targetBaseApiUrl, workerGroup, targetToken, objId, objectConfigBytes, objType)
-			if updateErr != nil {
-				log.Printf("Skipped updating %s '%s' on worker group '%s' due to following error during patching: %v", objType, objId, workerGroup, updateErr)
-			} else {
-				log.Printf("Successfully updated %s '%s' on worker group %s", objType, objId, workerGroup)
-			}
+		objectConfigBytes, objectSecrets, checkErr := prepareAndCheck(origBaseApiUrl, origWorkerGroup, origToken, objType, objId, objectConfigBytes, opts)
+		if checkErr != nil {
+			log.Fatalf("Aborting %s '%s' before any worker group was changed: %v", objType, objId, checkErr)
 		}
-	case "lookup":
-		if strings.HasSuffix(objId, ".csv") {
-			objectContent, getLookupErr := functions.GetLookupContent(origBaseApiUrl, origWorkerGroup, origToken, objId)
-			if getLookupErr != nil {
-				log.Fatalf("Fatal error encountered with initial GET for %s '%s': %v", objType, objId, getLookupErr)
-			}
+		// Without a mapping the template's notification target ids are pushed, they must name the same targets here
+		if strings.ToLower(objType) == "notification" && opts.notificationTargets == nil {
 			for _, workerGroup := range targetWorkerGroups {
-				objectUpload, uploadErr := functions.UploadLookup(targetBaseApiUrl, workerGroup, targetToken, objId, objectContent)
-
-				if uploadErr != nil {
-					log.Printf("Skipped updating %s '%s' on worker group '%s' due to following error during PUT: %v", objType, objId, workerGroup, uploadErr)
-					continue
+				if targetErr := functions.CheckNotificationTargets(targetBaseApiUrl, workerGroup, targetToken, objectConfigBytes); targetErr != nil {
+					log.Fatalf("Aborting %s '%s' before any worker group was changed: %v", objType, objId, targetErr)
 				}
+			}
+		}
+		if opts.planOut != "" {
+			return planConfig(action, targetBaseApiUrl, targetWorkerGroups, targetToken, objType, targetId, objectConfigBytes, opts)
+		}
+		contentHash, hashErr = functions.ConfigHash(objectConfigBytes)
+		// Updates only overwrite what was on each worker group when the run started, see checkConcurrentEdit
+		var startHashes map[string]targetSnapshot
+		if action == "update" && !opts.force {
+			startHashes = snapshotTargetHashes(targetBaseApiUrl, targetWorkerGroups, targetToken, objType, targetId)
+		}
 
-				patchErr := functions.PatchLookup(targetBaseApiUrl, workerGroup, targetToken, objId, objectUpload)
-				if patchErr != nil {
-					log.Printf("Skipped updating %s '%s' on worker group '%s' due to following error during PATCH: %v", objType, objId, workerGroup, patchErr)
-				} else {
-					log.Printf("Successfully updated %s '%s' on worker group '%s'", objType, objId, workerGroup)
+		pushToGroup = func(workerGroup string) error {
+			if startHashes != nil || opts.rollbackOnFail {
+				currentHash, currentConfig, stateErr := targetState(targetBaseApiUrl, workerGroup, targetToken, objType, targetId)
+				if stateErr != nil {
+					return fmt.Errorf("unable to read its current config before changing it: %w", stateErr)
+				}
+				if startHashes != nil {
+					if conflictErr := checkConcurrentEdit(startHashes[workerGroup], currentHash); conflictErr != nil {
+						return conflictErr
+					}
 				}
+				previousConfigs[workerGroup] = currentConfig
 			}
-		} else {
-			fmt.Println("Error: Expected object Id for lookup to end with '.csv', invalid lookup submitted")
+			// Only once the group is known to be safe to change, a conflicting group keeps its old secrets too
+			if secretErr := ensureSecrets(targetBaseApiUrl, workerGroup, targetToken, objectSecrets); secretErr != nil {
+				return fmt.Errorf("error saving its secrets: %w", secretErr)
+			}
+			if action == "update" && opts.diffFormat != "" {
+				showTargetDiff(targetBaseApiUrl, workerGroup, targetToken, objType, targetId, objectConfigBytes, opts.diffFormat)
+			}
+			var pushErr error
+			if action == "create" {
+				pushErr = functions.CreateDataObj(targetBaseApiUrl, workerGroup, targetToken, targetId, objectConfigBytes, objType)
+			} else {
+				pushErr = functions.UpdateDataObj(targetBaseApiUrl, workerGroup, targetToken, targetId, objectConfigBytes, objType)
+			}
+			if pushErr != nil || !opts.verify {
+				return pushErr
+			}
+			return verifyReadBack(targetBaseApiUrl, workerGroup, targetToken, objType, targetId, objectConfigBytes, opts.verifyIgnore)
+		}
+	case strings.ToLower(objType) == "lookup":
+		if opts.planOut != "" {
+			log.Fatal("-planOut is only supported for JSON config objects, not lookups")
+		}
+		if opts.rollbackOnFail {
+			log.Fatal("-rollbackOnFail is only supported for JSON config objects, not lookups")
+		}
+		if !functions.IsSupportedLookup(objId) {
+			fmt.Println("Error: Expected object Id for lookup to end with '.csv', '.csv.gz' or '.mmdb', invalid lookup submitted")
+			return summary
+		}
+		lookupFile, getLookupErr := functions.DownloadLookupToFile(origBaseApiUrl, origWorkerGroup, origToken, objId)
+		if getLookupErr != nil {
+			log.Fatalf("Fatal error encountered with initial GET for %s '%s': %v", objType, objId, getLookupErr)
+		}
+		tempFiles = append(tempFiles, lookupFile)
+		if csvErr := functions.ValidateLookupCsvFile(objId, lookupFile, opts.lookupRules); csvErr != nil {
+			abortf("Aborting %s '%s' before any worker group was changed: %v", objType, objId, csvErr)
 		}
+		contentHash, hashErr = functions.FileHash(lookupFile)
 
+		pushToGroup = func(workerGroup string) error {
+			objectUpload, uploadErr := functions.UploadLookupFile(targetBaseApiUrl, workerGroup, targetToken, targetId, lookupFile, contentHash)
+			if uploadErr != nil {
+				return fmt.Errorf("error during PUT: %w", uploadErr)
+			}
+			if action == "create" {
+				return functions.CreateLookup(targetBaseApiUrl, workerGroup, targetToken, targetId, objectUpload)
+			}
+			return functions.PatchLookup(targetBaseApiUrl, workerGroup, targetToken, targetId, objectUpload)
+		}
 	default:
 		log.Fatalf("(%s) not valid object type, ignored", objType)
 	}
-}
 
-func replicateConfigCreate(origBaseApiUrl string, origWorkerGroup string, origToken string, targetBaseApiUrl string, targetWorkerGroups []string, targetToken string, objType string, objId string) {
+	if hashErr != nil {
+		abortf("Fatal error encountered hashing %s '%s': %v", objType, objId, hashErr)
+	}
 
-	switch strings.ToLower(objType) {
-	case "source", "destination", "pipeline", "globalvariable":
-		objectConfigBytes, getDataErr := functions.GetDataObj(origBaseApiUrl, origWorkerGroup, origToken, objId, objType)
-		if getDataErr != nil {
-			log.Fatalf("Fatal error encountered with initial GET for %s '%s': %v", objType, objId, getDataErr)
+	if opts.locker != nil {
+		if lockErr := opts.locker.Acquire(opts.env, targetWorkerGroups); lockErr != nil {
+			abortf("Aborting %s '%s' before any worker group was changed: %v", objType, objId, lockErr)
 		}
-		for _, workerGroup := range targetWorkerGroups {
-			updateErr := functions.CreateDataObj(targetBaseApiUrl, workerGroup, targetToken, objId, objectConfigBytes, objType)
-			if updateErr != nil {
-				log.Printf("Skipped creating %s '%s' on worker group '%s' due to the following error during creating: %v", objType, objId, workerGroup, updateErr)
-			} else {
-				log.Printf("Successfully created %s '%s' on worker group %s", objType, objId, workerGroup)
+		defer releaseLocks(opts.locker)
+	}
+
+	waves := rolloutWaves(targetWorkerGroups, opts)
+	for waveNum, wave := range waves {
+		if opts.stopRequested() {
+			log.Printf("Stop requested, not starting %s '%s' on remaining worker groups", objType, objId)
+			break
+		}
+
+		var baseline map[string]functions.GroupHealth
+		if opts.canary {
+			log.Printf("Starting wave %d/%d of %s '%s': %s", waveNum+1, len(waves), objType, objId, strings.Join(wave, ", "))
+			var healthErr error
+			if baseline, healthErr = waveHealth(targetBaseApiUrl, targetToken, wave); healthErr != nil {
+				log.Printf("Rollout of %s '%s' stopped before wave %d/%d, its health can't be checked: %v", objType, objId, waveNum+1, len(waves), healthErr)
+				summary.halt()
+				break
 			}
 		}
-	case "lookup":
-		if strings.HasSuffix(objId, ".csv") {
-			objectContent, getLookupErr := functions.GetLookupContent(origBaseApiUrl, origWorkerGroup, origToken, objId)
-			if getLookupErr != nil {
-				log.Fatalf("Fatal error encountered with initial GET for %s '%s': %v", objType, objId, getLookupErr)
+
+		for _, workerGroup := range wave {
+			if opts.stopRequested() {
+				log.Printf("Stop requested, not starting %s '%s' on remaining worker groups", objType, objId)
+				break
 			}
-			for _, workerGroup := range targetWorkerGroups {
-				objectUpload, uploadErr := functions.UploadLookup(targetBaseApiUrl, workerGroup, targetToken, objId, objectContent)
 
-				if uploadErr != nil {
-					log.Printf("Skipped creating %s '%s' on worker group '%s' due to the following error during PUT: %v", objType, objId, workerGroup, uploadErr)
-					continue
-				}
+			if pushErr := pushToGroup(workerGroup); pushErr != nil {
+				log.Printf("Skipped %s %s '%s' on worker group '%s' due to the following error: %v", verb, objType, objId, workerGroup, pushErr)
+				summary.fail(workerGroup, pushErr)
+			} else {
+				log.Printf("Successfully %s %s '%s' on worker group '%s'", pastVerb, objType, objId, workerGroup)
+				summary.done(workerGroup)
+				recordState(opts.state, opts.env, targetBaseApiUrl, workerGroup, objType, targetId, contentHash, pastVerb)
+			}
+		}
 
-				patchErr := functions.CreateLookup(targetBaseApiUrl, workerGroup, targetToken, objId, objectUpload)
-				if patchErr != nil {
-					log.Printf("Skipped creating %s '%s' on worker group '%s' due to the following error during PATCH: %v", objType, objId, workerGroup, patchErr)
-				} else {
-					log.Printf("Successfully created %s '%s' on worker group '%s'", objType, objId, workerGroup)
-				}
+		if !opts.canary {
+			continue
+		}
+		deployMessage := fmt.Sprintf("criblPatching: %s %s '%s', wave %d/%d", action, objType, targetId, waveNum+1, len(waves))
+		if gateErr := checkWaveGates(targetBaseApiUrl, targetToken, wave, baseline, summary, deployMessage, opts); gateErr != nil {
+			log.Printf("Rollout of %s '%s' stopped, wave %d/%d failed its health gates: %v", objType, objId, waveNum+1, len(waves), gateErr)
+			summary.halt()
+			if opts.rollbackOnFail {
+				rollbackGroups(targetBaseApiUrl, targetToken, objType, targetId, previousConfigs, summary, fmt.Sprintf("criblPatching: roll back %s '%s'", objType, targetId), opts)
 			}
+			break
+		}
+		log.Printf("Wave %d/%d of %s '%s' passed its health gates", waveNum+1, len(waves), objType, objId)
+	}
+
+	summary.print(objType, objId)
+	return summary
+}
+
+// targetSnapshot is an object's ConfigHash on a worker group at the start of a run
+type targetSnapshot struct {
+	hash string
+	err  error
+}
+
+func snapshotTargetHashes(targetBaseApiUrl string, targetWorkerGroups []string, targetToken string, objType string, objId string) map[string]targetSnapshot {
+	snapshots := map[string]targetSnapshot{}
+	for _, workerGroup := range targetWorkerGroups {
+		currentHash, _, stateErr := targetState(targetBaseApiUrl, workerGroup, targetToken, objType, objId)
+		snapshots[workerGroup] = targetSnapshot{hash: currentHash, err: stateErr}
+	}
+	return snapshots
+}
+
+// checkConcurrentEdit returns a conflict error if the object changed on the worker group since the run started, e.g.
+// someone edited it in the UI during a long rollout. Their edit is kept rather than silently overwritten.
+func checkConcurrentEdit(start targetSnapshot, currentHash string) error {
+	if start.err != nil {
+		return fmt.Errorf("unable to read its config when the run started, so a concurrent edit can't be ruled out: %w", start.err)
+	}
+	if currentHash != start.hash {
+		return fmt.Errorf("CONFLICT: it was changed on the worker group after this run started (%s then, %s now). Not overwriting it, review the change and run again or use -force", describeHash(start.hash), describeHash(currentHash))
+	}
+	return nil
+}
+
+// verifyReadBack reads an object back after it was pushed and returns an error if the leader dropped or changed any of
+// the fields that were sent. Fields the leader only added or normalized are logged.
+func verifyReadBack(targetBaseApiUrl string, workerGroup string, targetToken string, objType string, objId string, sentConfigBytes []byte, ignoreFields []string) error {
+	readBackBytes, getErr := functions.GetDataObj(targetBaseApiUrl, workerGroup, targetToken, objId, objType)
+	if getErr != nil {
+		return fmt.Errorf("it was pushed but could not be read back to verify it: %w", getErr)
+	}
+	significant, minor, verifyErr := functions.VerifyReadBack(sentConfigBytes, readBackBytes, ignoreFields)
+	if verifyErr != nil {
+		return fmt.Errorf("it was pushed but could not be verified: %w", verifyErr)
+	}
+	if len(minor) > 0 {
+		log.Printf("Worker group '%s' normalized %s '%s' on save: %s", workerGroup, objType, objId, functions.DescribeChanges(minor))
+	}
+	if len(significant) > 0 {
+		fmt.Print(functions.RenderDiff(functions.RedactChanges(significant), "pushed", "stored on worker group '"+workerGroup+"'", functions.DiffFormatPlain))
+		return fmt.Errorf("it was pushed but the leader stored it with %d field(s) dropped or changed: %s", len(significant), functions.DescribeChanges(significant))
+	}
+	return nil
+}
+
+// splitFieldPaths splits a comma separated list of config paths, e.g. -verifyIgnore or -ignore
+func splitFieldPaths(list string) []string {
+	var paths []string
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func releaseLocks(locker *functions.RunLocker) {
+	for _, releaseErr := range locker.Release() {
+		log.Printf("Warning: unable to release lock, it will expire on its own: %v", releaseErr)
+	}
+}
+
+// rolloutWaves splits the worker groups into the waves they are changed in. Without -canary every group is one wave.
+func rolloutWaves(workerGroups []string, opts replicateOptions) [][]string {
+	if !opts.canary || len(workerGroups) == 0 {
+		return [][]string{workerGroups}
+	}
+	waves := [][]string{workerGroups[:1]}
+	remaining := workerGroups[1:]
+	for len(remaining) > 0 {
+		size := len(remaining)
+		if opts.waveSize > 0 && opts.waveSize < size {
+			size = opts.waveSize
+		}
+		waves = append(waves, remaining[:size])
+		remaining = remaining[size:]
+	}
+	return waves
+}
+
+func waveHealth(targetBaseApiUrl string, targetToken string, wave []string) (map[string]functions.GroupHealth, error) {
+	health := map[string]functions.GroupHealth{}
+	for _, workerGroup := range wave {
+		groupHealth, healthErr := functions.GetGroupHealth(targetBaseApiUrl, workerGroup, targetToken)
+		if healthErr != nil {
+			return nil, healthErr
+		}
+		health[workerGroup] = groupHealth
+	}
+	return health, nil
+}
+
+// checkWaveGates deploys the wave's changed groups, waits for them to settle, then compares each one's health to its
+// baseline. Workers only run deployed config, so without the deploy the gate would measure the config from before the
+// change. A group that failed to update also fails the gate, since the next wave would likely fail the same way.
+func checkWaveGates(targetBaseApiUrl string, targetToken string, wave []string, baseline map[string]functions.GroupHealth, summary *runSummary, deployMessage string, opts replicateOptions) error {
+	var changed []string
+	for _, workerGroup := range wave {
+		switch status, pushErr := summary.result(workerGroup); status {
+		case groupFailed:
+			return fmt.Errorf("worker group %s failed to update: %w", workerGroup, pushErr)
+		case groupDone:
+			changed = append(changed, workerGroup)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	for _, workerGroup := range changed {
+		commit, deployErr := functions.CommitAndDeploy(targetBaseApiUrl, workerGroup, targetToken, deployMessage)
+		if deployErr != nil {
+			return deployErr
+		}
+		log.Printf("Deployed commit %s to worker group '%s'", commit, workerGroup)
+	}
+
+	log.Printf("Waiting %s before checking the health of %s", opts.healthWait, strings.Join(changed, ", "))
+	var stopped <-chan struct{}
+	if opts.stop != nil {
+		stopped = opts.stop.Done()
+	}
+	select {
+	case <-time.After(opts.healthWait):
+	case <-stopped:
+		// The loop stops at the next wave, a stop isn't a reason to roll back
+		return nil
+	}
+
+	after, healthErr := waveHealth(targetBaseApiUrl, targetToken, changed)
+	if healthErr != nil {
+		return healthErr
+	}
+	for _, workerGroup := range changed {
+		if gateErr := functions.CheckHealthGate(baseline[workerGroup], after[workerGroup], opts.maxErrorRate); gateErr != nil {
+			return gateErr
+		}
+	}
+	return nil
+}
+
+// rollbackGroups restores every worker group changed in the run to the config it had before, deleting the object
+// where it didn't exist, and deploys the restored config since the change was deployed by the health gates
+func rollbackGroups(targetBaseApiUrl string, targetToken string, objType string, objId string, previousConfigs map[string][]byte, summary *runSummary, deployMessage string, opts replicateOptions) {
+	for _, workerGroup := range summary.groups(groupDone) {
+		previousConfig := previousConfigs[workerGroup]
+		var (
+			rollbackErr  error
+			previousHash string
+		)
+		if previousConfig == nil {
+			rollbackErr = functions.DeleteDataObj(targetBaseApiUrl, workerGroup, targetToken, objId, objType)
 		} else {
-			fmt.Println("Error: Expected object Id for lookup to end with '.csv', invalid lookup submitted")
+			rollbackErr = functions.UpdateDataObj(targetBaseApiUrl, workerGroup, targetToken, objId, previousConfig, objType)
+			previousHash, _ = functions.ConfigHash(previousConfig)
+		}
+		if rollbackErr != nil {
+			log.Printf("Rollback of %s '%s' on worker group '%s' FAILED, it needs restoring by hand: %v", objType, objId, workerGroup, rollbackErr)
+			continue
 		}
+		log.Printf("Rolled back %s '%s' on worker group '%s'", objType, objId, workerGroup)
+		summary.rolledBack(workerGroup)
+		recordState(opts.state, opts.env, targetBaseApiUrl, workerGroup, objType, objId, previousHash, "rolled back")
+		if _, deployErr := functions.CommitAndDeploy(targetBaseApiUrl, workerGroup, targetToken, deployMessage); deployErr != nil {
+			log.Printf("Rollback of %s '%s' on worker group '%s' is saved on the leader but its workers still run the change, deploy it by hand: %v", objType, objId, workerGroup, deployErr)
+		}
+	}
+}
 
-	default:
-		log.Fatalf("(%s) not valid object type, ignored", objType)
+// recordState adds a successful deployment to the state store. The change has already been made, so failing to record it
+// is only logged.
+func recordState(state *functions.StateStore, env string, targetBaseApiUrl string, workerGroup string, objType string, objId string, contentHash string, result string) {
+	if state == nil {
+		return
+	}
+	entry := functions.StateEntry{
+		Env:         env,
+		TargetUrl:   targetBaseApiUrl,
+		WorkerGroup: workerGroup,
+		ObjType:     strings.ToLower(objType),
+		ObjId:       objId,
+		ContentHash: contentHash,
+		Result:      result,
 	}
+	if recordErr := state.Record(entry); recordErr != nil {
+		log.Printf("Warning: %s '%s' on worker group '%s' was %s but could not be recorded in the state file: %v", objType, objId, workerGroup, result, recordErr)
+	}
+}
+
+// targetState returns the ConfigHash and config of an object on a worker group, or "" and nil if it doesn't exist there
+func targetState(targetBaseApiUrl string, workerGroup string, targetToken string, objType string, objId string) (string, []byte, error) {
+	currentConfigBytes, getErr := functions.GetDataObj(targetBaseApiUrl, workerGroup, targetToken, objId, objType)
+	if errors.Is(getErr, functions.ErrObjNotFound) {
+		return "", nil, nil
+	}
+	if getErr != nil {
+		return "", nil, getErr
+	}
+	currentHash, hashErr := functions.ConfigHash(currentConfigBytes)
+	return currentHash, currentConfigBytes, hashErr
 }
+
+// planConfig records what replicateConfig would send to each worker group, and the state it expects to find there,
+// in a signed plan file instead of changing anything
+func planConfig(action string, targetBaseApiUrl string, targetWorkerGroups []string, targetToken string, objType string, objId string, objectConfigBytes []byte, opts replicateOptions) *runSummary {
+	summary := newRunSummary(targetWorkerGroups)
+	plan := functions.NewPlan(opts.env, targetBaseApiUrl, action, objType, objId)
+
+	for _, workerGroup := range targetWorkerGroups {
+		if opts.stopRequested() {
+			log.Printf("Stop requested, not planning %s '%s' on remaining worker groups", objType, objId)
+			break
+		}
+
+		currentHash, currentConfigBytes, stateErr := targetState(targetBaseApiUrl, workerGroup, targetToken, objType, objId)
+		switch {
+		case stateErr != nil:
+		case action == "create" && currentConfigBytes != nil:
+			stateErr = fmt.Errorf("it already exists")
+		case action == "update" && currentConfigBytes == nil:
+			stateErr = fmt.Errorf("it doesn't exist")
+		}
+		if stateErr != nil {
+			log.Printf("Skipped planning %s %s '%s' on worker group '%s' due to the following error: %v", action, objType, objId, workerGroup, stateErr)
+			summary.fail(workerGroup, stateErr)
+			continue
+		}
+
+		if opts.diffFormat != "" && currentConfigBytes != nil {
+			if _, rendered, diffErr := renderTargetDiff(currentConfigBytes, objectConfigBytes, workerGroup, "template (planned)", opts.diffFormat); diffErr == nil {
+				fmt.Print(rendered)
+			}
+		}
+		plan.Groups = append(plan.Groups, functions.PlanGroup{WorkerGroup: workerGroup, ExpectedHash: currentHash, Payload: objectConfigBytes})
+		log.Printf("Planned %s %s '%s' on worker group '%s'", action, objType, objId, workerGroup)
+		summary.done(workerGroup)
+	}
+
+	if writeErr := functions.WritePlan(opts.planOut, plan, opts.planSigningKey); writeErr != nil {
+		log.Fatal("Fatal error encountered: ", writeErr)
+	}
+	log.Printf("Wrote plan for %d worker group(s) to %s. Run 'apply -plan %s' once it is approved", len(plan.Groups), opts.planOut, opts.planOut)
+	summary.print(objType, objId)
+	return summary
+}
+
+// setAuditLog starts the audit log, keyed with CRIBL_AUDIT_KEY so the chain can't be recomputed by whoever can edit it
+func setAuditLog(auditLogFile string) {
+	auditKey := os.Getenv("CRIBL_AUDIT_KEY")
+	if auditKey == "" {
+		log.Printf("WARNING: CRIBL_AUDIT_KEY is not set, the audit log %s catches accidental edits but can be rewritten undetected", auditLogFile)
+	}
+	if auditErr := functions.SetAuditLog(auditLogFile, auditKey); auditErr != nil {
+		log.Fatal("Fatal error encountered: ", auditErr)
+	}
+}
+
+// leaderFromEnv reads the connection details of the leader whose environment variables start with prefix (TEMPLATE, UAT
+// or PROD) and configures the transport used for it
+func leaderFromEnv(prefix string) (string, string, string, error) {
+	baseUrl := os.Getenv(prefix+"_API_PROTOCOL") + "://" + os.Getenv(prefix+"_HOST")
+	if port := os.Getenv(prefix + "_PORT"); len(strings.TrimSpace(port)) != 0 {
+		baseUrl = baseUrl + ":" + port
+	}
+	if transportErr := functions.ConfigureTransport(baseUrl, functions.TransportSettingsFromEnv(prefix)); transportErr != nil {
+		return "", "", "", transportErr
+	}
+	return baseUrl, os.Getenv(prefix + "_API_USERNAME"), os.Getenv(prefix + "_API_PASSWORD"), nil
+}
+
+// targetEnvPrefix is the environment variable prefix for the target leader of env
+func targetEnvPrefix(env string) string {
+	if strings.ToLower(env) == "prod" {
+		return "PROD"
+	}
+	return "UAT"
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, isCommand := commands[os.Args[1]]; isCommand {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	var (
-		templateProtocol, templateHost, templatePort, templateWorkerGroup, templateUser, templatePass, targetProtocol, targetHost, targetPort, targetUser, targetPass, templateUrl, targetUrl string
 		//action vars.Action
-		env      vars.Env
-		action   vars.Action
-		objType  vars.ObjType
-		objId    vars.Id
-		targetWG vars.WorkerGroupList
+		env                 vars.Env
+		action              vars.Action
+		objType             vars.ObjType
+		objId               vars.Id
+		targetWG            vars.WorkerGroupList
+		opts                replicateOptions
+		stateFile           string
+		auditLogFile        string
+		verifyIgnore        string
+		lockDir             string
+		lockTtl             time.Duration
+		leaderLock          bool
+		policyFile          string
+		notificationMapFile string
+		idMapFile           string
+		idMappings          string
+		secretsFile         string
+		certExpiryWarnDays  int
+		requestTimeout      time.Duration
+		transferTimeout     time.Duration
+		runTimeout          time.Duration
+		lookupRulesFile     string
 	)
 	// Global Var Loading
 	flag.Var(&env, "env", "Set the env (Uat or Prod)")
 	flag.Var(&action, "action", "Set the action (Create or Update)")
-	flag.Var(&objType, "objType", "Defines the object type of the configuration item that we are targeting (Source, Destination, Pipeline, Pack, GlobalVariable, or Lookup)")
+	flag.Var(&objType, "objType", "Defines the object type of the configuration item that we are targeting (Source, Destination, Pipeline, Pack, GlobalVariable, Lookup, EventBreaker, Parser, Regex, Grok, Schema, ParquetSchema, Collector, NotificationTarget, Notification, or Certificate)")
 	flag.Var(&objId, "id", "Set the id for configuration item you're looking to target")
 	flag.Var(&targetWG, "wgList", "List of worker groups to target")
+	flag.StringVar(&opts.previewSample, "previewSample", "", "(Optional) File of sample events (JSON array or NDJSON) to run a pipeline through on the template leader before pushing it")
+	flag.StringVar(&opts.previewExpected, "previewExpected", "", "(Optional) File of expected pipeline output events for -previewSample. The push is aborted if the preview output differs")
+
+	flag.BoolVar(&opts.deployDisabled, "deployDisabled", false, "(Optional) Deploy Collector jobs with their schedule disabled so they don't run before the target is ready")
+	flag.StringVar(&notificationMapFile, "notificationMap", "", "(Optional) File mapping template notification target ids to target environment ids. Without it, notifications attached to objects are not copied and a notification's targets must exist on the target worker groups under the same ids")
+	flag.StringVar(&idMapFile, "idMapFile", "", "(Optional) JSON file of template ids to copy under a different id on the target, by object type, e.g. {\"destination\": {\"uat_hec\": \"prod_hec\"}}. Type \"*\" applies to every object type")
+	flag.StringVar(&idMappings, "idMap", "", "(Optional) Comma separated [type:]from=to ids to copy under a different id on the target, e.g. destination:uat_hec=prod_hec. Without a type the id is renamed for every object type, typed mappings win over it. Merged with -idMapFile, replacing its mapping of the same type and id. References to mapped ids in the copied object are rewritten")
+	flag.StringVar(&secretsFile, "secrets", "", "(Optional) Encrypted secrets file (see secrets-encrypt), or 'env' for environment variables only. Referenced secrets are created/updated on each target worker group")
+	flag.IntVar(&certExpiryWarnDays, "certExpiryWarnDays", 30, "(Optional) Warn when a replicated Certificate expires within this many days")
+	flag.BoolVar(&opts.allowPrivateKeys, "allowPrivateKeys", false, "(Optional) Allow Certificate objects that include a private key to be copied")
+	flag.DurationVar(&requestTimeout, "requestTimeout", 60*time.Second, "(Optional) Timeout for each attempt of an API call")
+	flag.DurationVar(&transferTimeout, "transferTimeout", 30*time.Minute, "(Optional) Timeout for each attempt of a lookup file upload or download")
+	flag.DurationVar(&runTimeout, "runTimeout", 0, "(Optional) Timeout for the whole run, e.g. 15m. In-flight requests are cancelled when it expires")
+	flag.StringVar(&lookupRulesFile, "lookupRules", "", "(Optional) File of extra CSV Lookup checks: required columns, a key column that must be unique, and column types")
+	flag.StringVar(&opts.diffFormat, "diff", "", "(Optional) Print the differences between the template object and each target worker group's before updating it, with credentials redacted: color, plain, or markdown")
+	flag.StringVar(&opts.planOut, "planOut", "", "(Optional) Write a signed plan of the change to this file instead of making it. Needs CRIBL_PLAN_SIGNING_KEY")
+	flag.StringVar(&stateFile, "stateFile", defaultStateFile, "(Optional) Local file recording what was deployed to each worker group, see the state command. Empty to not record")
+	flag.StringVar(&auditLogFile, "auditLog", defaultAuditLogFile, "(Optional) Append-only, hash chained log of every attempted change on a leader, HMACed with CRIBL_AUDIT_KEY when set, see the audit-verify command. Empty to not log")
+	flag.BoolVar(&opts.canary, "canary", false, "(Optional) Roll out in waves: the first worker group in -wgList is a canary, the rest follow in waves of -waveSize. Each wave is committed and deployed, with any other pending changes in its groups, and must pass health gates before the next starts")
+	flag.IntVar(&opts.waveSize, "waveSize", 0, "(Optional) Worker groups per wave after the -canary group, 0 for all remaining groups at once")
+	flag.DurationVar(&opts.healthWait, "healthWait", 2*time.Minute, "(Optional) How long to let each -canary wave run before checking its health")
+	flag.Float64Var(&opts.maxErrorRate, "maxErrorRate", 0.01, "(Optional) Highest share of received events a -canary wave's groups may drop after the change, e.g. 0.01 for 1%")
+	flag.BoolVar(&opts.rollbackOnFail, "rollbackOnFail", false, "(Optional) When a -canary health gate fails, restore every worker group changed in the run to its previous config")
+	flag.BoolVar(&opts.verify, "verify", true, "(Optional) Read each object back after it is pushed and fail the worker group if fields were dropped or changed")
+	flag.StringVar(&verifyIgnore, "verifyIgnore", "", "(Optional) Comma separated paths that are expected to differ after -verify, e.g. conf.output,description")
+	flag.BoolVar(&opts.force, "force", false, "(Optional) Update worker groups even if their object was edited by someone else after the run started")
+	flag.StringVar(&lockDir, "lockDir", defaultLockDir, "(Optional) Directory of lock files that stop two runs changing the same worker group at once. Empty to not lock")
+	flag.DurationVar(&lockTtl, "lockTtl", time.Hour, "(Optional) How long a run's locks last unless renewed. They are renewed while the run is going, so this is how long a run that died keeps them")
+	flag.BoolVar(&leaderLock, "leaderLock", false, "(Optional) Also lock each worker group on the leader with a marker global variable, for operators on other machines. A run that died leaves it behind, remove it with force-unlock -leader")
+	flag.StringVar(&policyFile, "policy", "", "(Optional) Policy file of rules checked against the object before it is pushed. Blocking rules abort the run")
 
 	flag.Parse()
 
+	requiredFlags := map[string]bool{"env": true, "action": true, "objType": true, "id": true, "wgList": true}
+
 	var missingFlags []string
 	flag.VisitAll(func(f *flag.Flag) {
+		if !requiredFlags[f.Name] {
+			return
+		}
 		fmt.Println(f.Name)
 		fmt.Println(f.Value)
 		if f.Value.String() == "" {
@@ -144,42 +812,102 @@ func main() {
 		log.Fatalf("The following flags are missing: [%v]. Refer to -help or -h for details on the expected flags", strings.Join(missingFlags, ", "))
 	}
 
+	if (opts.previewSample == "") != (opts.previewExpected == "") {
+		log.Fatal("-previewSample and -previewExpected must be provided together")
+	}
+
+	if opts.rollbackOnFail && !opts.canary {
+		log.Fatal("-rollbackOnFail needs -canary, rollbacks are triggered by its health gates")
+	}
+	if opts.canary && opts.planOut != "" {
+		log.Fatal("-canary can't be combined with -planOut, plans are applied without health gates")
+	}
+
+	if opts.diffFormat != "" && !functions.IsDiffFormat(opts.diffFormat) {
+		log.Fatalf("Invalid -diff format %s. Valid options are: color, plain, or markdown", opts.diffFormat)
+	}
+
+	opts.env = strings.ToLower(string(env))
+	opts.verifyIgnore = splitFieldPaths(verifyIgnore)
+	opts.certExpiryWarn = time.Duration(certExpiryWarnDays) * 24 * time.Hour
+	functions.SetTimeouts(requestTimeout, transferTimeout)
+	opts.stop = handleInterrupts(runTimeout)
+	if stateFile != "" && opts.planOut == "" {
+		opts.state = functions.OpenStateStore(stateFile)
+	}
+	if policyFile != "" {
+		policy, policyErr := functions.LoadPolicy(policyFile)
+		if policyErr != nil {
+			log.Fatal("Fatal error encountered: ", policyErr)
+		}
+		opts.policy = policy
+	}
+	if lookupRulesFile != "" {
+		lookupRules, rulesErr := functions.LoadLookupCsvRules(lookupRulesFile)
+		if rulesErr != nil {
+			log.Fatal("Fatal error encountered: ", rulesErr)
+		}
+		opts.lookupRules = lookupRules
+	}
+	if notificationMapFile != "" {
+		notificationTargets, mapErr := functions.LoadNotificationTargetMap(notificationMapFile, opts.env)
+		if mapErr != nil {
+			log.Fatal("Fatal error encountered: ", mapErr)
+		}
+		opts.notificationTargets = notificationTargets
+	}
+	if idMapFile != "" {
+		idMap, mapErr := functions.LoadIdMap(idMapFile)
+		if mapErr != nil {
+			log.Fatal("Fatal error encountered: ", mapErr)
+		}
+		opts.idMap = idMap
+	}
+	if idMappings != "" {
+		if opts.idMap == nil {
+			opts.idMap = functions.IdMap{}
+		}
+		if mapErr := opts.idMap.ParseIdMappings(idMappings); mapErr != nil {
+			log.Fatal("Fatal error encountered: ", mapErr)
+		}
+	}
+
 	err := godotenv.Load()
 	if err != nil {
 		fmt.Println("Error loading .env file, relying on environment variables alone")
 	}
-	templateProtocol = os.Getenv("TEMPLATE_API_PROTOCOL")
-	templateHost = os.Getenv("TEMPLATE_HOST")
-	templatePort = os.Getenv("TEMPLATE_PORT")
-	templateWorkerGroup = os.Getenv("TEMPLATE_WORKER_GROUP")
-	templateUser = os.Getenv("TEMPLATE_API_USERNAME")
-	templatePass = os.Getenv("TEMPLATE_API_PASSWORD")
-
-	if strings.ToLower(string(env)) == "prod" {
-		targetProtocol = os.Getenv("PROD_API_PROTOCOL")
-		targetHost = os.Getenv("PROD_HOST")
-		targetPort = os.Getenv("PROD_PORT")
-		targetUser = os.Getenv("PROD_API_USERNAME")
-		targetPass = os.Getenv("PROD_API_PASSWORD")
-	} else {
-		// if strings.ToLower(string(env)) != "uat" {
-		// 	vars.InputEnv = "UAT (Defaulted)"
-		// }
-		targetProtocol = os.Getenv("UAT_API_PROTOCOL")
-		targetHost = os.Getenv("UAT_HOST")
-		targetPort = os.Getenv("UAT_PORT")
-		targetUser = os.Getenv("UAT_API_USERNAME")
-		targetPass = os.Getenv("UAT_API_PASSWORD")
+	if auditLogFile != "" {
+		setAuditLog(auditLogFile)
+	}
+	if secretsFile != "" {
+		if secretsFile == "env" {
+			secretsFile = ""
+		}
+		secretStore, secretsErr := functions.LoadSecretStore(secretsFile, os.Getenv("CRIBL_SECRETS_PASSPHRASE"), opts.env)
+		if secretsErr != nil {
+			log.Fatal("Fatal error encountered: ", secretsErr)
+		}
+		opts.secrets = secretStore
 	}
 
-	templateUrl = templateProtocol + "://" + templateHost
-	if len(strings.TrimSpace(templatePort)) != 0 {
-		templateUrl = templateUrl + ":" + templatePort
+	if opts.planOut != "" {
+		if opts.secrets != nil {
+			log.Fatal("-planOut can't be combined with -secrets, the plan file would hold secret values")
+		}
+		opts.planSigningKey = os.Getenv("CRIBL_PLAN_SIGNING_KEY")
+		if opts.planSigningKey == "" {
+			log.Fatal("CRIBL_PLAN_SIGNING_KEY must be set to sign the plan file")
+		}
 	}
 
-	targetUrl = targetProtocol + "://" + targetHost
-	if len(strings.TrimSpace(targetPort)) != 0 {
-		targetUrl = targetUrl + ":" + targetPort
+	templateWorkerGroup := os.Getenv("TEMPLATE_WORKER_GROUP")
+	templateUrl, templateUser, templatePass, transportErr := leaderFromEnv("TEMPLATE")
+	if transportErr != nil {
+		log.Fatal("Fatal error encountered: ", transportErr)
+	}
+	targetUrl, targetUser, targetPass, transportErr := leaderFromEnv(targetEnvPrefix(string(env)))
+	if transportErr != nil {
+		log.Fatal("Fatal error encountered: ", transportErr)
 	}
 
 	log.Print("Running tool with the following settings:")
@@ -195,14 +923,62 @@ func main() {
 	if targetTokenErr != nil {
 		log.Fatal("Fatal error encountered: ", targetTokenErr)
 	}
+	if lockDir != "" && opts.planOut == "" {
+		opts.locker = functions.NewRunLocker(lockDir, lockTtl)
+		if leaderLock {
+			opts.locker.WithLeaderLock(targetUrl, targetToken)
+		}
+	}
 	//fmt.Println("Token here:", val)
 
 	// getWorkerGroups(token)
+	var summary *runSummary
 	switch strings.ToLower(string(action)) {
 	case "create":
-		replicateConfigCreate(templateUrl, templateWorkerGroup, templateToken, targetUrl, targetWG, targetToken, string(objType), string(objId))
+		summary = replicateConfigCreate(templateUrl, templateWorkerGroup, templateToken, targetUrl, targetWG, targetToken, string(objType), string(objId), opts)
 	case "update":
-		replicateConfigPatch(templateUrl, templateWorkerGroup, templateToken, targetUrl, targetWG, targetToken, string(objType), string(objId))
+		summary = replicateConfigPatch(templateUrl, templateWorkerGroup, templateToken, targetUrl, targetWG, targetToken, string(objType), string(objId), opts)
 
 	}
+
+	if summary != nil {
+		if code := summary.exitCode(opts.stopRequested()); code != 0 {
+			os.Exit(code)
+		}
+	}
+}
+
+// handleInterrupts returns a context that is cancelled when the run should stop starting new work. The first
+// SIGINT/SIGTERM lets in-flight requests finish, a second one (or the run timeout expiring) cancels them.
+func handleInterrupts(runTimeout time.Duration) context.Context {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	return watchInterrupts(signals, runTimeout)
+}
+
+// watchInterrupts is handleInterrupts for signals delivered on a channel
+func watchInterrupts(signals <-chan os.Signal, runTimeout time.Duration) context.Context {
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	if runTimeout > 0 {
+		requestCtx, cancelRequests = context.WithTimeout(context.Background(), runTimeout)
+	}
+	functions.SetRunContext(requestCtx)
+	stopCtx, stopRun := context.WithCancel(requestCtx)
+
+	go func() {
+		<-signals
+		log.Print("Interrupt received, finishing in-flight requests then stopping. Interrupt again to cancel them")
+		stopRun()
+		<-signals
+		log.Print("Second interrupt received, cancelling in-flight requests")
+		cancelRequests()
+	}()
+	go func() {
+		<-requestCtx.Done()
+		if requestCtx.Err() == context.DeadlineExceeded {
+			log.Printf("Run timeout of %s reached, cancelling in-flight requests", runTimeout)
+		}
+	}()
+
+	return stopCtx
 }
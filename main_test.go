@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"criblPatching/fakeleader"
+	"criblPatching/functions"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testUser = "admin"
+	testPass = "secret"
+)
+
+// newTestLeaders starts a template leader with a "default" group and a target leader with the given groups
+func newTestLeaders(t *testing.T, targetGroups ...string) (*fakeleader.Leader, string, *fakeleader.Leader, string) {
+	t.Helper()
+
+	template := fakeleader.New(testUser, testPass, "default")
+	t.Cleanup(template.Close)
+	target := fakeleader.New(testUser, testPass, targetGroups...)
+	t.Cleanup(target.Close)
+
+	templateToken, err := functions.TokenApiCall(template.URL, testUser, testPass)
+	if err != nil {
+		t.Fatalf("template login failed: %v", err)
+	}
+	targetToken, err := functions.TokenApiCall(target.URL, testUser, testPass)
+	if err != nil {
+		t.Fatalf("target login failed: %v", err)
+	}
+
+	return template, templateToken, target, targetToken
+}
+
+func gzipBytes(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzWriter := gzip.NewWriter(&buf)
+	gzWriter.Write(content)
+	if err := gzWriter.Close(); err != nil {
+		t.Fatalf("gzip failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestTokenApiCallRejectsBadCredentials(t *testing.T) {
+	leader := fakeleader.New(testUser, testPass)
+	defer leader.Close()
+
+	if _, err := functions.TokenApiCall(leader.URL, testUser, "wrong"); err == nil {
+		t.Fatal("expected login with the wrong password to fail")
+	}
+}
+
+func TestReplicateConfigCreate(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	template.SetObject("default", "pipelines", "main", map[string]interface{}{
+		"conf": map[string]interface{}{"functions": []interface{}{map[string]interface{}{"id": "eval"}}},
+	})
+
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2"}, targetToken, "pipeline", "main", replicateOptions{})
+
+	for _, group := range []string{"wg1", "wg2"} {
+		obj, ok := target.Object(group, "pipelines", "main")
+		if !ok {
+			t.Fatalf("pipeline was not created on %s", group)
+		}
+		if _, hasStatus := obj["status"]; hasStatus {
+			t.Errorf("runtime status field was copied to %s", group)
+		}
+	}
+}
+
+func TestReplicateKnowledgeObjects(t *testing.T) {
+	tests := []struct {
+		objType, collection, id string
+		config, updated         map[string]interface{}
+	}{
+		{"eventbreaker", "lib/breakers", "syslog_breaker",
+			map[string]interface{}{"lib": "custom", "rules": []interface{}{map[string]interface{}{"name": "syslog", "condition": "true", "type": "regex", "eventBreakerRegex": "/[\\n\\r]+/"}}},
+			map[string]interface{}{"lib": "custom", "rules": []interface{}{map[string]interface{}{"name": "syslog", "condition": "true", "type": "regex", "eventBreakerRegex": "/[\\n\\r]+(?=<\\d+>)/"}}}},
+		{"parser", "lib/parsers", "access_log",
+			map[string]interface{}{"lib": "custom", "type": "csv", "fields": []interface{}{"host", "status"}},
+			map[string]interface{}{"lib": "custom", "type": "csv", "fields": []interface{}{"host", "status", "bytes"}}},
+		{"regex", "lib/regex", "ipv4",
+			map[string]interface{}{"lib": "custom", "regex": "/\\d+\\.\\d+\\.\\d+\\.\\d+/"},
+			map[string]interface{}{"lib": "custom", "regex": "/\\b\\d{1,3}(\\.\\d{1,3}){3}\\b/"}},
+		{"grok", "lib/grok", "custom.grok",
+			map[string]interface{}{"size": 30, "content": "STATUS [0-9]{3}"},
+			map[string]interface{}{"size": 34, "content": "STATUS [1-5][0-9]{2}"}},
+		{"schema", "lib/schemas", "order",
+			map[string]interface{}{"schema": `{"type": "object", "required": ["id"]}`},
+			map[string]interface{}{"schema": `{"type": "object", "required": ["id", "total"]}`}},
+		{"parquetschema", "lib/parquet-schemas", "orders_parquet",
+			map[string]interface{}{"schema": `{"fields": {"id": {"type": "STRING"}}}`},
+			map[string]interface{}{"schema": `{"fields": {"id": {"type": "STRING"}, "total": {"type": "DOUBLE"}}}`}},
+	}
+	for _, test := range tests {
+		t.Run(test.objType, func(t *testing.T) {
+			template, templateToken, target, targetToken := newTestLeaders(t, "wg1")
+			template.SetObject("default", test.collection, test.id, test.config)
+
+			summary := replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, test.objType, test.id, replicateOptions{verify: true})
+			if status, err := summary.result("wg1"); status != groupDone {
+				t.Fatalf("create: expected wg1 to be done, got %s: %v", status, err)
+			}
+			created, _ := target.Object("wg1", test.collection, test.id)
+			if changes := functions.DiffConfigs(test.config, created, []string{"id"}); len(changes) != 0 {
+				t.Errorf("create: expected the template's config, got %s", functions.DescribeChanges(changes))
+			}
+
+			template.SetObject("default", test.collection, test.id, test.updated)
+			summary = replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, test.objType, test.id, replicateOptions{verify: true})
+			if status, err := summary.result("wg1"); status != groupDone {
+				t.Fatalf("update: expected wg1 to be done, got %s: %v", status, err)
+			}
+			updated, _ := target.Object("wg1", test.collection, test.id)
+			if changes := functions.DiffConfigs(test.updated, updated, []string{"id"}); len(changes) != 0 {
+				t.Errorf("update: expected the template's new config, got %s", functions.DescribeChanges(changes))
+			}
+		})
+	}
+}
+
+func TestReplicateCollectorsDeployedDisabled(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1")
+	template.SetObject("default", "lib/jobs", "scheduled", map[string]interface{}{
+		"type": "collection", "schedule": map[string]interface{}{"enabled": true, "cronSchedule": "*/5 * * * *"},
+	})
+	template.SetObject("default", "lib/jobs", "adhoc", map[string]interface{}{"type": "collection"})
+
+	opts := replicateOptions{deployDisabled: true}
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "collector", "scheduled", opts)
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "collector", "adhoc", opts)
+
+	scheduled, _ := target.Object("wg1", "lib/jobs", "scheduled")
+	schedule, _ := scheduled["schedule"].(map[string]interface{})
+	if schedule["enabled"] != false || schedule["cronSchedule"] != "*/5 * * * *" {
+		t.Errorf("expected the schedule to be kept but disabled, got %v", scheduled["schedule"])
+	}
+	adhoc, _ := target.Object("wg1", "lib/jobs", "adhoc")
+	if _, hasSchedule := adhoc["schedule"]; hasSchedule {
+		t.Errorf("expected a job with no schedule to be left without one, got %v", adhoc["schedule"])
+	}
+}
+
+func TestReplicateConfigPatch(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1")
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	target.SetObject("wg1", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+
+	replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "globalvariable", "region", replicateOptions{})
+
+	obj, _ := target.Object("wg1", "lib/vars", "region")
+	if obj["value"] != "'us-east-1'" {
+		t.Errorf("expected global variable to be updated, got %v", obj["value"])
+	}
+}
+
+func TestRunTimeoutCancelsInFlightRequests(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	for _, group := range []string{"wg1", "wg2"} {
+		target.SetObject(group, "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+	}
+	var patches atomic.Int32
+	target.OnRequest(func(req fakeleader.RecordedRequest) {
+		if req.Method == http.MethodPatch {
+			patches.Add(1)
+			time.Sleep(time.Second)
+		}
+	})
+	t.Cleanup(func() { functions.SetRunContext(context.Background()) })
+
+	start := time.Now()
+	opts := replicateOptions{force: true, stop: watchInterrupts(make(chan os.Signal), 200*time.Millisecond)}
+	summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2"}, targetToken, "globalvariable", "region", opts)
+
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("expected the update in flight to be cancelled when the run timed out, the run took %s", elapsed)
+	}
+	if status, _ := summary.result("wg1"); status != groupFailed || patches.Load() != 1 {
+		t.Errorf("expected wg1 to fail without a retry, got %s after %d attempt(s)", status, patches.Load())
+	}
+	if status, _ := summary.result("wg2"); status != groupUntouched {
+		t.Errorf("expected wg2 not to be started once the run timed out, got %s", status)
+	}
+	if code := summary.exitCode(opts.stopRequested()); code != 1 {
+		t.Errorf("expected a timed out run to exit 1, got %d", code)
+	}
+}
+
+func TestInterruptStopsBetweenWorkerGroups(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2", "wg3")
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	for _, group := range []string{"wg1", "wg2", "wg3"} {
+		target.SetObject(group, "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+	}
+	t.Cleanup(func() { functions.SetRunContext(context.Background()) })
+	signals := make(chan os.Signal, 2)
+	opts := replicateOptions{force: true, stop: watchInterrupts(signals, 0)}
+	// The operator interrupts while wg1 is being updated
+	target.OnRequest(func(req fakeleader.RecordedRequest) {
+		if req.Method == http.MethodPatch && strings.Contains(req.Path, "/m/wg1/") {
+			signals <- os.Interrupt
+			<-opts.stop.Done()
+		}
+	})
+
+	summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2", "wg3"}, targetToken, "globalvariable", "region", opts)
+
+	if done := summary.groups(groupDone); len(done) != 1 || done[0] != "wg1" {
+		t.Errorf("expected the update in flight on wg1 to finish, got %v done", done)
+	}
+	if untouched := summary.groups(groupUntouched); len(untouched) != 2 {
+		t.Errorf("expected wg2 and wg3 not to be started, got %v untouched", untouched)
+	}
+	if code := summary.exitCode(opts.stopRequested()); code != 1 {
+		t.Errorf("expected a stopped run to exit 1, got %d", code)
+	}
+	if code := newRunSummary(nil).exitCode(true); code != 0 {
+		t.Errorf("expected a run stopped with nothing left to do to exit 0, got %d", code)
+	}
+}
+
+func TestInterruptStopsBetweenWaves(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2", "wg3")
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	for _, group := range []string{"wg1", "wg2", "wg3"} {
+		target.SetObject(group, "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+		target.AddMetric(group, "total.in_events", 1000)
+	}
+	t.Cleanup(func() { functions.SetRunContext(context.Background()) })
+	signals := make(chan os.Signal, 2)
+	opts := replicateOptions{canary: true, waveSize: 1, healthWait: time.Millisecond, maxErrorRate: 0.01, force: true, stop: watchInterrupts(signals, 0)}
+	// The operator interrupts while the canary wave is being deployed
+	target.OnRequest(func(req fakeleader.RecordedRequest) {
+		if req.Method == http.MethodPatch && req.Path == "/api/v1/master/groups/wg1/deploy" {
+			signals <- os.Interrupt
+			<-opts.stop.Done()
+		}
+	})
+
+	summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2", "wg3"}, targetToken, "globalvariable", "region", opts)
+
+	if target.Deployed("wg1") == "" {
+		t.Error("expected the canary deploy in flight to finish")
+	}
+	if untouched := summary.groups(groupUntouched); len(untouched) != 2 || target.Deployed("wg2") != "" {
+		t.Errorf("expected the next waves not to be started, got %v untouched", untouched)
+	}
+	if code := summary.exitCode(opts.stopRequested()); code != 1 {
+		t.Errorf("expected a stopped rollout to exit 1, got %d", code)
+	}
+}
+
+func TestReplicateConfigPatchFailureInjection(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2", "wg3")
+	template.SetObject("default", "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "host": "new"})
+	for _, group := range []string{"wg1", "wg2", "wg3"} {
+		target.SetObject(group, "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "host": "old"})
+	}
+
+	// wg1 rejects the change outright, wg2 has a transient error that should be retried
+	target.InjectFailure(fakeleader.Failure{Method: http.MethodPatch, PathContains: "/m/wg1/", Status: http.StatusBadRequest})
+	target.InjectFailure(fakeleader.Failure{Method: http.MethodPatch, PathContains: "/m/wg2/", Status: http.StatusServiceUnavailable, Times: 2})
+
+	summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2", "wg3"}, targetToken, "destination", "splunk", replicateOptions{})
+	if code := summary.exitCode(false); code != 1 {
+		t.Errorf("expected a run with a failed worker group to exit 1, got %d", code)
+	}
+
+	expected := map[string]string{"wg1": "old", "wg2": "new", "wg3": "new"}
+	for group, host := range expected {
+		obj, _ := target.Object(group, "system/outputs", "splunk")
+		if obj["host"] != host {
+			t.Errorf("%s: expected host %q, got %v", group, host, obj["host"])
+		}
+	}
+}
+
+func TestCreateExistingObjectIsNotRetried(t *testing.T) {
+	_, _, target, targetToken := newTestLeaders(t, "wg1")
+	target.SetObject("wg1", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+
+	createErr := functions.CreateDataObj(target.URL, "wg1", targetToken, "region", []byte(`{"id":"region","type":"string","value":"'us-east-1'"}`), "globalvariable")
+	if createErr == nil {
+		t.Fatal("expected creating an existing object to fail")
+	}
+	posts := 0
+	for _, req := range target.Requests() {
+		if req.Method == http.MethodPost && req.Path == "/api/v1/m/wg1/lib/vars" {
+			posts++
+		}
+	}
+	if posts != 1 {
+		t.Errorf("expected a rejected create to be sent once, it was sent %d times", posts)
+	}
+}
+
+func TestReplicateLookups(t *testing.T) {
+	csvContent := []byte("host,owner\nweb01,ops\n")
+	gzContent := gzipBytes(t, csvContent)
+
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	template.SetLookup("default", "owners.csv", csvContent)
+	template.SetLookup("default", "owners.csv.gz", gzContent)
+
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "lookup", "owners.csv", replicateOptions{})
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "lookup", "owners.csv.gz", replicateOptions{})
+
+	target.SetLookup("wg2", "owners.csv", []byte("host,owner\n"))
+	target.InjectFailure(fakeleader.Failure{Method: http.MethodPut, PathContains: "/m/wg2/system/lookups", Status: http.StatusBadGateway, Times: 1})
+	replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg2"}, targetToken, "lookup", "owners.csv", replicateOptions{})
+
+	checks := []struct {
+		group, id string
+		want      []byte
+	}{
+		{"wg1", "owners.csv", csvContent},
+		{"wg1", "owners.csv.gz", gzContent},
+		{"wg2", "owners.csv", csvContent},
+	}
+	for _, check := range checks {
+		got, ok := target.Lookup(check.group, check.id)
+		if !ok || !bytes.Equal(got, check.want) {
+			t.Errorf("%s/%s: lookup content not replicated, got %q", check.group, check.id, got)
+		}
+	}
+}
+
+func TestReplicateLookupRejectsCorruptGzip(t *testing.T) {
+	template, templateToken, target, _ := newTestLeaders(t, "wg1")
+	corrupt := gzipBytes(t, []byte("host,owner\nweb01,ops\n"))
+	corrupt[len(corrupt)-5] ^= 0xff
+	template.SetLookup("default", "owners.csv.gz", corrupt)
+
+	if _, err := functions.DownloadLookupToFile(template.URL, "default", templateToken, "owners.csv.gz"); err == nil {
+		t.Fatal("expected corrupt gzip lookup to fail validation")
+	}
+	if _, ok := target.Lookup("wg1", "owners.csv.gz"); ok {
+		t.Fatal("corrupt lookup should not have been uploaded")
+	}
+}
+
+func TestApplyPlanSkipsGroupsChangedSincePlanning(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	for _, group := range []string{"wg1", "wg2"} {
+		target.SetObject(group, "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+	}
+
+	planFile := t.TempDir() + "/plan.json"
+	opts := replicateOptions{planOut: planFile, planSigningKey: "test-key"}
+	replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2"}, targetToken, "globalvariable", "region", opts)
+
+	if obj, _ := target.Object("wg1", "lib/vars", "region"); obj["value"] != "'eu-west-1'" {
+		t.Fatalf("planning changed wg1: %v", obj["value"])
+	}
+	plan, err := functions.LoadPlan(planFile, "test-key")
+	if err != nil {
+		t.Fatalf("unable to load plan: %v", err)
+	}
+	if _, err := functions.LoadPlan(planFile, "other-key"); err == nil {
+		t.Error("expected a plan signed with a different key to be rejected")
+	}
+
+	target.SetObject("wg2", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'ap-south-1'"})
+	for _, group := range plan.Groups {
+		applyErr := applyPlanGroup(target.URL, targetToken, plan, group, true, nil)
+		if group.WorkerGroup == "wg1" && applyErr != nil {
+			t.Errorf("apply to unchanged wg1 failed: %v", applyErr)
+		}
+		if group.WorkerGroup == "wg2" && applyErr == nil {
+			t.Error("expected apply to wg2 to fail after it changed")
+		}
+	}
+
+	if obj, _ := target.Object("wg1", "lib/vars", "region"); obj["value"] != "'us-east-1'" {
+		t.Errorf("wg1 was not updated: %v", obj["value"])
+	}
+	if obj, _ := target.Object("wg2", "lib/vars", "region"); obj["value"] != "'ap-south-1'" {
+		t.Errorf("concurrent change on wg2 was overwritten: %v", obj["value"])
+	}
+}
+
+func TestCanaryRolloutRollsBackWhenGateFails(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2", "wg3")
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	for _, group := range []string{"wg1", "wg2", "wg3"} {
+		target.SetObject(group, "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+	}
+	// The canary's only worker is disconnected, so its health gate fails
+	target.SetWorkers("wg1", 0, 1)
+
+	opts := replicateOptions{canary: true, waveSize: 1, healthWait: time.Millisecond, maxErrorRate: 0.01, rollbackOnFail: true}
+	summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2", "wg3"}, targetToken, "globalvariable", "region", opts)
+
+	if !summary.halted {
+		t.Error("expected the rollout to be halted")
+	}
+	if rolledBack := summary.groups(groupRolledBack); len(rolledBack) != 1 || rolledBack[0] != "wg1" {
+		t.Errorf("expected only wg1 to be rolled back, got %v", rolledBack)
+	}
+	for _, group := range []string{"wg1", "wg2", "wg3"} {
+		if obj, _ := target.Object(group, "lib/vars", "region"); obj["value"] != "'eu-west-1'" {
+			t.Errorf("%s was left changed: %v", group, obj["value"])
+		}
+	}
+	deploys := 0
+	for _, req := range target.Requests() {
+		if req.Method == http.MethodPatch && req.Path == "/api/v1/master/groups/wg1/deploy" {
+			deploys++
+		}
+	}
+	if deploys != 2 {
+		t.Errorf("expected the canary to be deployed before its gate and again after the rollback, got %d deploys", deploys)
+	}
+	if target.Deployed("wg2") != "" || target.Deployed("wg3") != "" {
+		t.Error("groups after the failed canary were deployed")
+	}
+}
+
+func TestCanaryRolloutDeploysEachWaveBeforeItsGate(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	for _, group := range []string{"wg1", "wg2"} {
+		target.SetObject(group, "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'eu-west-1'"})
+		target.AddMetric(group, "total.in_events", 1000)
+	}
+	// The wg2 wave is only checked after it was deployed, its worker restarts and resets its counters
+	target.OnRequest(func(req fakeleader.RecordedRequest) {
+		if req.Method == http.MethodPatch && req.Path == "/api/v1/master/groups/wg2/deploy" {
+			target.AddMetric("wg2", "total.in_events", -900)
+		}
+	})
+
+	opts := replicateOptions{canary: true, waveSize: 1, healthWait: time.Millisecond, maxErrorRate: 0.01}
+	summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2"}, targetToken, "globalvariable", "region", opts)
+
+	if target.Deployed("wg1") == "" || target.Deployed("wg2") == "" {
+		t.Errorf("expected each wave to be deployed, got wg1 %q wg2 %q", target.Deployed("wg1"), target.Deployed("wg2"))
+	}
+	if !summary.halted {
+		t.Error("expected the wave whose counters were reset to fail its gate")
+	}
+}
+
+func TestConcurrentEditIsDetected(t *testing.T) {
+	_, _, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	for _, group := range []string{"wg1", "wg2"} {
+		target.SetObject(group, "pipelines", "main", map[string]interface{}{"conf": map[string]interface{}{"output": "default"}})
+	}
+
+	startHashes := snapshotTargetHashes(target.URL, []string{"wg1", "wg2"}, targetToken, "pipeline", "main")
+	// Someone edits wg2 in the UI while the run is in progress
+	target.SetObject("wg2", "pipelines", "main", map[string]interface{}{"conf": map[string]interface{}{"output": "s3"}})
+
+	for group, wantConflict := range map[string]bool{"wg1": false, "wg2": true} {
+		currentHash, _, err := targetState(target.URL, group, targetToken, "pipeline", "main")
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", group, err)
+		}
+		if conflictErr := checkConcurrentEdit(startHashes[group], currentHash); (conflictErr != nil) != wantConflict {
+			t.Errorf("%s: expected conflict %v, got %v", group, wantConflict, conflictErr)
+		}
+	}
+}
+
+func TestReplicateConfigUnderMappedId(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1")
+	template.SetObject("default", "system/inputs", "uat_http", map[string]interface{}{
+		"id":          "uat_http",
+		"type":        "http",
+		"connections": []interface{}{map[string]interface{}{"pipeline": "uat_main", "output": "uat_hec"}},
+	})
+	idMap := functions.IdMap{}
+	if err := idMap.ParseIdMappings("source:uat_http=prod_http,destination:uat_hec=prod_hec,uat_main=prod_main"); err != nil {
+		t.Fatalf("unable to parse id mappings: %v", err)
+	}
+
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "source", "uat_http", replicateOptions{idMap: idMap})
+
+	if _, exists := target.Object("wg1", "system/inputs", "uat_http"); exists {
+		t.Error("source was created under its template id")
+	}
+	obj, ok := target.Object("wg1", "system/inputs", "prod_http")
+	if !ok {
+		t.Fatal("source was not created under its mapped id")
+	}
+	connection := obj["connections"].([]interface{})[0].(map[string]interface{})
+	if obj["id"] != "prod_http" || connection["pipeline"] != "prod_main" || connection["output"] != "prod_hec" {
+		t.Errorf("ids were not remapped consistently: %v", obj)
+	}
+}
+
+func TestPreGatesCheckTheConfigPreparedForTheTarget(t *testing.T) {
+	source := []byte(`{"id": "uat_http", "type": "http", "connections": [{"pipeline": "main", "output": "uat_hec"}]}`)
+	idMap := functions.IdMap{}
+	if err := idMap.ParseIdMappings("destination:uat_hec=prod_hec"); err != nil {
+		t.Fatalf("unable to parse id mappings: %v", err)
+	}
+	loadPolicy := func(assert string) *functions.Policy {
+		policyFile := filepath.Join(t.TempDir(), "policy.json")
+		os.WriteFile(policyFile, []byte(`{"rules": [{"name": "prod-outputs", "objTypes": ["source"], "path": "connections[*].output",
+			"assert": "`+assert+`", "values": ["prod_hec"], "levels": {"prod": "block"}}]}`), 0600)
+		policy, err := functions.LoadPolicy(policyFile)
+		if err != nil {
+			t.Fatalf("unable to load policy: %v", err)
+		}
+		return policy
+	}
+
+	opts := replicateOptions{env: "prod", idMap: idMap, policy: loadPolicy("allowed")}
+	prepared, _, err := prepareAndCheck("", "", "", "source", "uat_http", source, opts)
+	if err != nil {
+		t.Fatalf("expected the remapped output to pass the policy, got %v", err)
+	}
+	if !bytes.Contains(prepared, []byte("prod_hec")) {
+		t.Errorf("expected the prepared config to be returned, got %s", prepared)
+	}
+
+	opts.policy = loadPolicy("forbidden")
+	if _, _, err := prepareAndCheck("", "", "", "source", "uat_http", source, opts); err == nil || !strings.Contains(err.Error(), "blocked by policy") {
+		t.Errorf("expected the remapped output to be blocked, got %v", err)
+	}
+}
+
+func TestCompareGroupsAcrossLeaders(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1")
+	template.SetObject("default", "pipelines", "main", map[string]interface{}{"conf": map[string]interface{}{"output": "default"}})
+	target.SetObject("wg1", "pipelines", "main", map[string]interface{}{"conf": map[string]interface{}{"output": "s3"}})
+	template.SetObject("default", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	target.SetObject("wg1", "lib/vars", "region", map[string]interface{}{"type": "string", "value": "'us-east-1'"})
+	template.SetObject("default", "lib/vars", "uat_only", map[string]interface{}{"type": "string", "value": "'x'"})
+	template.SetLookup("default", "hosts.csv", []byte("host,owner\na,b\n"))
+	target.SetLookup("wg1", "hosts.csv", []byte("host,owner\na,c\n"))
+	target.SetLookup("wg1", "extra.csv", []byte("k,v\n"))
+	template.SetObject("default", "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "password": "uat-password"})
+	target.SetObject("wg1", "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "password": "prod-password"})
+	// Each leader encrypts with its own key, so the ciphertexts always differ
+	template.SetObject("default", "system/outputs", "hec", map[string]interface{}{"type": "splunk_hec", "token": "#42:uatCipherText"})
+	target.SetObject("wg1", "system/outputs", "hec", map[string]interface{}{"type": "splunk_hec", "token": "#42:prodCipherText"})
+	// The same CSV compressed differently
+	template.SetLookup("default", "zones.csv.gz", gzipBytes(t, []byte("zone,owner\na,b\n")))
+	var fastest bytes.Buffer
+	gzWriter, _ := gzip.NewWriterLevel(&fastest, gzip.BestSpeed)
+	gzWriter.Name = "zones.csv"
+	gzWriter.Write([]byte("zone,owner\na,b\n"))
+	gzWriter.Close()
+	target.SetLookup("wg1", "zones.csv.gz", fastest.Bytes())
+	// A run holding the leader lock on wg1 isn't a difference
+	target.SetObject("wg1", "lib/vars", functions.LeaderLockVarId, map[string]interface{}{"type": "string", "value": "'locked'"})
+
+	comparisons, err := compareGroups(template.URL, "default", templateToken, target.URL, "wg1", targetToken, []string{"globalvariable", "pipeline", "destination", "lookup"}, nil)
+	if err != nil {
+		t.Fatalf("compare failed: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, comparison := range comparisons {
+		got[comparison.ObjType+"/"+comparison.ObjId] = comparison.Status
+	}
+	want := map[string]string{
+		"globalvariable/region":   functions.CompareSame,
+		"globalvariable/uat_only": functions.CompareOnlyLeft,
+		"pipeline/main":           functions.CompareDifferent,
+		"destination/splunk":      functions.CompareDifferent,
+		"destination/hec":         functions.CompareSecretUnknown,
+		"lookup/hosts.csv":        functions.CompareDifferent,
+		"lookup/zones.csv.gz":     functions.CompareSame,
+		"lookup/extra.csv":        functions.CompareOnlyRight,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d objects, got %v", len(want), got)
+	}
+	for key, status := range want {
+		if got[key] != status {
+			t.Errorf("%s: expected %s, got %s", key, status, got[key])
+		}
+	}
+	report, _ := json.Marshal(comparisons)
+	if bytes.Contains(report, []byte("uat-password")) || bytes.Contains(report, []byte("prod-password")) {
+		t.Errorf("expected passwords to be redacted, got %s", report)
+	}
+}
+
+func TestPipelinePreviewGate(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1")
+	template.SetObject("default", "pipelines", "main", map[string]interface{}{
+		"conf": map[string]interface{}{"functions": []interface{}{map[string]interface{}{
+			"id":   "eval",
+			"conf": map[string]interface{}{"add": []interface{}{map[string]interface{}{"name": "env", "value": "'prod'"}}},
+		}}},
+	})
+	dir := t.TempDir()
+	writeFile := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+		return path
+	}
+	sample := writeFile("sample.ndjson", "{\"host\":\"web01\"}\n{\"host\":\"web02\"}\n")
+	expected := writeFile("expected.json", `[{"host":"web01","env":"prod"},{"host":"web02","env":"prod"}]`)
+	wrong := writeFile("wrong.json", `[{"host":"web01","env":"uat"},{"host":"web02","env":"uat"}]`)
+
+	pipelineBytes, err := functions.GetDataObj(template.URL, "default", templateToken, "main", "pipeline")
+	if err != nil {
+		t.Fatalf("unable to read pipeline: %v", err)
+	}
+	if gateErr := runPreGates(template.URL, "default", templateToken, "pipeline", "main", pipelineBytes, replicateOptions{previewSample: sample, previewExpected: wrong}); gateErr == nil {
+		t.Error("expected preview output that differs from the expected events to block the push")
+	}
+
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "pipeline", "main", replicateOptions{previewSample: sample, previewExpected: expected})
+	if _, ok := target.Object("wg1", "pipelines", "main"); !ok {
+		t.Error("pipeline whose preview matches the expected events was not created")
+	}
+}
+
+func TestAuditVerifyReport(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	template.SetObject("default", "pipelines", "main", map[string]interface{}{"conf": map[string]interface{}{}})
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := functions.SetAuditLog(auditPath, "audit key"); err != nil {
+		t.Fatalf("unable to set audit log: %v", err)
+	}
+	t.Cleanup(func() { functions.CloseAuditLog() })
+
+	replicateConfigCreate(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2"}, targetToken, "pipeline", "main", replicateOptions{})
+	functions.CloseAuditLog()
+
+	report, err := auditVerifyReport(auditPath, "audit key", "")
+	if err != nil || !strings.Contains(report, "2 keyed entries verified") {
+		t.Fatalf("expected both creates to be logged and verify, got %q %v", report, err)
+	}
+	if _, err := auditVerifyReport(auditPath, "", ""); err == nil {
+		t.Error("expected verifying a keyed log without the key to fail")
+	}
+
+	head := report[strings.LastIndex(report, " ")+1:]
+	content, _ := os.ReadFile(auditPath)
+	firstLine := content[:bytes.IndexByte(content, '\n')+1]
+	os.WriteFile(auditPath, firstLine, 0600)
+	if _, err := auditVerifyReport(auditPath, "audit key", head); err == nil || !strings.Contains(err.Error(), "1 good entries") {
+		t.Errorf("expected the truncated log to fail against the recorded head, got %v", err)
+	}
+}
+
+func TestVerifyReadBackAgainstLeaderNormalization(t *testing.T) {
+	tests := []struct {
+		name       string
+		onSave     func(collection string, obj map[string]interface{})
+		wantResult string
+	}{
+		{
+			name:       "leader adds a default",
+			onSave:     func(collection string, obj map[string]interface{}) { obj["compress"] = true },
+			wantResult: groupDone,
+		},
+		{
+			name:       "leader stores the port as a number",
+			onSave:     func(collection string, obj map[string]interface{}) { obj["port"] = 8088 },
+			wantResult: groupDone,
+		},
+		{
+			name:       "leader encrypts the password",
+			onSave:     func(collection string, obj map[string]interface{}) { obj["password"] = "#42:ciphertext" },
+			wantResult: groupDone,
+		},
+		{
+			name:       "leader drops a field",
+			onSave:     func(collection string, obj map[string]interface{}) { delete(obj, "host") },
+			wantResult: groupFailed,
+		},
+	}
+	for _, test := range tests {
+		template, templateToken, target, targetToken := newTestLeaders(t, "wg1")
+		template.SetObject("default", "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "host": "new", "port": "8088", "password": "hunter2"})
+		target.SetObject("wg1", "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "host": "old", "port": "8088"})
+		target.OnSave(test.onSave)
+
+		summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1"}, targetToken, "destination", "splunk", replicateOptions{verify: true})
+		if result, resultErr := summary.result("wg1"); result != test.wantResult {
+			t.Errorf("%s: expected wg1 to be %s, got %s (%v)", test.name, test.wantResult, result, resultErr)
+		}
+	}
+}
+
+func TestTargetDiffRedactsCredentials(t *testing.T) {
+	current := []byte(`{"type": "splunk", "host": "old", "password": "#42:ciphertext"}`)
+	// The password was replaced with its plaintext from the secrets store
+	sent := []byte(`{"type": "splunk", "host": "new", "password": "prod-password", "authTokens": [{"token": "prod-token"}]}`)
+
+	for _, format := range []string{functions.DiffFormatPlain, functions.DiffFormatMarkdown} {
+		changes, rendered, err := renderTargetDiff(current, sent, "wg1", "template (to be pushed)", format)
+		if err != nil {
+			t.Fatalf("unable to diff: %v", err)
+		}
+		if len(changes) != 3 {
+			t.Errorf("%s: expected 3 changes, got %v", format, changes)
+		}
+		if strings.Contains(rendered, "prod-password") || strings.Contains(rendered, "prod-token") || strings.Contains(rendered, "ciphertext") {
+			t.Errorf("%s: expected credentials to be redacted, got %s", format, rendered)
+		}
+		if !strings.Contains(rendered, functions.RedactedValue) || !strings.Contains(rendered, "new") {
+			t.Errorf("%s: expected the redacted password and the other changes to be shown, got %s", format, rendered)
+		}
+	}
+}
+
+func TestConflictingGroupKeepsItsConfigAndSecrets(t *testing.T) {
+	template, templateToken, target, targetToken := newTestLeaders(t, "wg1", "wg2")
+	template.SetObject("default", "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "host": "new", "textSecret": "hec_token"})
+	for _, group := range []string{"wg1", "wg2"} {
+		target.SetObject(group, "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "host": "old"})
+	}
+	t.Setenv("CRIBL_SECRET_PROD_HEC_TOKEN", "t0k3n")
+	secrets, err := functions.LoadSecretStore("", "", "prod")
+	if err != nil {
+		t.Fatalf("unable to load secrets: %v", err)
+	}
+
+	// Someone edits wg2 in the UI while wg1 is being updated
+	target.OnRequest(func(req fakeleader.RecordedRequest) {
+		if req.Method == http.MethodPatch && req.Path == "/api/v1/m/wg1/system/outputs/splunk" {
+			target.SetObject("wg2", "system/outputs", "splunk", map[string]interface{}{"type": "splunk", "host": "edited"})
+		}
+	})
+	summary := replicateConfigPatch(template.URL, "default", templateToken, target.URL, []string{"wg1", "wg2"}, targetToken, "destination", "splunk", replicateOptions{env: "prod", secrets: secrets})
+
+	if result, _ := summary.result("wg1"); result != groupDone {
+		t.Errorf("expected wg1 to be updated, got %s", result)
+	}
+	if result, resultErr := summary.result("wg2"); result != groupFailed {
+		t.Errorf("expected wg2 to be reported failed, got %s (%v)", result, resultErr)
+	}
+	if obj, _ := target.Object("wg2", "system/outputs", "splunk"); obj["host"] != "edited" {
+		t.Errorf("the concurrent edit on wg2 was overwritten: %v", obj["host"])
+	}
+	if _, exists := target.Object("wg1", "system/secrets", "hec_token"); !exists {
+		t.Error("expected the secret to be saved on wg1")
+	}
+	if _, exists := target.Object("wg2", "system/secrets", "hec_token"); exists {
+		t.Error("the secret was saved on wg2 even though it was skipped")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	groupUntouched = "untouched"
+	groupDone      = "done"
+	groupFailed    = "failed"
+	// Changed during the run, then restored after a rollout health gate failed
+	groupRolledBack = "rolled back"
+)
+
+// runSummary tracks what happened to each target worker group so a run that is stopped part way through
+// still reports which groups were changed
+type runSummary struct {
+	mu     sync.Mutex
+	order  []string
+	status map[string]string
+	errors map[string]error
+	// Set when a rollout health gate stopped the run
+	halted bool
+}
+
+func newRunSummary(workerGroups []string) *runSummary {
+	summary := &runSummary{status: map[string]string{}, errors: map[string]error{}}
+	for _, workerGroup := range workerGroups {
+		if _, seen := summary.status[workerGroup]; !seen {
+			summary.order = append(summary.order, workerGroup)
+		}
+		summary.status[workerGroup] = groupUntouched
+	}
+	return summary
+}
+
+func (s *runSummary) done(workerGroup string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[workerGroup] = groupDone
+}
+
+func (s *runSummary) fail(workerGroup string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[workerGroup] = groupFailed
+	s.errors[workerGroup] = err
+}
+
+func (s *runSummary) rolledBack(workerGroup string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status[workerGroup] = groupRolledBack
+}
+
+func (s *runSummary) halt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.halted = true
+}
+
+// result returns a worker group's status and, if it failed, why
+func (s *runSummary) result(workerGroup string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status[workerGroup], s.errors[workerGroup]
+}
+
+func (s *runSummary) groups(status string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matching []string
+	for _, workerGroup := range s.order {
+		if s.status[workerGroup] == status {
+			matching = append(matching, workerGroup)
+		}
+	}
+	return matching
+}
+
+func (s *runSummary) failed() bool {
+	return len(s.groups(groupFailed)) > 0
+}
+
+// exitCode is the run's exit status: 1 if a worker group failed, a health gate halted the rollout, or the run was
+// stopped before every worker group was done, otherwise 0
+func (s *runSummary) exitCode(stopRequested bool) int {
+	if s.failed() || s.halted || stopRequested && len(s.groups(groupUntouched)) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (s *runSummary) print(objType string, objId string) {
+	log.Printf("Summary for %s '%s':", objType, objId)
+	for _, status := range []string{groupDone, groupFailed, groupRolledBack, groupUntouched} {
+		workerGroups := s.groups(status)
+		if len(workerGroups) == 0 {
+			continue
+		}
+		log.Printf("  %-11s (%d): %s", status, len(workerGroups), strings.Join(workerGroups, ", "))
+	}
+}
@@ -51,11 +51,13 @@ var InputObjType ObjType
 
 func (e *ObjType) Set(s string) error {
 	switch strings.ToLower(s) {
-	case "source", "destination", "pipeline", "pack", "globalvariable", "lookup":
+	case "source", "destination", "pipeline", "pack", "globalvariable", "lookup",
+		"eventbreaker", "parser", "regex", "grok", "schema", "parquetschema", "collector",
+		"notificationtarget", "notification", "certificate":
 		*e = ObjType(s)
 		return nil
 	default:
-		return fmt.Errorf("invalid Object Type provided: %s. Valid options are: Source, Destination, Pipeline, Pack, GlobalVariable, or Lookup", s)
+		return fmt.Errorf("invalid Object Type provided: %s. Valid options are: Source, Destination, Pipeline, Pack, GlobalVariable, Lookup, EventBreaker, Parser, Regex, Grok, Schema, ParquetSchema, Collector, NotificationTarget, Notification, or Certificate", s)
 	}
 
 }
@@ -70,12 +72,12 @@ type Id string
 var InputId Id
 
 func (e *Id) Set(s string) error {
-	allowedCharsRegex := regexp.MustCompile(`^[a-zA-Z0-9_-]+(?:\.csv)?$`)
+	allowedCharsRegex := regexp.MustCompile(`^[a-zA-Z0-9_-]+(?:\.csv|\.csv\.gz|\.mmdb)?$`)
 	if allowedCharsRegex.MatchString(s) {
 		*e = Id(s)
 		return nil
 	} else {
-		return fmt.Errorf("invalid Id String: %s. String must be alphanumeric with special characters '-' and '_' allowed or if a lookup, ensure ending is .csv", s)
+		return fmt.Errorf("invalid Id String: %s. String must be alphanumeric with special characters '-' and '_' allowed or if a lookup, ensure ending is .csv, .csv.gz or .mmdb", s)
 	}
 
 }